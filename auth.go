@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ReasonUnauthorized is reported in the ErrorResponse when a request could not be authenticated
+const ReasonUnauthorized = "unauthorized"
+
+// Errors returned by Authenticators
+var (
+	// ErrNoCredentials means the request carries no credentials of the kind the Authenticator understands, so the
+	// next one is tried
+	ErrNoCredentials  = errors.New("no credentials")
+	ErrBadCredentials = errors.New("invalid credentials")
+	ErrExpiredAPIKey  = errors.New("API key has expired")
+)
+
+// Authentication methods recorded on the Principal
+const (
+	AuthMethodAPIKey     = "api_key"
+	AuthMethodJWT        = "jwt"
+	AuthMethodBasic      = "basic"
+	AuthMethodClientCert = "client_cert"
+)
+
+// Principal is who a request was authenticated as
+type Principal struct {
+	Subject string
+	Method  string
+	// Claims holds the token claims for AuthMethodJWT
+	Claims map[string]interface{}
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal Authenticate stored in the context
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Authenticator checks the credentials on a request. It returns ErrNoCredentials when there are none it handles.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator
+type AuthenticatorFunc func(r *http.Request) (Principal, error)
+
+// Authenticate calls f(r)
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Principal, error) {
+	return f(r)
+}
+
+// AuthSpec captures the specification for Authenticate
+type AuthSpec struct {
+	// Authenticators are tried in order until one finds credentials on the request
+	Authenticators []Authenticator
+	// Optional lets requests without credentials through unauthenticated. Bad credentials are still refused.
+	Optional bool
+	// Realm is sent in the WWW-Authenticate header. Defaults to "service".
+	Realm string
+}
+
+// Authenticate refuses requests that none of the spec's Authenticators accept with a 401. The principal of accepted
+// requests is available to handlers through PrincipalFrom.
+func Authenticate(spec AuthSpec) Middleware {
+	if spec.Realm == "" {
+		spec.Realm = "service"
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, a := range spec.Authenticators {
+				p, err := a.Authenticate(r)
+				if err == ErrNoCredentials {
+					continue
+				}
+				if err != nil {
+					Logger(r.Context()).Info("Authentication failed", "method", p.Method, "error", err)
+					unauthorized(w, spec.Realm, "invalid credentials")
+					return
+				}
+				h.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+				return
+			}
+			if spec.Optional {
+				h.ServeHTTP(w, r)
+				return
+			}
+			unauthorized(w, spec.Realm, "authentication required")
+		})
+	}
+}
+
+func unauthorized(w http.ResponseWriter, realm, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`", Basic realm="`+realm+`"`)
+	writeJSONError(w, http.StatusUnauthorized, ReasonUnauthorized, message)
+}
+
+// APIKey is a key a client sends to authenticate as Subject. A zero Expires never expires.
+type APIKey struct {
+	Key     string
+	Subject string
+	Expires time.Time
+}
+
+// APIKeyStore holds the API keys that are accepted. Only a hash of each key is kept. Keys are rotated by adding
+// the new key, letting clients move over and then revoking the old one, or by giving the old one an expiry.
+type APIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[[sha256.Size]byte]APIKey
+	now  func() time.Time
+}
+
+// NewAPIKeyStore returns a store holding keys
+func NewAPIKeyStore(keys ...APIKey) *APIKeyStore {
+	s := &APIKeyStore{keys: make(map[[sha256.Size]byte]APIKey), now: time.Now}
+	for _, k := range keys {
+		s.Add(k)
+	}
+	return s
+}
+
+// Add accepts key, replacing any previous entry for the same key
+func (s *APIKeyStore) Add(key APIKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := sha256.Sum256([]byte(key.Key))
+	key.Key = ""
+	s.keys[sum] = key
+}
+
+// Revoke stops accepting key
+func (s *APIKeyStore) Revoke(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, sha256.Sum256([]byte(key)))
+}
+
+// Lookup returns the subject key belongs to
+func (s *APIKeyStore) Lookup(key string) (string, error) {
+	s.mu.RLock()
+	k, ok := s.keys[sha256.Sum256([]byte(key))]
+	s.mu.RUnlock()
+	if !ok {
+		return "", ErrBadCredentials
+	}
+	if !k.Expires.IsZero() && !s.now().Before(k.Expires) {
+		return "", ErrExpiredAPIKey
+	}
+	return k.Subject, nil
+}
+
+// APIKeyAuthenticator authenticates requests carrying a key from store in header, e.g. "X-API-Key"
+func APIKeyAuthenticator(store *APIKeyStore, header string) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		key := r.Header.Get(header)
+		if key == "" {
+			return Principal{}, ErrNoCredentials
+		}
+		p := Principal{Method: AuthMethodAPIKey}
+		subject, err := store.Lookup(key)
+		if err != nil {
+			return p, err
+		}
+		p.Subject = subject
+		return p, nil
+	})
+}
+
+// dummyHash is compared against for unknown users so they take as long to refuse as known ones
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// BasicAuthenticator authenticates requests with HTTP basic auth against users, a map of user name to bcrypt hash
+func BasicAuthenticator(users map[string][]byte) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			return Principal{}, ErrNoCredentials
+		}
+		p := Principal{Method: AuthMethodBasic}
+		hash, known := users[user]
+		if !known {
+			dummyHashOnce.Do(func() {
+				dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+			})
+			hash = dummyHash
+		}
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !known {
+			return p, ErrBadCredentials
+		}
+		p.Subject = user
+		return p, nil
+	})
+}
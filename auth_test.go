@@ -0,0 +1,110 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// principalHandler echoes the subject of the authenticated principal
+func principalHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := PrincipalFrom(r.Context())
+	if !ok {
+		w.Write([]byte("anonymous"))
+		return
+	}
+	w.Write([]byte(p.Method + ":" + p.Subject))
+}
+
+func TestAuthenticate(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	keys := NewAPIKeyStore(APIKey{Key: "key-1", Subject: "svc-a"})
+	h := Authenticate(AuthSpec{Authenticators: []Authenticator{
+		APIKeyAuthenticator(keys, "X-API-Key"),
+		BasicAuthenticator(map[string][]byte{"alice": hash}),
+	}})(http.HandlerFunc(principalHandler))
+
+	serve := func(prepare func(r *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		prepare(req)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(func(r *http.Request) { r.Header.Set("X-API-Key", "key-1") })
+	if w.Code != http.StatusOK || w.Body.String() != "api_key:svc-a" {
+		t.Error("Expected the API key to authenticate. Got: ", w.Code, w.Body.String())
+	}
+	w = serve(func(r *http.Request) { r.SetBasicAuth("alice", "s3cret") })
+	if w.Code != http.StatusOK || w.Body.String() != "basic:alice" {
+		t.Error("Expected basic auth to authenticate. Got: ", w.Code, w.Body.String())
+	}
+
+	refused := map[string]func(r *http.Request){
+		"no credentials": func(r *http.Request) {},
+		"wrong key":      func(r *http.Request) { r.Header.Set("X-API-Key", "key-2") },
+		"wrong password": func(r *http.Request) { r.SetBasicAuth("alice", "guess") },
+		"unknown user":   func(r *http.Request) { r.SetBasicAuth("bob", "s3cret") },
+		"bad key with good basic auth": func(r *http.Request) {
+			r.Header.Set("X-API-Key", "key-2")
+			r.SetBasicAuth("alice", "s3cret")
+		},
+	}
+	for name, prepare := range refused {
+		w := serve(prepare)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected 401 with a challenge. Got: %d", name, w.Code)
+			continue
+		}
+		if e := decodeErrorResponse(t, w); e.Reason != ReasonUnauthorized {
+			t.Errorf("%s: unexpected reason %s", name, e.Reason)
+		}
+	}
+}
+
+func TestAuthenticateOptional(t *testing.T) {
+	keys := NewAPIKeyStore(APIKey{Key: "key-1", Subject: "svc-a"})
+	h := Authenticate(AuthSpec{
+		Authenticators: []Authenticator{APIKeyAuthenticator(keys, "X-API-Key")},
+		Optional:       true,
+	})(http.HandlerFunc(principalHandler))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "anonymous" {
+		t.Error("Expected an anonymous request through. Got: ", w.Code, w.Body.String())
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-API-Key", "wrong")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("Bad credentials should be refused even when optional. Got: ", w.Code)
+	}
+}
+
+func TestAPIKeyRotation(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	keys := NewAPIKeyStore(APIKey{Key: "old", Subject: "svc"})
+	keys.now = func() time.Time { return now }
+
+	keys.Add(APIKey{Key: "new", Subject: "svc"})
+	keys.Add(APIKey{Key: "old", Subject: "svc", Expires: now.Add(time.Hour)})
+	for _, k := range []string{"old", "new"} {
+		if subject, err := keys.Lookup(k); err != nil || subject != "svc" {
+			t.Errorf("Expected %s to be accepted during the rollover: %v", k, err)
+		}
+	}
+	now = now.Add(time.Hour)
+	if _, err := keys.Lookup("old"); err != ErrExpiredAPIKey {
+		t.Error("Expected the old key to have expired. Got: ", err)
+	}
+	keys.Revoke("new")
+	if _, err := keys.Lookup("new"); err != ErrBadCredentials {
+		t.Error("Expected the revoked key to be refused. Got: ", err)
+	}
+}
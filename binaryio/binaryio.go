@@ -2,11 +2,14 @@ package binaryio
 
 import (
 	"archive/zip"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"io"
 	"os"
 	"sync"
+
+	"github.com/arunsworld/go-service/tracing"
 )
 
 // Repo is a repository for binary data
@@ -21,36 +24,65 @@ type Repo interface {
 
 // NewRepo creates a new repo for binary data
 func NewRepo(filename string) (Repo, error) {
+	return NewRepoContext(context.Background(), filename)
+}
+
+// NewRepoContext creates a new repo for binary data, recording a span in the trace carried by ctx that ends
+// when the repo is closed
+func NewRepoContext(ctx context.Context, filename string) (Repo, error) {
+	_, span := tracing.Start(ctx, "binaryio.NewRepo")
+	span.SetAttribute("file.path", filename)
 	f, err := os.Create(filename)
 	if err != nil {
+		span.RecordError(err)
+		span.End()
 		return nil, err
 	}
 	zw := zip.NewWriter(f)
 	return &repo{
 		fileWriter: f,
 		zipWriter:  zw,
+		span:       span,
 	}, nil
 }
 
 // OpenRepo opens an existing repo
 func OpenRepo(filename string) (Repo, error) {
+	return OpenRepoContext(context.Background(), filename)
+}
+
+// OpenRepoContext opens an existing repo, recording a span in the trace carried by ctx that ends when the repo
+// is closed
+func OpenRepoContext(ctx context.Context, filename string) (Repo, error) {
+	_, span := tracing.Start(ctx, "binaryio.OpenRepo")
+	span.SetAttribute("file.path", filename)
 	f, err := os.Open(filename)
 	if err != nil {
-		return nil, fmt.Errorf("repo not found: %v", err)
+		err = fmt.Errorf("repo not found: %v", err)
+		span.RecordError(err)
+		span.End()
+		return nil, err
 	}
 	zr, err := zip.OpenReader(filename)
 	if err != nil {
-		return nil, fmt.Errorf("error opening repo: %v", err)
+		f.Close()
+		err = fmt.Errorf("error opening repo: %v", err)
+		span.RecordError(err)
+		span.End()
+		return nil, err
 	}
+	span.SetAttribute("binaryio.shards", len(zr.File))
 	return &readrepo{
 		fileReader: f,
 		zipReader:  zr,
+		span:       span,
 	}, nil
 }
 
 type repo struct {
 	fileWriter io.WriteCloser
 	zipWriter  *zip.Writer
+	span       *tracing.Span
 	counter    int
 	mu         sync.Mutex
 }
@@ -58,6 +90,10 @@ type repo struct {
 func (r *repo) Close() {
 	r.zipWriter.Close()
 	r.fileWriter.Close()
+	r.mu.Lock()
+	r.span.SetAttribute("binaryio.shards", r.counter)
+	r.mu.Unlock()
+	r.span.End()
 }
 
 func (r *repo) Create() (io.Writer, error) {
@@ -103,11 +139,13 @@ func (r *repo) Read(int, interface{}) error {
 type readrepo struct {
 	fileReader io.ReadCloser
 	zipReader  *zip.ReadCloser
+	span       *tracing.Span
 }
 
 func (r *readrepo) Close() {
 	r.zipReader.Close()
 	r.fileReader.Close()
+	r.span.End()
 }
 
 func (r *readrepo) Create() (io.Writer, error) {
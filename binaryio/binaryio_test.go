@@ -1,7 +1,11 @@
 package binaryio
 
 import (
+	"context"
+	"path/filepath"
 	"testing"
+
+	"github.com/arunsworld/go-service/tracing"
 )
 
 func TestCreateRepo(t *testing.T) {
@@ -50,3 +54,41 @@ func TestReadRepo(t *testing.T) {
 		t.Fatal("Expected 6 entries but got:", len(v))
 	}
 }
+
+func TestRepoContextSpans(t *testing.T) {
+	exporter := tracing.NewMemoryExporter()
+	ctx, parent := tracing.NewTracer(tracing.TracerSpec{Exporter: exporter}).Start(context.Background(), "job", tracing.SpanKindInternal)
+	filename := filepath.Join(t.TempDir(), "spans.db")
+
+	repo, err := NewRepoContext(ctx, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.CreateAndWrite([]string{"a"})
+	repo.CreateAndWrite([]string{"b"})
+	repo.Close()
+	repo, err = OpenRepoContext(ctx, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.Close()
+	if _, err := OpenRepoContext(ctx, filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Fatal("Expected an error opening a missing repo.")
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 3 {
+		t.Fatal("Expected a span per repo. Got: ", len(spans))
+	}
+	for i, name := range []string{"binaryio.NewRepo", "binaryio.OpenRepo", "binaryio.OpenRepo"} {
+		if spans[i].Name != name || spans[i].ParentSpanID != parent.SpanContext().SpanID.String() {
+			t.Errorf("Unexpected span: %+v", spans[i])
+		}
+	}
+	if spans[0].Attributes["binaryio.shards"] != 2 || spans[1].Attributes["binaryio.shards"] != 2 {
+		t.Error("Expected the shards written and found on the spans.")
+	}
+	if spans[2].Status != tracing.StatusError {
+		t.Error("Expected the failed open to be marked as an error.")
+	}
+}
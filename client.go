@@ -1,43 +1,32 @@
 package service
 
 import (
-	"bytes"
-	"fmt"
+	"context"
 	"io"
-	"io/ioutil"
-	"mime/multipart"
-	"net/http"
+
+	"github.com/arunsworld/go-service/httpclient"
 )
 
 // UploadClientSpec specifies the requirements for the UploadClient
-type UploadClientSpec struct {
-	URL      string
-	Content  io.Reader
-	Filename string
-}
+type UploadClientSpec = httpclient.UploadClientSpec
+
+// BasicAuth holds credentials for HTTP basic authentication
+type BasicAuth = httpclient.BasicAuth
+
+// ProgressFunc is told how many bytes of the file have been sent so far
+type ProgressFunc = httpclient.ProgressFunc
+
+// StatusError is returned when the server replies with a status outside the 2xx range
+type StatusError = httpclient.StatusError
 
 // FileUploaderClient uploads file per the spec
 func FileUploaderClient(spec UploadClientSpec) ([]byte, error) {
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", spec.Filename)
-	if err != nil {
-		return nil, err
-	}
-	io.Copy(part, spec.Content)
-	writer.Close()
+	return httpclient.FileUploaderClient(spec)
+}
 
-	resp, err := http.Post(spec.URL, writer.FormDataContentType(), body)
-	if err != nil {
-		return nil, err
-	}
-	respBody := resp.Body
-	defer respBody.Close()
-	respContent, err := ioutil.ReadAll(respBody)
-	if err != nil {
-		return nil, err
-	}
-	return respContent, nil
+// FileUploaderClientContext uploads file per the spec, streaming the body and stopping when ctx is cancelled
+func FileUploaderClientContext(ctx context.Context, spec UploadClientSpec) ([]byte, error) {
+	return httpclient.FileUploaderClientContext(ctx, spec)
 }
 
 // HTMLParser is a callback function once the client gets a successful response
@@ -49,16 +38,8 @@ type HTMLParserClientSpec struct {
 	Parser HTMLParser
 }
 
-// HTMLParserClient does a GET on the spec URL and calls the included Parser function
+// HTMLParserClient does a GET on the spec URL and calls the included Parser function. It is sent with
+// httpclient.DefaultClient, so failed attempts are retried.
 func HTMLParserClient(spec HTMLParserClientSpec) error {
-	resp, err := http.Get(spec.URL)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("expected 200 status code. Got: %d", resp.StatusCode)
-	}
-	defer resp.Body.Close()
-	spec.Parser(resp.Body)
-	return nil
+	return httpclient.HTMLParserClient(httpclient.HTMLParserClientSpec{URL: spec.URL, Parser: httpclient.HTMLParser(spec.Parser)})
 }
@@ -1,16 +1,15 @@
 package main
 
 import (
-	"context"
 	"log"
 	"net/http"
 	"os"
-	"os/signal"
 	"time"
 
 	"github.com/gorilla/mux"
 
 	service "github.com/arunsworld/go-service"
+	"github.com/arunsworld/go-service/tracing"
 )
 
 func main() {
@@ -21,43 +20,73 @@ func main() {
 		}
 	})
 
+	tracerSpec := tracing.TracerSpec{ServiceName: "go-service"}
+	if os.Getenv("TRACE_STDOUT") != "" {
+		tracerSpec.Exporter = tracing.NewStdoutExporter()
+	}
+	tracing.SetDefault(tracing.NewTracer(tracerSpec))
+
+	metrics := service.NewMetrics(service.MetricsSpec{})
 	mux := mux.NewRouter()
 	mux.HandleFunc("/abcd", h)
-	mux.HandleFunc("/upload", service.GetUploadHandler(service.UploadHandlerSpec{
+	var upload http.Handler = service.GetUploadHandler(service.UploadHandlerSpec{
 		DownloadURL: "http://localhost:8087/uploads/",
-	}))
-	mux.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("/tmp/"))))
+		Metrics:     metrics,
+	})
+	if key := os.Getenv("UPLOAD_API_KEY"); key != "" {
+		keys := service.NewAPIKeyStore(service.APIKey{Key: key, Subject: "uploader"})
+		upload = service.Authenticate(service.AuthSpec{
+			Authenticators: []service.Authenticator{service.APIKeyAuthenticator(keys, "X-API-Key")},
+		})(upload)
+	}
+	// Rate limit ahead of authentication so that guessing API keys is throttled too
+	uploadLimit := service.RateLimiter(service.RateLimitSpec{Limit: service.RateLimit{Requests: 10, Period: time.Minute}})
+	mux.Handle("/upload", uploadLimit(upload))
+	mux.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", service.GetDownloadHandler(service.DownloadHandlerSpec{})))
 
-	handler := service.SecureGivenHandler(mux)
-	handler = service.AllowCORSForDevTesting(handler)
+	health := service.NewHealth()
+	health.Register("upload-disk", service.DiskSpaceCheck("/tmp/", 100*1024*1024), service.CheckOptions{})
+	health.Routes(mux)
+	mux.Handle("/metrics", metrics.Handler())
+	const maxUpload = 100 << 20
+	mux.Use(service.RouteLimits{
+		Default: service.RouteLimit{Timeout: 30 * time.Second, MaxBody: 1 << 20},
+		Routes: map[string]service.RouteLimit{
+			"/upload":   {Timeout: 3 * time.Minute, MaxBody: maxUpload},
+			"/uploads/": {Timeout: 3 * time.Minute},
+		},
+	}.Middleware())
 
-	srv := http.Server{
-		Addr:         ":8087",
-		Handler:      handler,
+	srv := service.NewServer(service.ServerSpec{
+		Addr:    ":8087",
+		Handler: mux,
+		Middleware: []service.Middleware{
+			service.RequestLogger(service.LoggingSpec{Logger: service.NewJSONLogger(os.Stdout), Router: mux}),
+			service.Tracing(service.TracingSpec{Router: mux}),
+			service.Recovery(service.RecoverySpec{}),
+			metrics.Middleware(mux),
+			service.DevCORSPolicy().Handler,
+			service.SecureGivenHandler,
+			service.Compress(service.CompressionSpec{}),
+			service.DecompressLimit(maxUpload),
+		},
 		ReadTimeout:  time.Minute * 3,
 		WriteTimeout: time.Minute * 3,
+		TLS:          tlsFromEnv(),
+	})
+	health.FailReadinessOn(srv.ShuttingDown())
+	log.Println("Serving on port 8087...")
+	if err := srv.ListenAndServe(); err != nil {
+		log.Println(err)
 	}
-	finishedServing := make(chan struct{})
-	go func() {
-		log.Println("Serving on port 8087...")
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
-		}
-		finishedServing <- struct{}{}
-	}()
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+}
 
-	select {
-	case <-c:
-		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-		defer cancel()
-		err := srv.Shutdown(ctx)
-		if err != nil {
-			log.Println("Shutdown error:", err)
-		}
-		<-finishedServing
-	case <-finishedServing:
+// tlsFromEnv serves HTTPS when TLS_CERT_FILE and TLS_KEY_FILE are set, requiring client certificates signed by
+// TLS_CA_FILE when that is set too
+func tlsFromEnv() *service.TLSSpec {
+	cert, key := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if cert == "" || key == "" {
+		return nil
 	}
+	return &service.TLSSpec{CertFile: cert, KeyFile: key, CAFile: os.Getenv("TLS_CA_FILE")}
 }
@@ -0,0 +1,338 @@
+package service
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// ReasonUnsupportedEncoding is reported in the ErrorResponse when a request body is encoded in a way the server
+// cannot decode
+const ReasonUnsupportedEncoding = "unsupported_encoding"
+
+// DefaultCompressibleTypes are the media types Compress compresses unless told otherwise. Entries ending in "/"
+// match a whole type.
+var DefaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/problem+json",
+	"application/javascript",
+	"application/xml",
+	"application/csv",
+	"application/x-protobuf",
+	"application/protobuf",
+	"application/vnd.google.protobuf",
+	"image/svg+xml",
+}
+
+// CompressionSpec captures the specification for Compress
+type CompressionSpec struct {
+	// MinSize is the smallest response worth compressing. Defaults to 1KiB.
+	MinSize int
+	// ContentTypes that are compressed. Defaults to DefaultCompressibleTypes.
+	ContentTypes []string
+	// GzipLevel defaults to gzip.DefaultCompression
+	GzipLevel int
+	// BrotliLevel defaults to 4, which compresses about as well as gzip does at its default but faster
+	BrotliLevel int
+	// DisableBrotli only offers gzip
+	DisableBrotli bool
+}
+
+// Compress compresses responses with brotli or gzip, whichever the client prefers in Accept-Encoding. Responses
+// that are small, already encoded, partial or of a type not in the spec's ContentTypes are sent as they are.
+func Compress(spec CompressionSpec) Middleware {
+	if spec.MinSize == 0 {
+		spec.MinSize = 1024
+	}
+	if spec.ContentTypes == nil {
+		spec.ContentTypes = DefaultCompressibleTypes
+	}
+	if spec.GzipLevel == 0 {
+		spec.GzipLevel = gzip.DefaultCompression
+	}
+	if spec.BrotliLevel == 0 {
+		spec.BrotliLevel = 4
+	}
+	pools := map[string]*sync.Pool{
+		"gzip": {New: func() interface{} {
+			w, _ := gzip.NewWriterLevel(nil, spec.GzipLevel)
+			return w
+		}},
+		"br": {New: func() interface{} {
+			return brotli.NewWriterLevel(nil, spec.BrotliLevel)
+		}},
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), !spec.DisableBrotli)
+			if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, spec: &spec, encoding: encoding, pool: pools[encoding]}
+			// Not deferred, so a panic leaves the response unstarted for Recovery to answer
+			h.ServeHTTP(cw, r)
+			cw.Close()
+		})
+	}
+}
+
+// negotiateEncoding picks br or gzip from an Accept-Encoding header, preferring br when the client rates them equally
+func negotiateEncoding(header string, allowBrotli bool) string {
+	best, bestQ := "", 0.0
+	wildcard := -1.0
+	seen := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		if name != "gzip" && !(name == "br" && allowBrotli) {
+			continue
+		}
+		seen[name] = true
+		if q > 0 && (q > bestQ || (q == bestQ && name == "br")) {
+			best, bestQ = name, q
+		}
+	}
+	if best == "" && wildcard > 0 {
+		if allowBrotli && !seen["br"] {
+			return "br"
+		}
+		if !seen["gzip"] {
+			return "gzip"
+		}
+	}
+	return best
+}
+
+// encoder is implemented by both gzip.Writer and brotli.Writer
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+	Flush() error
+}
+
+// compressWriter buffers the start of a response until it knows whether it is worth compressing
+type compressWriter struct {
+	http.ResponseWriter
+	spec     *CompressionSpec
+	encoding string
+	pool     *sync.Pool
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 || cw.decided {
+		return
+	}
+	if status >= 100 && status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	if !cw.eligible() {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.spec.MinSize {
+		if err := cw.decide(cw.eligible()); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// eligible checks the status and headers, sniffing the content type from what is buffered if none was set
+func (cw *compressWriter) eligible() bool {
+	switch cw.status {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil && n < cw.spec.MinSize {
+			return false
+		}
+	}
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		if len(cw.buf) == 0 {
+			return true
+		}
+		ct = http.DetectContentType(cw.buf)
+		h.Set("Content-Type", ct)
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range cw.spec.ContentTypes {
+		if mediaType == allowed || (strings.HasSuffix(allowed, "/") && strings.HasPrefix(mediaType, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide sends the header, compressed or not, followed by anything buffered
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if compress {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.enc = cw.pool.Get().(encoder)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends what has been written so far. A response that has not reached MinSize by its first flush is not
+// compressed.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(len(cw.buf) >= cw.spec.MinSize && cw.eligible())
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response once the handler returns
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return nil
+		}
+		cw.decide(len(cw.buf) >= cw.spec.MinSize && cw.eligible())
+	}
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	cw.enc.Reset(nil)
+	cw.pool.Put(cw.enc)
+	cw.enc = nil
+	return err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// DefaultDecompressLimit is the most a request body may decode to under Decompress
+const DefaultDecompressLimit = 10 << 20
+
+// Decompress transparently decodes request bodies sent with Content-Encoding gzip or br, so handlers read the
+// original bytes. Decoded bodies are limited to DefaultDecompressLimit; use DecompressLimit for another limit.
+// Other encodings are refused with a 415.
+func Decompress(h http.Handler) http.Handler {
+	return DecompressLimit(DefaultDecompressLimit)(h)
+}
+
+// DecompressLimit is Decompress refusing decoded bodies larger than limit bytes, so a small compressed request
+// cannot expand without bound. Handlers reading past the limit get an *http.MaxBytesError, which upload handlers
+// answer with a 413. A limit of zero or less means DefaultDecompressLimit.
+func DecompressLimit(limit int64) Middleware {
+	if limit <= 0 {
+		limit = DefaultDecompressLimit
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			var body io.Reader
+			switch encoding {
+			case "", "identity":
+				h.ServeHTTP(w, r)
+				return
+			case "gzip", "x-gzip":
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					writeJSONError(w, http.StatusBadRequest, ReasonUnsupportedEncoding, "request body is not valid gzip")
+					return
+				}
+				body = zr
+			case "br":
+				body = brotli.NewReader(r.Body)
+			default:
+				w.Header().Set("Accept-Encoding", "gzip, br")
+				writeJSONError(w, http.StatusUnsupportedMediaType, ReasonUnsupportedEncoding, "unsupported Content-Encoding "+encoding)
+				return
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{body, r.Body}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		header, expected string
+		brotli           bool
+	}{
+		{"", "", true},
+		{"gzip", "gzip", true},
+		{"gzip, deflate, br", "br", true},
+		{"gzip, deflate, br", "gzip", false},
+		{"br;q=0.5, gzip", "gzip", true},
+		{"gzip;q=0, br;q=0", "", true},
+		{"identity", "", true},
+		{"*", "br", true},
+		{"*", "gzip", false},
+		{"br;q=0, *", "gzip", true},
+		{"x-gzip", "gzip", true},
+	}
+	for _, c := range cases {
+		if got := negotiateEncoding(c.header, c.brotli); got != c.expected {
+			t.Errorf("%q (brotli %v): expected %q, got %q", c.header, c.brotli, c.expected, got)
+		}
+	}
+}
+
+func decodeBody(t *testing.T, encoding string, body []byte) string {
+	var r io.Reader = bytes.NewReader(body)
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(r)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCompress(t *testing.T) {
+	csv := strings.Repeat("id,name,amount\n1,widget,9.99\n", 200)
+	h := Compress(CompressionSpec{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(csv))
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"ok":true}`))
+		case "/png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(bytes.Repeat([]byte{0}, 4096))
+		case "/sniffed":
+			w.Write([]byte("<html>" + csv))
+		case "/partial":
+			w.Header().Set("Content-Type", "text/csv")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(csv))
+		case "/stream":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(csv))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(csv))
+		}
+	}))
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, encoding := range []string{"gzip", "br"} {
+		w := get("/csv", encoding)
+		if w.Header().Get("Content-Encoding") != encoding || w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Expected a %s response. Got headers: %v", encoding, w.Header())
+		}
+		if w.Body.Len() >= len(csv) || decodeBody(t, encoding, w.Body.Bytes()) != csv {
+			t.Errorf("%s body did not round trip, %d bytes", encoding, w.Body.Len())
+		}
+		if w.Header().Get("ETag") != `W/"v1"` {
+			t.Error("Expected the ETag to be weakened. Got: ", w.Header().Get("ETag"))
+		}
+	}
+
+	w := get("/sniffed", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Error("Expected the sniffed type to be compressed. Got: ", w.Header())
+	}
+	w = get("/stream", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || decodeBody(t, "gzip", w.Body.Bytes()) != csv+csv {
+		t.Error("Expected a flushed response to be compressed whole.")
+	}
+
+	for _, path := range []string{"/small", "/png", "/partial"} {
+		w := get(path, "gzip, br")
+		if w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s should not be compressed", path)
+		}
+	}
+	if w := get("/small", "gzip"); w.Body.String() != `{"ok":true}` {
+		t.Error("Unexpected body: ", w.Body.String())
+	}
+	if w := get("/csv", ""); w.Header().Get("Content-Encoding") != "" || w.Body.String() != csv {
+		t.Error("Expected no compression without Accept-Encoding.")
+	}
+	req := httptest.NewRequest("GET", "/csv", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-10")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Error("Range requests should not be compressed.")
+	}
+}
+
+func TestCompressOverHTTP(t *testing.T) {
+	body := strings.Repeat("compress me ", 1000)
+	ts := httptest.NewServer(Compress(CompressionSpec{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(body))
+	})))
+	defer ts.Close()
+
+	// The transport asks for gzip and decodes it transparently
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !resp.Uncompressed || string(data) != body {
+		t.Error("Expected a gzip response the client could decode.")
+	}
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressUpload(t *testing.T) {
+	content := []byte(strings.Repeat("a,b,c\n", 500))
+	plain := multipartUpload(t, "data.csv", "text/csv", content)
+	raw, _ := ioutil.ReadAll(plain.Body)
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(gzipped(t, raw)))
+	req.Header.Set("Content-Type", plain.Header.Get("Content-Type"))
+	req.Header.Set("Content-Encoding", "gzip")
+
+	store := NewMemoryUploadStore()
+	w := httptest.NewRecorder()
+	Decompress(GetUploadHandler(UploadHandlerSpec{Store: store, DownloadURL: "http://abc.com/uploads/"})).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected 200. Got: ", w.Code, w.Body.String())
+	}
+	manifest := decodeManifest(t, w)
+	if len(manifest.Files) != 1 || manifest.Files[0].Size != int64(len(content)) {
+		t.Error("Expected the decompressed file to be stored: ", manifest.Files)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	echo := Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(data)
+	}))
+	post := func(encoding string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		echo.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("gzip", gzipped(t, []byte("hello"))); w.Body.String() != "hello" {
+		t.Error("Expected the gzip body to be decoded. Got: ", w.Body.String())
+	}
+	var br bytes.Buffer
+	bw := brotli.NewWriter(&br)
+	bw.Write([]byte("hello"))
+	bw.Close()
+	if w := post("br", br.Bytes()); w.Body.String() != "hello" {
+		t.Error("Expected the brotli body to be decoded. Got: ", w.Body.String())
+	}
+	if w := post("", []byte("hello")); w.Body.String() != "hello" {
+		t.Error("Expected an unencoded body to pass through. Got: ", w.Body.String())
+	}
+
+	w := post("deflate", []byte("hello"))
+	if w.Code != http.StatusUnsupportedMediaType || w.Header().Get("Accept-Encoding") == "" {
+		t.Error("Expected 415 for an unsupported encoding. Got: ", w.Code)
+	}
+	if e := decodeErrorResponse(t, w); e.Reason != ReasonUnsupportedEncoding {
+		t.Error("Unexpected reason: ", e.Reason)
+	}
+	if w := post("gzip", []byte("not gzip")); w.Code != http.StatusBadRequest {
+		t.Error("Expected 400 for a corrupt gzip body. Got: ", w.Code)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 1<<20)
+	var readErr error
+	h := DecompressLimit(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		readErr = err
+		w.Write(data)
+	}))
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(gzipped(t, content)))
+	req.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	var maxErr *http.MaxBytesError
+	if !errors.As(readErr, &maxErr) || maxErr.Limit != 1024 {
+		t.Error("Expected the decoded body to be cut off at the limit. Got: ", readErr)
+	}
+
+	req = httptest.NewRequest("POST", "/", bytes.NewReader(gzipped(t, content[:1024])))
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if readErr != nil || w.Body.Len() != 1024 {
+		t.Error("Expected a body within the limit to be decoded. Got: ", readErr, w.Body.Len())
+	}
+
+	store := NewMemoryUploadStore()
+	plain := multipartUpload(t, "data.csv", "text/csv", content)
+	raw, _ := ioutil.ReadAll(plain.Body)
+	req = httptest.NewRequest("POST", "/", bytes.NewReader(gzipped(t, raw)))
+	req.Header.Set("Content-Type", plain.Header.Get("Content-Type"))
+	req.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	DecompressLimit(64<<10)(GetUploadHandler(UploadHandlerSpec{Store: store, DownloadURL: "http://abc.com/uploads/"})).ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Expected 413 for an upload that decodes past the limit. Got: ", w.Code, w.Body.String())
+	}
+	for _, h := range []http.Handler{Decompress(echoLength(&readErr)), DecompressLimit(0)(echoLength(&readErr))} {
+		req = httptest.NewRequest("POST", "/", bytes.NewReader(gzipped(t, make([]byte, DefaultDecompressLimit+1))))
+		req.Header.Set("Content-Encoding", "gzip")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if !errors.As(readErr, &maxErr) || maxErr.Limit != DefaultDecompressLimit {
+			t.Error("Expected the default limit to apply. Got: ", readErr)
+		}
+	}
+}
+
+// echoLength reads the whole body, keeping the error in readErr
+func echoLength(readErr *error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(ioutil.Discard, r.Body)
+		*readErr = err
+		fmt.Fprint(w, n)
+	})
+}
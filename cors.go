@@ -0,0 +1,114 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/cors"
+)
+
+// CORSPolicy describes the cross-origin requests a handler accepts. Unlike the library defaults, a policy
+// with no AllowedOrigins and no AllowOriginFunc allows no origin at all.
+type CORSPolicy struct {
+	// AllowedOrigins lists origins such as "https://app.example.com". Each may contain one "*" matching any
+	// characters, e.g. "https://*.example.com", and "*" alone allows every origin.
+	AllowedOrigins []string
+	// AllowOriginFunc is asked about origins AllowedOrigins does not match
+	AllowOriginFunc func(r *http.Request, origin string) bool
+	// AllowedMethods defaults to GET, HEAD and POST
+	AllowedMethods []string
+	// AllowedHeaders lists request headers the client may send. "*" allows any header.
+	AllowedHeaders []string
+	// ExposedHeaders lists response headers the client may read
+	ExposedHeaders []string
+	// AllowCredentials lets requests carry cookies and authorization. The matched origin is echoed back since
+	// browsers refuse credentials with "*". It cannot be combined with an AllowedOrigins of "*", which would let
+	// any site make authenticated requests; use AllowOriginFunc to decide such origins instead.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the answer to a preflight request
+	MaxAge time.Duration
+}
+
+// DevCORSPolicy allows any origin to use any common method and header. Only use it while developing.
+func DevCORSPolicy() CORSPolicy {
+	return CORSPolicy{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+		AllowedHeaders: []string{"*"},
+		MaxAge:         10 * time.Minute,
+	}
+}
+
+// Handler returns h with the policy applied. Preflight requests are answered without reaching h.
+// It panics if the policy allows credentials from every origin.
+func (p CORSPolicy) Handler(h http.Handler) http.Handler {
+	if p.allowsAll() && p.AllowCredentials {
+		panic(`service: CORSPolicy cannot allow credentials with an AllowedOrigins of "*"`)
+	}
+	opts := cors.Options{
+		AllowedMethods:   p.AllowedMethods,
+		AllowedHeaders:   p.AllowedHeaders,
+		ExposedHeaders:   p.ExposedHeaders,
+		AllowCredentials: p.AllowCredentials,
+		MaxAge:           int(p.MaxAge / time.Second),
+	}
+	if p.allowsAll() {
+		opts.AllowedOrigins = []string{"*"}
+	} else {
+		opts.AllowOriginRequestFunc = p.originAllowed
+	}
+	return cors.New(opts).Handler(h)
+}
+
+// Middleware returns the policy as a mux middleware, for use with Router.Use on a router or sub-router.
+// The routes must match OPTIONS for preflight requests to reach it.
+func (p CORSPolicy) Middleware() mux.MiddlewareFunc {
+	return p.Handler
+}
+
+// HandleWithCORS registers h on router for path with its own policy. The route is restricted to methods if any
+// are given, which also become the policy's AllowedMethods when it has none. Preflight requests for the path
+// are routed to the policy.
+func HandleWithCORS(router *mux.Router, path string, policy CORSPolicy, h http.Handler, methods ...string) *mux.Route {
+	if len(policy.AllowedMethods) == 0 && len(methods) > 0 {
+		policy.AllowedMethods = methods
+	}
+	handler := policy.Handler(h)
+	route := router.Handle(path, handler)
+	if len(methods) > 0 {
+		route.Methods(methods...)
+		router.Handle(path, handler).Methods(http.MethodOptions)
+	}
+	return route
+}
+
+func (p CORSPolicy) allowsAll() bool {
+	for _, o := range p.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p CORSPolicy) originAllowed(r *http.Request, origin string) bool {
+	for _, pattern := range p.AllowedOrigins {
+		if originMatches(pattern, origin) {
+			return true
+		}
+	}
+	return p.AllowOriginFunc != nil && p.AllowOriginFunc(r, origin)
+}
+
+// originMatches compares case-insensitively, with at most one "*" in pattern matching any characters
+func originMatches(pattern, origin string) bool {
+	pattern, origin = strings.ToLower(pattern), strings.ToLower(origin)
+	i := strings.IndexByte(pattern, '*')
+	if i < 0 {
+		return pattern == origin
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix)
+}
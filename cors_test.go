@@ -0,0 +1,133 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func preflight(h http.Handler, path, origin, method, headers string) http.Header {
+	req := httptest.NewRequest("OPTIONS", path, nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		req.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Header()
+}
+
+func TestCORSPolicyPreflight(t *testing.T) {
+	policy := CORSPolicy{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+		AllowedMethods:   []string{"GET", "PUT"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	}
+	h := policy.Handler(getGenericHandler())
+
+	headers := preflight(h, "/", "https://app.example.com", "PUT", "Authorization")
+	if headers.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Error("Access-Control-Allow-Origin not set or set to wrong value: ", headers.Get("Access-Control-Allow-Origin"))
+	}
+	if headers.Get("Access-Control-Allow-Methods") != "PUT" {
+		t.Error("Access-Control-Allow-Methods not set or set to wrong value: ", headers.Get("Access-Control-Allow-Methods"))
+	}
+	if headers.Get("Access-Control-Allow-Headers") != "Authorization" {
+		t.Error("Access-Control-Allow-Headers not set or set to wrong value: ", headers.Get("Access-Control-Allow-Headers"))
+	}
+	if headers.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("Access-Control-Allow-Credentials not set.")
+	}
+	if headers.Get("Access-Control-Max-Age") != "3600" {
+		t.Error("Access-Control-Max-Age not set or set to wrong value: ", headers.Get("Access-Control-Max-Age"))
+	}
+
+	if headers := preflight(h, "/", "https://api.eu.example.org", "GET", ""); headers.Get("Access-Control-Allow-Origin") != "https://api.eu.example.org" {
+		t.Error("Expected a wildcard origin to be allowed.")
+	}
+	denied := []struct{ origin, method, headers string }{
+		{"https://example.org", "GET", ""},
+		{"https://evil.com", "GET", ""},
+		{"https://app.example.com", "DELETE", ""},
+		{"https://app.example.com", "PUT", "X-Secret"},
+	}
+	for _, d := range denied {
+		if headers := preflight(h, "/", d.origin, d.method, d.headers); headers.Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Expected preflight for %v to be denied.", d)
+		}
+	}
+}
+
+func TestCORSPolicyActualRequest(t *testing.T) {
+	policy := CORSPolicy{
+		AllowOriginFunc: func(r *http.Request, origin string) bool {
+			return strings.HasSuffix(origin, ".internal")
+		},
+		ExposedHeaders: []string{"X-Request-Id"},
+	}
+	h := policy.Handler(getGenericHandler())
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "http://tools.internal")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Body.String() != "OK" || w.Header().Get("Access-Control-Allow-Origin") != "http://tools.internal" {
+		t.Error("Expected the callback to allow the origin: ", w.Header())
+	}
+	if w.Header().Get("Access-Control-Expose-Headers") != "X-Request-Id" {
+		t.Error("Access-Control-Expose-Headers not set or set to wrong value: ", w.Header().Get("Access-Control-Expose-Headers"))
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Expected the origin to be denied.")
+	}
+	if headers := preflight(CORSPolicy{}.Handler(getGenericHandler()), "/", "https://any.com", "GET", ""); headers.Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Expected an empty policy to allow no origin.")
+	}
+}
+
+func TestCORSPolicyWildcardWithCredentials(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected credentials from every origin to be refused.")
+		}
+	}()
+	CORSPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true}.Handler(getGenericHandler())
+}
+
+func TestHandleWithCORS(t *testing.T) {
+	router := mux.NewRouter()
+	HandleWithCORS(router, "/public", CORSPolicy{AllowedOrigins: []string{"*"}}, getGenericHandler(), "GET")
+	HandleWithCORS(router, "/private", CORSPolicy{AllowedOrigins: []string{"https://app.example.com"}}, getGenericHandler(), "POST")
+
+	if headers := preflight(router, "/public", "https://any.com", "GET", ""); headers.Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("Expected the public route to allow any origin: ", headers)
+	}
+	if headers := preflight(router, "/private", "https://any.com", "POST", ""); headers.Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Expected the private route to deny other origins.")
+	}
+	if headers := preflight(router, "/private", "https://app.example.com", "POST", ""); headers.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Error("Expected the private route to allow its origin: ", headers)
+	}
+	if headers := preflight(router, "/private", "https://app.example.com", "DELETE", ""); headers.Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Expected the route's methods to limit the policy.")
+	}
+
+	req := httptest.NewRequest("GET", "/private", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Error("Expected the route to be restricted to its methods. Got: ", w.Code)
+	}
+}
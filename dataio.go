@@ -2,9 +2,12 @@ package service
 
 import (
 	"bufio"
+	"context"
 	"encoding/csv"
 	"errors"
 	"io"
+
+	"github.com/arunsworld/go-service/tracing"
 )
 
 // RecordProcessor is the function which is called for every record in the CSV
@@ -20,6 +23,13 @@ type CSVSpec struct {
 
 // ParseCSV parses the reader as CSV and calls the RecordProcessor for each record
 func ParseCSV(r io.Reader, spec CSVSpec, processor RecordProcessor, errorProcessor ErrorRecordProcessor) {
+	ParseCSVContext(context.Background(), r, spec, processor, errorProcessor)
+}
+
+// ParseCSVContext is ParseCSV recording a span in the trace carried by ctx
+func ParseCSVContext(ctx context.Context, r io.Reader, spec CSVSpec, processor RecordProcessor, errorProcessor ErrorRecordProcessor) {
+	_, span := tracing.Start(ctx, "dataio.ParseCSV")
+	defer span.End()
 	csvReader := csv.NewReader(r)
 	if spec.Comma != 0 {
 		csvReader.Comma = spec.Comma
@@ -41,6 +51,7 @@ func ParseCSV(r io.Reader, spec CSVSpec, processor RecordProcessor, errorProcess
 		processor(record, header)
 		header = false
 	}
+	span.SetAttribute("csv.rows", rowCounter)
 }
 
 // LineProcessor is the function called for each line while Parsing lines
@@ -116,18 +127,29 @@ func CRNewLineFixer(in io.Reader) *CRFixer {
 
 // WriteCSV writes to a CSV writer the records
 func WriteCSV(spec CSVSpec, records [][]string, w io.Writer) error {
+	return WriteCSVContext(context.Background(), spec, records, w)
+}
+
+// WriteCSVContext is WriteCSV recording a span in the trace carried by ctx
+func WriteCSVContext(ctx context.Context, spec CSVSpec, records [][]string, w io.Writer) error {
+	_, span := tracing.Start(ctx, "dataio.WriteCSV")
+	defer span.End()
+	span.SetAttribute("csv.rows", len(records))
 	csvWriter := csv.NewWriter(w)
 	if spec.Comma != 0 {
 		csvWriter.Comma = spec.Comma
 	}
 	for _, record := range records {
 		if err := csvWriter.Write(record); err != nil {
-			return errors.New("error writing record to csv: " + err.Error())
+			err = errors.New("error writing record to csv: " + err.Error())
+			span.RecordError(err)
+			return err
 		}
 	}
 	csvWriter.Flush()
 
 	if err := csvWriter.Error(); err != nil {
+		span.RecordError(err)
 		return err
 	}
 	return nil
@@ -2,11 +2,14 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
 	"errors"
 	"io/ioutil"
 	"strings"
 	"testing"
+
+	"github.com/arunsworld/go-service/tracing"
 )
 
 func TestCSVParser(t *testing.T) {
@@ -385,3 +388,21 @@ func TestCSVWriter(t *testing.T) {
 		t.Errorf("Output did not match the expected. %s instead of %s", output.String(), expected)
 	}
 }
+
+func TestCSVContextSpans(t *testing.T) {
+	exporter := tracing.NewMemoryExporter()
+	ctx, parent := tracing.NewTracer(tracing.TracerSpec{Exporter: exporter}).Start(context.Background(), "job", tracing.SpanKindInternal)
+	ParseCSVContext(ctx, strings.NewReader("name\nrob\nken\n"), CSVSpec{}, func([]string, bool) {}, func(int, error) {})
+	if err := WriteCSVContext(ctx, CSVSpec{}, [][]string{{"name"}, {"rob"}}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatal("Expected a span per call. Got: ", len(spans))
+	}
+	for i, name := range []string{"dataio.ParseCSV", "dataio.WriteCSV"} {
+		if spans[i].Name != name || spans[i].ParentSpanID != parent.SpanContext().SpanID.String() || spans[i].Attributes["csv.rows"] != 2 {
+			t.Errorf("Unexpected span: %+v", spans[i])
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DownloadHandlerSpec captures the specification for serving stored uploads
+type DownloadHandlerSpec struct {
+	// Store holds the uploaded files. Use the same store as the UploadHandlerSpec.
+	Store UploadStore
+	// UploadLocation is used for a LocalUploadStore when Store is nil, as in UploadHandlerSpec
+	UploadLocation string
+	// Inline serves files with "Content-Disposition: inline" instead of as attachments
+	Inline bool
+	// Signer, when set, only serves requests carrying a valid signature issued by the upload handler. A single-use
+	// URL is consumed by the first GET that finds the file, after which it is refused, ranges included; HEAD
+	// requests and failed lookups leave it usable.
+	Signer *URLSigner
+}
+
+// GetDownloadHandler gets a handler that serves files from the spec's store. The stored name is taken from the
+// request path, so mount it with http.StripPrefix on the prefix of the UploadHandlerSpec's DownloadURL.
+// Anything that was not put in the store by an upload gets a 404.
+func GetDownloadHandler(spec DownloadHandlerSpec) http.HandlerFunc {
+	if spec.UploadLocation == "" {
+		spec.UploadLocation = "/tmp/"
+	}
+	if spec.Store == nil {
+		spec.Store = NewLocalUploadStore(spec.UploadLocation)
+	}
+	disposition := "attachment"
+	if spec.Inline {
+		disposition = "inline"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if spec.Signer != nil {
+			// Download URLs are signed over the escaped name they carry
+			if err := spec.Signer.Check(url.PathEscape(name), r.URL.Query()); err != nil {
+				writeJSONError(w, http.StatusForbidden, ReasonInvalidSignature, err.Error())
+				return
+			}
+		}
+		rc, info, err := spec.Store.Get(r.Context(), name)
+		if errors.Is(err, ErrUploadNotFound) || errors.Is(err, ErrInvalidStoredName) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			Logger(r.Context()).Error("Unable to read upload", "name", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer rc.Close()
+		if spec.Signer != nil && r.Method == http.MethodGet {
+			if err := spec.Signer.MarkUsed(r.URL.Query()); err != nil {
+				writeJSONError(w, http.StatusForbidden, ReasonInvalidSignature, err.Error())
+				return
+			}
+		}
+
+		h := w.Header()
+		if ct := info.Metadata[MetaContentType]; ct != "" {
+			h.Set("Content-Type", ct)
+		} else {
+			h.Set("Content-Type", "application/octet-stream")
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime.UnixNano(), info.Size))
+		filename := info.Metadata[MetaOriginalName]
+		if filename == "" {
+			filename = name
+		}
+		h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+
+		if rs, ok := rc.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, "", info.ModTime, rs)
+			return
+		}
+		// Without seeking there is no way to serve ranges, so answer conditional requests and send it all
+		if match := r.Header.Get("If-None-Match"); match != "" && match == h.Get("ETag") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if info.Size >= 0 {
+			h.Set("Content-Length", fmt.Sprint(info.Size))
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		io.Copy(w, rc)
+	}
+}
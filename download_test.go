@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadHandler(t *testing.T) {
+	store := NewMemoryUploadStore()
+	data := "0123456789abcdefghij"
+	_, err := store.Put(context.Background(), "abc-report.csv", strings.NewReader(data), map[string]string{
+		MetaOriginalName: "Q1 résumé.csv",
+		MetaContentType:  "text/csv",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.StripPrefix("/uploads/", GetDownloadHandler(DownloadHandlerSpec{Store: store}))
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Full download", func(t *testing.T) {
+		w := get("/uploads/abc-report.csv", nil)
+		if w.Code != http.StatusOK || w.Body.String() != data {
+			t.Fatal("Unexpected response:", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+			t.Error("Unexpected Content-Type:", ct)
+		}
+		cd := w.Header().Get("Content-Disposition")
+		if !strings.HasPrefix(cd, "attachment;") || !strings.Contains(cd, "filename*=utf-8''Q1%20r%C3%A9sum%C3%A9.csv") {
+			t.Error("Content-Disposition does not carry the original name:", cd)
+		}
+		if w.Header().Get("ETag") == "" || w.Header().Get("Last-Modified") == "" {
+			t.Error("Expected ETag and Last-Modified headers.")
+		}
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		w := get("/uploads/abc-report.csv", map[string]string{"Range": "bytes=10-14"})
+		if w.Code != http.StatusPartialContent || w.Body.String() != "abcde" {
+			t.Error("Unexpected range response:", w.Code, w.Body.String())
+		}
+		if cr := w.Header().Get("Content-Range"); cr != "bytes 10-14/20" {
+			t.Error("Unexpected Content-Range:", cr)
+		}
+	})
+
+	t.Run("If-None-Match", func(t *testing.T) {
+		etag := get("/uploads/abc-report.csv", nil).Header().Get("ETag")
+		w := get("/uploads/abc-report.csv", map[string]string{"If-None-Match": etag})
+		if w.Code != http.StatusNotModified {
+			t.Error("Expected 304. Got:", w.Code)
+		}
+	})
+
+	t.Run("If-Modified-Since", func(t *testing.T) {
+		since := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+		w := get("/uploads/abc-report.csv", map[string]string{"If-Modified-Since": since})
+		if w.Code != http.StatusNotModified {
+			t.Error("Expected 304. Got:", w.Code)
+		}
+	})
+
+	t.Run("Unknown files", func(t *testing.T) {
+		for _, path := range []string{"/uploads/missing.csv", "/uploads/../etc/passwd", "/uploads/a/b", "/uploads/"} {
+			if w := get(path, nil); w.Code != http.StatusNotFound {
+				t.Errorf("Expected 404 for %s. Got: %d", path, w.Code)
+			}
+		}
+	})
+
+	t.Run("Only GET and HEAD", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/uploads/abc-report.csv", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Error("Expected 405. Got:", w.Code)
+		}
+	})
+}
+
+func TestDownloadHandlerLocalStoreOnlyServesUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("not an upload"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := NewLocalUploadStore(dir)
+	if _, err := store.Put(context.Background(), "upload.txt", strings.NewReader("uploaded"), nil); err != nil {
+		t.Fatal(err)
+	}
+	handler := GetDownloadHandler(DownloadHandlerSpec{UploadLocation: dir})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/secret.txt", nil))
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected 404 for a file that was not uploaded. Got:", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/upload.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "uploaded" {
+		t.Error("Expected the uploaded file. Got:", w.Code, w.Body.String())
+	}
+}
+
+func TestDownloadHandlerS3Range(t *testing.T) {
+	ts := httptest.NewServer(newFakeS3())
+	defer ts.Close()
+	store := NewS3UploadStore(S3UploadStoreSpec{Endpoint: ts.URL, Bucket: "uploads", AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	if _, err := store.Put(context.Background(), "data.txt", strings.NewReader("0123456789"), nil); err != nil {
+		t.Fatal(err)
+	}
+	handler := GetDownloadHandler(DownloadHandlerSpec{Store: store})
+	req := httptest.NewRequest("GET", "/data.txt", nil)
+	req.Header.Set("Range", "bytes=4-6")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "456" {
+		t.Error("Unexpected range response from S3 store:", w.Code, w.Body.String())
+	}
+}
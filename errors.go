@@ -0,0 +1,262 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ContentTypeProblem is the media type of the problem details (RFC 7807) error bodies
+const ContentTypeProblem = "application/problem+json"
+
+// Reasons reported in the ErrorResponse for malformed requests
+const (
+	ReasonBadRequest           = "bad_request"
+	ReasonInvalidJSON          = "invalid_json"
+	ReasonValidationFailed     = "validation_failed"
+	ReasonUnsupportedMediaType = "unsupported_media_type"
+	ReasonNotFound             = "not_found"
+)
+
+// MaxJSONBody is the largest request body DecodeJSON reads
+var MaxJSONBody int64 = 1 << 20
+
+// ErrorResponse is the problem details (RFC 7807) body sent back when the package's handlers refuse a request.
+// Reason is a stable code clients can act upon, such as ReasonTooLarge. Message repeats Detail for clients
+// written before the switch to problem details.
+type ErrorResponse struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Reason   string `json:"reason"`
+	Message  string `json:"message"`
+	// RequestID ties the error to the server's logs when RequestLogger is in use
+	RequestID string `json:"request_id,omitempty"`
+	// Errors lists the fields that failed validation
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// HTTPError is an error that knows how it should be reported to the client. Return it, or wrap it, from code
+// called by handlers and WriteError sends it as an ErrorResponse.
+type HTTPError struct {
+	Status int
+	// Reason defaults to ReasonInternalError for 5xx statuses and ReasonBadRequest otherwise
+	Reason string
+	// Message is sent to the client, so it must not reveal internals
+	Message string
+	Fields  []FieldError
+	// Err is the underlying cause. It is logged but never sent.
+	Err error
+}
+
+// NewHTTPError returns an HTTPError for status
+func NewHTTPError(status int, reason, message string) *HTTPError {
+	return &HTTPError{Status: status, Reason: reason, Message: message}
+}
+
+func (e *HTTPError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.Status, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+// Unwrap returns the underlying cause
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// FieldError is a problem with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is returned by a Validator for a request that has problems with its fields
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	parts := make([]string, len(v))
+	for i, f := range v {
+		parts[i] = f.Field + ": " + f.Message
+	}
+	return "validation failed: " + strings.Join(parts, "; ")
+}
+
+// Validator is implemented by request types that check themselves once DecodeJSON has decoded them
+type Validator interface {
+	Validate() error
+}
+
+type errorMapping struct {
+	target error
+	status int
+	reason string
+}
+
+var (
+	errorMappingsMu sync.RWMutex
+	errorMappings   = []errorMapping{
+		{ErrUploadNotFound, http.StatusNotFound, ReasonNotFound},
+		{ErrInvalidStoredName, http.StatusNotFound, ReasonNotFound},
+		{ErrSignatureInvalid, http.StatusForbidden, ReasonInvalidSignature},
+		{ErrSignatureExpired, http.StatusForbidden, ReasonInvalidSignature},
+		{ErrSignatureUsed, http.StatusForbidden, ReasonInvalidSignature},
+		{ErrBadCredentials, http.StatusUnauthorized, ReasonUnauthorized},
+		{ErrExpiredAPIKey, http.StatusUnauthorized, ReasonUnauthorized},
+		{ErrTokenInvalid, http.StatusUnauthorized, ReasonUnauthorized},
+		{ErrTokenExpired, http.StatusUnauthorized, ReasonUnauthorized},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, ReasonTimeout},
+	}
+)
+
+// RegisterError makes WriteError report errors matching target, by errors.Is, with status and reason. The
+// error's text becomes the message, so only register errors that are safe to show to clients.
+func RegisterError(target error, status int, reason string) {
+	errorMappingsMu.Lock()
+	defer errorMappingsMu.Unlock()
+	errorMappings = append(errorMappings, errorMapping{target, status, reason})
+}
+
+// AsHTTPError works out how err should be reported. Errors that are not an HTTPError, ValidationErrors,
+// *http.MaxBytesError or registered with RegisterError are internal errors.
+func AsHTTPError(err error) *HTTPError {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr
+	}
+	var validation ValidationErrors
+	if errors.As(err, &validation) {
+		return &HTTPError{Status: http.StatusBadRequest, Reason: ReasonValidationFailed, Message: "the request has invalid fields", Fields: validation, Err: err}
+	}
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return &HTTPError{Status: http.StatusRequestEntityTooLarge, Reason: ReasonTooLarge, Message: fmt.Sprintf("request bodies are limited to %d bytes", maxErr.Limit), Err: err}
+	}
+	errorMappingsMu.RLock()
+	defer errorMappingsMu.RUnlock()
+	for _, m := range errorMappings {
+		if errors.Is(err, m.target) {
+			return &HTTPError{Status: m.status, Reason: m.reason, Message: m.target.Error(), Err: err}
+		}
+	}
+	return &HTTPError{Status: http.StatusInternalServerError, Err: err}
+}
+
+// WriteError sends err to the client as an ErrorResponse, see AsHTTPError. Server errors are logged.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	httpErr := AsHTTPError(err)
+	if httpErr.Status >= 500 {
+		Logger(r.Context()).Error("Request failed", "status", httpErr.Status, "error", err)
+	}
+	writeProblem(w, httpErr, r.URL.Path)
+}
+
+// WriteJSON sends v as a JSON body with status
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// DecodeJSON decodes the JSON request body into v, refusing unknown fields, trailing data and bodies over
+// MaxJSONBody, and then validates v if it is a Validator. Client mistakes come back as an *HTTPError with a
+// 4xx status, ready for WriteError.
+func DecodeJSON(r *http.Request, v interface{}) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			return NewHTTPError(http.StatusUnsupportedMediaType, ReasonUnsupportedMediaType, "the request body must be JSON")
+		}
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, MaxJSONBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return jsonDecodeError(err)
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return NewHTTPError(http.StatusBadRequest, ReasonInvalidJSON, "the request body must hold a single JSON value")
+	}
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func jsonDecodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxErr *http.MaxBytesError
+	invalid := func(message string) error {
+		return &HTTPError{Status: http.StatusBadRequest, Reason: ReasonInvalidJSON, Message: message, Err: err}
+	}
+	switch {
+	case errors.As(err, &maxErr):
+		return err
+	case err == io.EOF:
+		return invalid("the request body is empty")
+	case errors.As(err, &syntaxErr):
+		return invalid(fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset))
+	case err == io.ErrUnexpectedEOF:
+		return invalid("malformed JSON, the body ended early")
+	case errors.As(err, &typeErr):
+		return &HTTPError{
+			Status:  http.StatusBadRequest,
+			Reason:  ReasonValidationFailed,
+			Message: "the request has invalid fields",
+			Fields:  []FieldError{{Field: typeErr.Field, Message: "must be " + typeErr.Type.String()}},
+			Err:     err,
+		}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &HTTPError{
+			Status:  http.StatusBadRequest,
+			Reason:  ReasonValidationFailed,
+			Message: "the request has invalid fields",
+			Fields:  []FieldError{{Field: field, Message: "is not a known field"}},
+			Err:     err,
+		}
+	}
+	return invalid("malformed JSON")
+}
+
+func writeJSONError(w http.ResponseWriter, status int, reason, message string) {
+	writeProblem(w, &HTTPError{Status: status, Reason: reason, Message: message}, "")
+}
+
+func writeProblem(w http.ResponseWriter, e *HTTPError, instance string) {
+	reason, message := e.Reason, e.Message
+	if reason == "" {
+		reason = ReasonBadRequest
+		if e.Status >= 500 {
+			reason = ReasonInternalError
+		}
+	}
+	if message == "" && e.Status >= 500 {
+		message = "the server was unable to complete the request"
+	}
+	w.Header().Set("Content-Type", ContentTypeProblem)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Type:      "about:blank",
+		Title:     http.StatusText(e.Status),
+		Status:    e.Status,
+		Detail:    message,
+		Instance:  instance,
+		Reason:    reason,
+		Message:   message,
+		RequestID: w.Header().Get(HeaderRequestID),
+		Errors:    e.Fields,
+	})
+}
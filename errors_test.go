@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type createReport struct {
+	Name  string `json:"name"`
+	Pages int    `json:"pages"`
+}
+
+func (c createReport) Validate() error {
+	var errs ValidationErrors
+	if c.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "is required"})
+	}
+	if c.Pages < 0 {
+		errs = append(errs, FieldError{Field: "pages", Message: "must not be negative"})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func TestWriteError(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+	RegisterError(errQuota, http.StatusTooManyRequests, "quota")
+
+	cases := []struct {
+		err    error
+		status int
+		reason string
+	}{
+		{NewHTTPError(http.StatusConflict, "busy", "try later"), http.StatusConflict, "busy"},
+		{fmt.Errorf("loading: %w", &HTTPError{Status: http.StatusBadRequest, Message: "bad"}), http.StatusBadRequest, ReasonBadRequest},
+		{ValidationErrors{{Field: "name", Message: "is required"}}, http.StatusBadRequest, ReasonValidationFailed},
+		{&http.MaxBytesError{Limit: 10}, http.StatusRequestEntityTooLarge, ReasonTooLarge},
+		{fmt.Errorf("get: %w", ErrUploadNotFound), http.StatusNotFound, ReasonNotFound},
+		{ErrSignatureExpired, http.StatusForbidden, ReasonInvalidSignature},
+		{ErrTokenExpired, http.StatusUnauthorized, ReasonUnauthorized},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, ReasonTimeout},
+		{fmt.Errorf("charge: %w", errQuota), http.StatusTooManyRequests, "quota"},
+		{errors.New("database password is hunter2"), http.StatusInternalServerError, ReasonInternalError},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		w.Header().Set(HeaderRequestID, "req-1")
+		WriteError(w, httptest.NewRequest("GET", "/reports/1", nil), c.err)
+		if w.Code != c.status {
+			t.Errorf("%v: expected %d. Got: %d", c.err, c.status, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "hunter2") {
+			t.Error("Internal error details leaked to the client: ", w.Body.String())
+		}
+		e := decodeErrorResponse(t, w)
+		if e.Status != c.status || e.Reason != c.reason || e.Title != http.StatusText(c.status) || e.Type != "about:blank" {
+			t.Errorf("%v: unexpected error response: %+v", c.err, e)
+		}
+		if e.Instance != "/reports/1" || e.RequestID != "req-1" || e.Detail == "" || e.Message != e.Detail {
+			t.Errorf("%v: unexpected error response: %+v", c.err, e)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	if err := WriteJSON(w, http.StatusCreated, createReport{Name: "q3", Pages: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != "application/json" {
+		t.Error("Unexpected response: ", w.Code, w.Header())
+	}
+	if w.Body.String() != `{"name":"q3","pages":4}`+"\n" {
+		t.Error("Unexpected body: ", w.Body.String())
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	decode := func(contentType, body string) (createReport, *HTTPError) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		var v createReport
+		if err := DecodeJSON(req, &v); err != nil {
+			return v, AsHTTPError(err)
+		}
+		return v, nil
+	}
+
+	v, err := decode("application/json; charset=utf-8", `{"name":"q3","pages":4}`)
+	if err != nil || v.Name != "q3" || v.Pages != 4 {
+		t.Error("Expected the body to decode. Got: ", v, err)
+	}
+
+	cases := []struct {
+		contentType, body string
+		status            int
+		reason, field     string
+	}{
+		{"text/plain", `{"name":"q3"}`, http.StatusUnsupportedMediaType, ReasonUnsupportedMediaType, ""},
+		{"application/json", ``, http.StatusBadRequest, ReasonInvalidJSON, ""},
+		{"application/json", `{"name":`, http.StatusBadRequest, ReasonInvalidJSON, ""},
+		{"application/json", `{"name":"q3"}}`, http.StatusBadRequest, ReasonInvalidJSON, ""},
+		{"application/json", `{"name":"q3"} {"name":"q4"}`, http.StatusBadRequest, ReasonInvalidJSON, ""},
+		{"application/json", `{"name":"q3","pages":"four"}`, http.StatusBadRequest, ReasonValidationFailed, "pages"},
+		{"application/json", `{"name":"q3","owner":"me"}`, http.StatusBadRequest, ReasonValidationFailed, "owner"},
+		{"application/json", `{"pages":-1}`, http.StatusBadRequest, ReasonValidationFailed, "name"},
+		{"", `{"name":"` + strings.Repeat("a", int(MaxJSONBody)) + `"}`, http.StatusRequestEntityTooLarge, ReasonTooLarge, ""},
+	}
+	for _, c := range cases {
+		_, err := decode(c.contentType, c.body)
+		if err == nil {
+			t.Errorf("%.40s: expected an error.", c.body)
+			continue
+		}
+		if err.Status != c.status || err.Reason != c.reason {
+			t.Errorf("%.40s: unexpected error: %v (%s)", c.body, err, err.Reason)
+		}
+		if c.field != "" && (len(err.Fields) == 0 || err.Fields[0].Field != c.field) {
+			t.Errorf("%.40s: expected field %s to be reported. Got: %v", c.body, c.field, err.Fields)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"errors"
+	"mime"
+	"mime/multipart"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ReasonInvalidFilename is reported in the ErrorResponse when a filename is refused by the FilenamePolicy
+const ReasonInvalidFilename = "invalid_filename"
+
+// defaultMaxFilenameLength leaves room for the UUID prefix and metadata suffix within the usual 255 byte limit
+const defaultMaxFilenameLength = 200
+
+// ErrUnsafeFilename is returned when a filename cannot be made safe under the FilenamePolicy
+var ErrUnsafeFilename = errors.New("unsafe filename")
+
+// FilenamePolicy controls how client-supplied filenames are cleaned before they are used to name stored files
+type FilenamePolicy struct {
+	// RejectPaths refuses filenames that contain directory components instead of stripping them
+	RejectPaths bool
+	// MaxLength caps the cleaned filename in bytes, keeping the extension. Defaults to 200.
+	MaxLength int
+	// UUIDOnly stores files under a generated UUID alone. The cleaned original name is kept as metadata.
+	UUIDOnly bool
+}
+
+// Clean returns a version of name that is safe to use as part of a stored file name. It strips (or rejects)
+// directory components, normalises unicode to NFC, drops control and formatting characters, replaces
+// characters reserved by common filesystems and caps the length.
+func (p FilenamePolicy) Clean(name string) (string, error) {
+	name = norm.NFC.String(strings.ToValidUTF8(name, "_"))
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		if p.RejectPaths {
+			return "", ErrUnsafeFilename
+		}
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "", ErrUnsafeFilename
+	}
+	maxLength := p.MaxLength
+	if maxLength <= 0 {
+		maxLength = defaultMaxFilenameLength
+	}
+	return truncateFilename(name, maxLength), nil
+}
+
+// truncateFilename shortens name to at most max bytes on a rune boundary, keeping a short extension
+func truncateFilename(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 16 || len(ext) >= max {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	limit := max - len(ext)
+	for limit > 0 && !utf8.RuneStart(stem[limit]) {
+		limit--
+	}
+	return stem[:limit] + ext
+}
+
+// rawPartFilename returns the filename exactly as the client sent it. multipart.Part.FileName already
+// applies filepath.Base, which would hide path components from the FilenamePolicy.
+func rawPartFilename(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return part.FileName()
+	}
+	return params["filename"]
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFilenamePolicyClean(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"report.csv", "report.csv"},
+		{"../../etc/passwd", "passwd"},
+		{`..\..\windows\system32\cmd.exe`, "cmd.exe"},
+		{"/absolute/path.txt", "path.txt"},
+		{".htaccess", "htaccess"},
+		{"evil\x00.txt.exe", "evil.txt.exe"},
+		{"invoice\u202efdp.exe", "invoicefdp.exe"},
+		{"a<b>c:d|e?f*.txt", "a_b_c_d_e_f_.txt"},
+		{"café.txt", "café.txt"},
+		{"bad\xffutf8.txt", "bad_utf8.txt"},
+		{"trailing. . .", "trailing"},
+	}
+	p := FilenamePolicy{}
+	for _, tt := range tests {
+		got, err := p.Clean(tt.in)
+		if err != nil {
+			t.Errorf("Clean(%q) returned error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.out {
+			t.Errorf("Clean(%q) = %q. Expected %q.", tt.in, got, tt.out)
+		}
+	}
+
+	for _, name := range []string{"", "..", "../", "...", "\x00\x01", " "} {
+		if got, err := p.Clean(name); err != ErrUnsafeFilename {
+			t.Errorf("Clean(%q) = %q, %v. Expected ErrUnsafeFilename.", name, got, err)
+		}
+	}
+}
+
+func TestFilenamePolicyRejectPaths(t *testing.T) {
+	p := FilenamePolicy{RejectPaths: true}
+	for _, name := range []string{"../x.txt", `a\b.txt`, "dir/x.txt"} {
+		if _, err := p.Clean(name); err != ErrUnsafeFilename {
+			t.Errorf("Expected %q to be rejected. Got: %v", name, err)
+		}
+	}
+	if got, err := p.Clean("x.txt"); err != nil || got != "x.txt" {
+		t.Errorf("Expected x.txt to be accepted. Got: %q, %v", got, err)
+	}
+}
+
+func TestFilenamePolicyMaxLength(t *testing.T) {
+	p := FilenamePolicy{MaxLength: 20}
+	got, err := p.Clean(strings.Repeat("ü", 30) + ".csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) > 20 || !strings.HasSuffix(got, ".csv") {
+		t.Errorf("Expected at most 20 bytes ending in .csv. Got %q (%d bytes).", got, len(got))
+	}
+	if !strings.HasPrefix(got, "üüüüüüü") || strings.ContainsRune(got, utf8.RuneError) {
+		t.Errorf("Truncation split a rune: %q", got)
+	}
+}
+
+func TestUploadHandlerHostileFilenames(t *testing.T) {
+	root, err := ioutil.TempDir("", "hostile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	uploads := filepath.Join(root, "uploads")
+	if err := os.Mkdir(uploads, 0700); err != nil {
+		t.Fatal(err)
+	}
+	store := NewLocalUploadStore(uploads)
+	handler := GetUploadHandler(UploadHandlerSpec{Store: store, DownloadURL: "http://abc.com/uploads/"})
+
+	hostile := []string{
+		"../escaped.txt",
+		"../../../../../../tmp/escaped.txt",
+		`..\..\escaped.txt`,
+		"/etc/cron.d/escaped",
+		"sub/dir/escaped.txt",
+		"..",
+	}
+	for _, name := range hostile {
+		w := httptest.NewRecorder()
+		handler(w, multipartUpload(t, name, "text/plain", []byte("payload")))
+		if w.Code != http.StatusOK && w.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected status for %q: %d", name, w.Code)
+			continue
+		}
+		if w.Code == http.StatusOK {
+			stored := decodeManifest(t, w).Files[0].StoredName
+			if strings.ContainsAny(stored, `/\`) || strings.Contains(stored, "..") {
+				t.Errorf("Stored name for %q is unsafe: %q", name, stored)
+			}
+			if _, err := store.Stat(context.Background(), stored); err != nil {
+				t.Errorf("Could not find stored file for %q: %v", name, err)
+			}
+		}
+	}
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !strings.HasPrefix(path, uploads+string(filepath.Separator)) {
+			t.Error("File written outside the upload location:", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("RejectPaths", func(t *testing.T) {
+		handler := GetUploadHandler(UploadHandlerSpec{Store: NewMemoryUploadStore(), FilenamePolicy: FilenamePolicy{RejectPaths: true}})
+		w := httptest.NewRecorder()
+		handler(w, multipartUpload(t, "../escaped.txt", "text/plain", []byte("payload")))
+		if w.Code != http.StatusBadRequest {
+			t.Fatal("Expected 400. Got:", w.Code)
+		}
+		if resp := decodeErrorResponse(t, w); resp.Reason != ReasonInvalidFilename {
+			t.Error("Unexpected reason:", resp.Reason)
+		}
+	})
+
+	t.Run("UUIDOnly", func(t *testing.T) {
+		store := NewMemoryUploadStore()
+		handler := GetUploadHandler(UploadHandlerSpec{Store: store, FilenamePolicy: FilenamePolicy{UUIDOnly: true}})
+		w := httptest.NewRecorder()
+		handler(w, multipartUpload(t, "../report.csv", "text/plain", []byte("payload")))
+		if w.Code != http.StatusOK {
+			t.Fatal("Expected 200. Got:", w.Code)
+		}
+		stored := decodeManifest(t, w).Files[0].StoredName
+		if len(stored) != 36 {
+			t.Error("Expected the stored name to be a bare UUID. Got:", stored)
+		}
+		info, err := store.Stat(context.Background(), stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Metadata[MetaOriginalName] != "report.csv" {
+			t.Error("Expected the cleaned original name in metadata. Got:", info.Metadata[MetaOriginalName])
+		}
+	})
+}
@@ -1,14 +1,27 @@
 package filesystem
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"regexp"
+
+	"github.com/arunsworld/go-service/tracing"
 )
 
 // FindFilesInDirectory finds files in a directory matching a pattern
 func FindFilesInDirectory(dir string, pattern *regexp.Regexp) []string {
+	return FindFilesInDirectoryContext(context.Background(), dir, pattern)
+}
+
+// FindFilesInDirectoryContext finds files in a directory matching a pattern, recording the walk as a span in
+// the trace carried by ctx
+func FindFilesInDirectoryContext(ctx context.Context, dir string, pattern *regexp.Regexp) []string {
+	_, span := tracing.Start(ctx, "filesystem.FindFilesInDirectory")
+	defer span.End()
+	span.SetAttribute("file.dir", dir)
 	files := []string{}
+	defer func() { span.SetAttribute("file.matches", len(files)) }()
 	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if pattern.MatchString(path) {
 			files = append(files, path)
@@ -1,8 +1,11 @@
 package filesystem
 
 import (
+	"context"
 	"regexp"
 	"testing"
+
+	"github.com/arunsworld/go-service/tracing"
 )
 
 func TestFindGoFiles(t *testing.T) {
@@ -12,3 +15,16 @@ func TestFindGoFiles(t *testing.T) {
 		t.Errorf("Expected 3 files, got: %d", len(files))
 	}
 }
+
+func TestFindGoFilesContext(t *testing.T) {
+	exporter := tracing.NewMemoryExporter()
+	ctx, _ := tracing.NewTracer(tracing.TracerSpec{Exporter: exporter}).Start(context.Background(), "job", tracing.SpanKindInternal)
+	files := FindFilesInDirectoryContext(ctx, "test_filesystem", regexp.MustCompile(`.*\.go`))
+	if len(files) != 3 {
+		t.Errorf("Expected 3 files, got: %d", len(files))
+	}
+	spans := exporter.Spans()
+	if len(spans) != 1 || spans[0].Attributes["file.matches"] != 3 {
+		t.Errorf("Expected a span with the matches. Got: %+v", spans)
+	}
+}
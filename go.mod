@@ -1,9 +1,12 @@
 module github.com/arunsworld/go-service
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/codegangsta/negroni v1.0.0 // indirect
 	github.com/gofrs/uuid v3.2.0+incompatible
 	github.com/gorilla/mux v1.7.0
 	github.com/rs/cors v1.6.0
 	github.com/unrolled/secure v0.0.0-20190103195806-76e6d4e9b90c
+	golang.org/x/crypto v0.9.0
+	golang.org/x/text v0.14.0
 )
@@ -2,8 +2,8 @@ package service
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
-	"io/ioutil"
 	"log"
 	"mime/multipart"
 	"net/http"
@@ -156,6 +156,24 @@ func TestCORSForOriginShouldDenyOtherOrigins(t *testing.T) {
 	}
 }
 
+func TestCORSForNoOriginsAllowsAll(t *testing.T) {
+	req := httptest.NewRequest("OPTIONS", "/", nil)
+	req.Header.Add("Origin", "iapps365.com")
+	req.Header.Add("Access-Control-Request-Method", "POST")
+	for _, origins := range [][]string{nil, {}} {
+		w := httptest.NewRecorder()
+		AllowCORSForSpecificOrigins(getGenericHandler(), origins).ServeHTTP(w, req)
+		if allowedOrigin := w.Header().Get("Access-Control-Allow-Origin"); allowedOrigin != "*" {
+			t.Error("Expected no origins to allow every origin. Got: ", allowedOrigin)
+		}
+	}
+	w := httptest.NewRecorder()
+	CORSPolicy{}.Handler(getGenericHandler()).ServeHTTP(w, req)
+	if allowedOrigin := w.Header().Get("Access-Control-Allow-Origin"); allowedOrigin != "" {
+		t.Error("Expected a CORSPolicy without origins to allow none. Got: ", allowedOrigin)
+	}
+}
+
 func TestFileUploadHandler(t *testing.T) {
 
 	t.Run("Happy Path", GoodFileUploadHandler)
@@ -196,15 +214,18 @@ func GoodFileUploadHandler(t *testing.T) {
 
 	handler(w, req)
 
-	resp, err := ioutil.ReadAll(w.Body)
-	if err != nil {
+	if w.Result().StatusCode != 200 {
+		t.Error("Did not get 200 error code. Instead got: ", w.Result().StatusCode)
+	}
+	var manifest UploadManifest
+	if err := json.NewDecoder(w.Body).Decode(&manifest); err != nil {
 		t.Error("Error in TestFileUploadHandler: ", err)
 		return
 	}
-	if w.Result().StatusCode != 200 {
-		t.Error("Did not get 200 error code. Instead got: ", w.Result().StatusCode)
+	if len(manifest.Files) != 1 {
+		t.Fatal("Expected 1 file in the manifest. Got: ", len(manifest.Files))
 	}
-	respStr := string(resp)
+	respStr := manifest.Files[0].DownloadURL
 	if !strings.HasPrefix(respStr, spec.DownloadURL) {
 		t.Error("Did not get the right prefix to download URL: ", respStr)
 	}
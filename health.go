@@ -0,0 +1,255 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HealthCheck reports a problem with a component by returning an error
+type HealthCheck func(ctx context.Context) error
+
+// CheckOptions configures a registered HealthCheck
+type CheckOptions struct {
+	// Timeout bounds a single run of the check. Defaults to 5 seconds.
+	Timeout time.Duration
+	// CacheFor reuses a result for this long so frequent probes do not hammer the component. Defaults to
+	// 5 seconds; use a negative value to run the check on every probe.
+	CacheFor time.Duration
+	// Liveness includes the check in /livez. Only use it for failures a restart fixes, such as a deadlock.
+	Liveness bool
+}
+
+// CheckResult is the outcome of a single check in a HealthReport
+type CheckResult struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Duration  string    `json:"duration"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// HealthReport is the JSON body of the health endpoints
+type HealthReport struct {
+	Status       string        `json:"status"`
+	ShuttingDown bool          `json:"shutting_down,omitempty"`
+	Checks       []CheckResult `json:"checks"`
+}
+
+// Statuses used in a HealthReport
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+type registeredCheck struct {
+	name  string
+	check HealthCheck
+	opts  CheckOptions
+
+	mu        sync.Mutex
+	last      CheckResult
+	expiresAt time.Time
+}
+
+// Health runs the registered checks behind /healthz, /readyz and /livez. /livez runs the liveness checks,
+// /readyz runs every check and fails once shutdown has started and /healthz reports every check.
+type Health struct {
+	mu       sync.RWMutex
+	checks   []*registeredCheck
+	shutdown <-chan struct{}
+	now      func() time.Time
+}
+
+// NewHealth returns a Health without checks, which always reports ok
+func NewHealth() *Health {
+	return &Health{now: time.Now}
+}
+
+// Register adds a named check. Checks are reported in the order they are registered.
+func (h *Health) Register(name string, check HealthCheck, opts CheckOptions) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.CacheFor == 0 {
+		opts.CacheFor = 5 * time.Second
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, &registeredCheck{name: name, check: check, opts: opts})
+}
+
+// FailReadinessOn makes /readyz fail as soon as shuttingDown is closed, e.g. with Server.ShuttingDown
+func (h *Health) FailReadinessOn(shuttingDown <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shutdown = shuttingDown
+}
+
+// Routes registers /healthz, /readyz and /livez on router
+func (h *Health) Routes(router *mux.Router) {
+	router.Handle("/healthz", h.HealthzHandler()).Methods(http.MethodGet, http.MethodHead)
+	router.Handle("/readyz", h.ReadyzHandler()).Methods(http.MethodGet, http.MethodHead)
+	router.Handle("/livez", h.LivezHandler()).Methods(http.MethodGet, http.MethodHead)
+}
+
+// HealthzHandler reports every check
+func (h *Health) HealthzHandler() http.HandlerFunc {
+	return h.handler(false, false)
+}
+
+// ReadyzHandler reports every check and fails while shutting down
+func (h *Health) ReadyzHandler() http.HandlerFunc {
+	return h.handler(false, true)
+}
+
+// LivezHandler reports the liveness checks
+func (h *Health) LivezHandler() http.HandlerFunc {
+	return h.handler(true, false)
+}
+
+func (h *Health) handler(livenessOnly, readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := h.Report(r.Context(), livenessOnly)
+		if readiness && h.shuttingDown() {
+			report.ShuttingDown = true
+			report.Status = StatusFail
+		}
+		status := http.StatusOK
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// Report runs the checks concurrently, or reuses their cached results, and summarises them
+func (h *Health) Report(ctx context.Context, livenessOnly bool) HealthReport {
+	h.mu.RLock()
+	var checks []*registeredCheck
+	for _, c := range h.checks {
+		if !livenessOnly || c.opts.Liveness {
+			checks = append(checks, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	report := HealthReport{Status: StatusOK, Checks: make([]CheckResult, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *registeredCheck) {
+			defer wg.Done()
+			report.Checks[i] = h.run(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+	for _, result := range report.Checks {
+		if result.Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+func (h *Health) shuttingDown() bool {
+	h.mu.RLock()
+	shutdown := h.shutdown
+	h.mu.RUnlock()
+	if shutdown == nil {
+		return false
+	}
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// run holds the check's lock so concurrent probes share a single run. A run cut short because the probe
+// itself went away says nothing about the check, so it is not cached for the probes after it.
+func (h *Health) run(probe context.Context, c *registeredCheck) CheckResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := h.now()
+	if start.Before(c.expiresAt) {
+		return c.last
+	}
+	ctx, cancel := context.WithTimeout(probe, c.opts.Timeout)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = fmt.Errorf("check did not finish: %v", ctx.Err())
+	}
+	result := CheckResult{Name: c.name, Status: StatusOK, Duration: h.now().Sub(start).String(), CheckedAt: start}
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+	}
+	if probe.Err() == nil {
+		c.last = result
+		c.expiresAt = start.Add(c.opts.CacheFor)
+	}
+	return result
+}
+
+// DBPingCheck checks the database behind db, e.g. the one given to query.GenericQuery, answers a ping
+func DBPingCheck(db *sql.DB) HealthCheck {
+	return db.PingContext
+}
+
+// HTTPCheck checks that url answers a GET with a status below 400. client defaults to http.DefaultClient.
+func HTTPCheck(url string, client *http.Client) HealthCheck {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%s answered %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// ErrDiskSpaceUnsupported is returned by a DiskSpaceCheck on platforms where free space cannot be read
+var ErrDiskSpaceUnsupported = errors.New("disk space check is not supported on this platform")
+
+// DiskSpaceCheck checks the file system holding dir, e.g. the UploadLocation, has at least minFree bytes available
+func DiskSpaceCheck(dir string, minFree uint64) HealthCheck {
+	return func(ctx context.Context) error {
+		free, err := diskFree(dir)
+		if err != nil {
+			return err
+		}
+		if free < minFree {
+			return fmt.Errorf("%s has %d bytes free, below the minimum of %d", dir, free, minFree)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package service
+
+func diskFree(dir string) (uint64, error) {
+	return 0, ErrDiskSpaceUnsupported
+}
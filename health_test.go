@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func getHealthReport(t *testing.T, h http.Handler, path string) (int, HealthReport) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var report HealthReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal("Unable to decode health report: ", err, w.Body.String())
+	}
+	return w.Code, report
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	health := NewHealth()
+	health.Register("loop", func(ctx context.Context) error { return nil }, CheckOptions{Liveness: true})
+	health.Register("db", func(ctx context.Context) error { return errors.New("connection refused") }, CheckOptions{})
+	router := mux.NewRouter()
+	health.Routes(router)
+
+	code, report := getHealthReport(t, router, "/healthz")
+	if code != http.StatusServiceUnavailable || report.Status != StatusFail {
+		t.Error("Expected /healthz to fail. Got: ", code, report.Status)
+	}
+	if len(report.Checks) != 2 || report.Checks[0].Name != "loop" || report.Checks[1].Name != "db" {
+		t.Fatal("Unexpected checks: ", report.Checks)
+	}
+	if report.Checks[1].Status != StatusFail || report.Checks[1].Error != "connection refused" {
+		t.Error("Expected the db check to carry its error: ", report.Checks[1])
+	}
+
+	if code, _ := getHealthReport(t, router, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Error("Expected /readyz to fail. Got: ", code)
+	}
+	code, report = getHealthReport(t, router, "/livez")
+	if code != http.StatusOK || len(report.Checks) != 1 || report.Checks[0].Name != "loop" {
+		t.Error("Expected /livez to only run the liveness check: ", code, report)
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	health := NewHealth()
+	block := make(chan struct{})
+	defer close(block)
+	health.Register("stuck", func(ctx context.Context) error {
+		<-block
+		return nil
+	}, CheckOptions{Timeout: 20 * time.Millisecond})
+
+	start := time.Now()
+	report := health.Report(context.Background(), false)
+	if time.Since(start) > time.Second {
+		t.Error("Check was not abandoned at its timeout.")
+	}
+	if report.Status != StatusFail || !strings.Contains(report.Checks[0].Error, "deadline exceeded") {
+		t.Error("Expected the stuck check to fail: ", report.Checks[0])
+	}
+}
+
+func TestHealthCheckCaching(t *testing.T) {
+	health := NewHealth()
+	now := time.Now()
+	health.now = func() time.Time { return now }
+	var runs, uncachedRuns int32
+	health.Register("cached", func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}, CheckOptions{CacheFor: time.Minute})
+	health.Register("uncached", func(ctx context.Context) error {
+		atomic.AddInt32(&uncachedRuns, 1)
+		return nil
+	}, CheckOptions{CacheFor: -1})
+
+	health.Report(context.Background(), false)
+	health.Report(context.Background(), false)
+	if runs != 1 || uncachedRuns != 2 {
+		t.Error("Unexpected number of runs within the cache period: ", runs, uncachedRuns)
+	}
+	now = now.Add(2 * time.Minute)
+	health.Report(context.Background(), false)
+	if runs != 2 {
+		t.Error("Expected the check to run again once the cached result expired: ", runs)
+	}
+}
+
+func TestHealthCheckAbortedProbe(t *testing.T) {
+	health := NewHealth()
+	health.Register("db", func(ctx context.Context) error {
+		return ctx.Err()
+	}, CheckOptions{CacheFor: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report := health.Report(ctx, false); report.Status != StatusFail {
+		t.Error("Expected the aborted probe to fail. Got: ", report.Status)
+	}
+	if report := health.Report(context.Background(), false); report.Status != StatusOK {
+		t.Error("Expected the aborted probe's result not to be cached. Got: ", report.Checks)
+	}
+}
+
+func TestReadinessFailsOnShutdown(t *testing.T) {
+	health := NewHealth()
+	router := mux.NewRouter()
+	health.Routes(router)
+	srv := NewServer(ServerSpec{Handler: router, ShutdownDelay: 300 * time.Millisecond})
+	health.FailReadinessOn(srv.ShuttingDown())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	readyz := func() (int, HealthReport) {
+		resp, err := http.Get("http://" + l.Addr().String() + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var report HealthReport
+		json.NewDecoder(resp.Body).Decode(&report)
+		return resp.StatusCode, report
+	}
+
+	if code, _ := readyz(); code != http.StatusOK {
+		t.Fatal("Expected ready before shutdown. Got: ", code)
+	}
+	go srv.Shutdown(context.Background())
+	<-srv.ShuttingDown()
+	code, report := readyz()
+	if code != http.StatusServiceUnavailable || !report.ShuttingDown {
+		t.Error("Expected readiness to fail during the shutdown delay: ", code, report)
+	}
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHTTPCheck(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer ts.Close()
+	if err := HTTPCheck(ts.URL+"/up", nil)(context.Background()); err != nil {
+		t.Error("Expected the downstream to be reachable: ", err)
+	}
+	if err := HTTPCheck(ts.URL+"/down", nil)(context.Background()); err == nil {
+		t.Error("Expected a 502 to fail the check.")
+	}
+}
+
+func TestDiskSpaceCheck(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "freebsd" {
+		t.Skip("disk space is not available on ", runtime.GOOS)
+	}
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := DiskSpaceCheck(dir, 1)(context.Background()); err != nil {
+		t.Error("Expected some free space: ", err)
+	}
+	if err := DiskSpaceCheck(dir, math.MaxUint64)(context.Background()); err == nil {
+		t.Error("Expected the check to fail below the minimum.")
+	}
+	if err := DiskSpaceCheck(dir+"/missing", 1)(context.Background()); err == nil {
+		t.Error("Expected the check to fail for a missing directory.")
+	}
+}
+
+// pingDriver is a database/sql driver whose connections only answer pings
+type pingDriver struct{ err error }
+
+func (d pingDriver) Open(name string) (driver.Conn, error)            { return pingConn(d), nil }
+func (d pingDriver) Connect(ctx context.Context) (driver.Conn, error) { return pingConn(d), nil }
+func (d pingDriver) Driver() driver.Driver                            { return d }
+
+type pingConn pingDriver
+
+func (c pingConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c pingConn) Close() error                              { return nil }
+func (c pingConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+func (c pingConn) Ping(ctx context.Context) error            { return c.err }
+
+func TestDBPingCheck(t *testing.T) {
+	up := sql.OpenDB(pingDriver{})
+	defer up.Close()
+	if err := DBPingCheck(up)(context.Background()); err != nil {
+		t.Error("Expected the ping to succeed: ", err)
+	}
+	down := sql.OpenDB(pingDriver{err: errors.New("database is down")})
+	defer down.Close()
+	if err := DBPingCheck(down)(context.Background()); err == nil {
+		t.Error("Expected the ping to fail.")
+	}
+}
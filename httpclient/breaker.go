@@ -0,0 +1,166 @@
+package httpclient
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned, wrapped in a *CircuitOpenError, for requests refused because their host's circuit
+// breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitOpenError names the host whose breaker refused a request and when it will let one through again
+type CircuitOpenError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s: %v until %s", e.Host, ErrCircuitOpen, e.Until.Format(time.RFC3339))
+}
+
+// Unwrap lets errors.Is match ErrCircuitOpen
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// BreakerState is the state of a host's circuit breaker
+type BreakerState int
+
+// Breaker states. A closed breaker lets requests through; an open one refuses them; a half-open one lets a
+// single trial request through to find out whether the host has recovered.
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// BreakerSpec captures the specification for the per host circuit breakers of a Client
+type BreakerSpec struct {
+	// FailureThreshold is the number of consecutive failed attempts that opens the breaker. Defaults to 5.
+	FailureThreshold int
+	// OpenDuration is how long the breaker stays open before a trial request. Defaults to 30 seconds.
+	OpenDuration time.Duration
+	// IdleTimeout is how long a host's breaker is kept after its last request, unless it is still refusing
+	// requests. Defaults to 10 minutes.
+	IdleTimeout time.Duration
+	// Disabled turns the breakers off
+	Disabled bool
+}
+
+// outcome of an attempt as far as the breaker is concerned
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	// outcomeIgnored is an attempt that says nothing about the host, such as one the caller cancelled
+	outcomeIgnored
+)
+
+// circuitBreaker guards a single host
+type circuitBreaker struct {
+	spec     *BreakerSpec
+	host     string
+	onChange func(host string, from, to BreakerState)
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trial    bool
+	lastUsed time.Time
+}
+
+// allow returns a *CircuitOpenError if the request may not be sent now. trial says the request is the one a
+// half-open breaker is waiting on, which must be passed on to record.
+func (b *circuitBreaker) allow(now time.Time) (trial bool, err error) {
+	b.mu.Lock()
+	b.lastUsed = now
+	from := b.state
+	switch b.state {
+	case BreakerOpen:
+		if until := b.openedAt.Add(b.spec.OpenDuration); now.Before(until) {
+			err = &CircuitOpenError{Host: b.host, Until: until}
+		} else {
+			b.state = BreakerHalfOpen
+			b.trial = true
+			trial = true
+		}
+	case BreakerHalfOpen:
+		if b.trial {
+			err = &CircuitOpenError{Host: b.host, Until: now}
+		} else {
+			b.trial = true
+			trial = true
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.changed(from, to)
+	return trial, err
+}
+
+// record updates the breaker with the outcome of an attempt that allow let through
+func (b *circuitBreaker) record(o outcome, trial bool, now time.Time) {
+	b.mu.Lock()
+	from := b.state
+	if trial {
+		b.trial = false
+	}
+	// Attempts that were sent before the breaker opened do not change it while it is open, and only the trial
+	// decides a half-open breaker
+	if b.state == BreakerClosed || (b.state == BreakerHalfOpen && trial) {
+		switch o {
+		case outcomeSuccess:
+			b.failures = 0
+			b.state = BreakerClosed
+		case outcomeFailure:
+			b.failures++
+			if b.state == BreakerHalfOpen || b.failures >= b.spec.FailureThreshold {
+				b.state = BreakerOpen
+				b.openedAt = now
+				b.failures = 0
+			}
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.changed(from, to)
+}
+
+// idle says whether the breaker has gone unused for IdleTimeout and holds nothing worth keeping: it is not
+// refusing requests nor waiting on a trial
+func (b *circuitBreaker) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Sub(b.lastUsed) < b.spec.IdleTimeout || b.trial {
+		return false
+	}
+	return b.state != BreakerOpen || !now.Before(b.openedAt.Add(b.spec.OpenDuration))
+}
+
+func (b *circuitBreaker) current() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// changed tells the hook about a transition, outside the lock so the hook may use the Client
+func (b *circuitBreaker) changed(from, to BreakerState) {
+	if from != to && b.onChange != nil {
+		b.onChange(b.host, from, to)
+	}
+}
@@ -0,0 +1,151 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var healthy int32
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	host := u.Host
+
+	now := time.Now()
+	var changes []string
+	c := NewClient(ClientSpec{
+		MaxAttempts: 1,
+		Breaker:     BreakerSpec{FailureThreshold: 3, OpenDuration: time.Minute},
+		OnBreakerChange: func(h string, from, to BreakerState) {
+			if h == host {
+				changes = append(changes, from.String()+">"+to.String())
+			}
+		},
+	})
+	c.now = func() time.Time { return now }
+	get := func() error {
+		resp, err := c.Get(context.Background(), ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.BreakerState(host) != BreakerOpen {
+		t.Fatal("Expected the breaker to open after 3 failures. Got: ", c.BreakerState(host))
+	}
+	err := get()
+	var openErr *CircuitOpenError
+	if !errors.Is(err, ErrCircuitOpen) || !errors.As(err, &openErr) || openErr.Host != host {
+		t.Fatal("Expected the open breaker to refuse the request. Got: ", err)
+	}
+	if atomic.LoadInt32(&requests) != 3 || c.Stats().Rejected != 1 {
+		t.Error("Expected the refused request not to reach the server.")
+	}
+
+	// After OpenDuration a failing trial opens the breaker again
+	now = now.Add(time.Minute)
+	get()
+	if c.BreakerState(host) != BreakerOpen || get() == nil {
+		t.Error("Expected a failed trial to open the breaker again.")
+	}
+
+	// A successful trial closes it
+	atomic.StoreInt32(&healthy, 1)
+	now = now.Add(time.Minute)
+	if err := get(); err != nil || c.BreakerState(host) != BreakerClosed {
+		t.Error("Expected a successful trial to close the breaker. Got: ", err, c.BreakerState(host))
+	}
+	expected := []string{"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed"}
+	if len(changes) != len(expected) {
+		t.Fatal("Unexpected breaker changes: ", changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Error("Unexpected breaker changes: ", changes)
+			break
+		}
+	}
+}
+
+func TestCircuitBreakerHalfOpenTrial(t *testing.T) {
+	b := &circuitBreaker{spec: &BreakerSpec{FailureThreshold: 1, OpenDuration: time.Second}, host: "example.com"}
+	now := time.Now()
+	b.allow(now)
+	early, _ := b.allow(now)
+	b.record(outcomeFailure, false, now)
+	now = now.Add(time.Second)
+	trial, err := b.allow(now)
+	if err != nil || !trial {
+		t.Fatal("Expected a trial request. Got: ", trial, err)
+	}
+	if _, err := b.allow(now); err == nil {
+		t.Error("Expected a single trial request while half-open.")
+	}
+	b.record(outcomeSuccess, early, now)
+	b.record(outcomeIgnored, false, now)
+	if _, err := b.allow(now); err == nil || b.current() != BreakerHalfOpen {
+		t.Error("Expected requests sent before the breaker opened not to end the trial. Got: ", err, b.current())
+	}
+	b.record(outcomeIgnored, trial, now)
+	if trial, err := b.allow(now); err != nil || !trial || b.current() != BreakerHalfOpen {
+		t.Error("Expected a cancelled trial to make way for another. Got: ", err)
+	}
+
+	disabled := NewClient(ClientSpec{Breaker: BreakerSpec{Disabled: true}})
+	if disabled.breaker("example.com") != nil || disabled.BreakerState("example.com") != BreakerClosed {
+		t.Error("Expected no breaker when disabled.")
+	}
+}
+
+func TestCircuitBreakerIdleHosts(t *testing.T) {
+	now := time.Now()
+	c := NewClient(ClientSpec{Breaker: BreakerSpec{FailureThreshold: 1, OpenDuration: time.Hour, IdleTimeout: time.Minute}})
+	c.now = func() time.Time { return now }
+	c.breaker("idle.example.com").allow(now)
+	open := c.breaker("down.example.com")
+	open.allow(now)
+	open.record(outcomeFailure, false, now)
+
+	now = now.Add(time.Minute)
+	c.breaker("busy.example.com")
+	c.mu.Lock()
+	_, idle := c.breakers["idle.example.com"]
+	_, down := c.breakers["down.example.com"]
+	c.mu.Unlock()
+	if idle || !down {
+		t.Error("Expected idle hosts to be forgotten but not ones whose breaker is open. Got: ", idle, down)
+	}
+	if c.BreakerState("down.example.com") != BreakerOpen {
+		t.Error("Expected the open breaker to be kept.")
+	}
+
+	now = now.Add(time.Hour)
+	c.breaker("busy.example.com")
+	if c.BreakerState("down.example.com") != BreakerClosed || c.BreakerState("busy.example.com") != BreakerClosed {
+		t.Error("Expected the breaker to be forgotten once its OpenDuration is over.")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.breakers) != 1 {
+		t.Error("Expected only the busy host to be kept. Got: ", len(c.breakers))
+	}
+}
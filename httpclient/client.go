@@ -1,34 +1,108 @@
 package httpclient
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 )
 
+// ProgressFunc is told how many bytes of the file have been sent so far. total is -1 when the size is unknown.
+type ProgressFunc func(sent, total int64)
+
+// BasicAuth holds credentials for HTTP basic authentication
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
 // UploadClientSpec specifies the requirements for the UploadClient
 type UploadClientSpec struct {
 	URL      string
 	Content  io.Reader
 	Filename string
+	// Size is the length of Content, reported to Progress as the total. Worked out from Content when it can be.
+	Size     int64
+	Progress ProgressFunc
+	// FieldName is the form field the file is sent in. Defaults to "file".
+	FieldName string
+	// Fields are extra form values, sent ahead of the file
+	Fields map[string]string
+	// Headers are added to the request. Content-Type is always set to the multipart type.
+	Headers http.Header
+	// BearerToken is sent as an "Authorization: Bearer" header when set
+	BearerToken string
+	// BasicAuth is sent as HTTP basic authentication when set
+	BasicAuth *BasicAuth
+	// Client sends the request. Defaults to http.DefaultClient traced with TracingTransport; wrap your own
+	// with TracedClient to keep the trace going.
+	Client *http.Client
+	// Resilient sends the request with retries and a circuit breaker. Defaults to DefaultClient, or when Client is
+	// set to a new Client over it for this upload alone, whose breakers start closed. Uploads sent with the same
+	// Resilient share its breakers, so pass one to have failures to a host refuse later uploads there.
+	// Uploads are only retried when Headers carry an Idempotency-Key and Content is an io.Seeker, so it can be
+	// sent again from the start.
+	Resilient *Client
+}
+
+// StatusError is returned when the server replies with a status outside the 2xx range
+type StatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, strings.TrimSpace(string(e.Body)))
 }
 
 // FileUploaderClient uploads file per the spec
 func FileUploaderClient(spec UploadClientSpec) ([]byte, error) {
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", spec.Filename)
+	return FileUploaderClientContext(context.Background(), spec)
+}
+
+// FileUploaderClientContext uploads file per the spec. The multipart body is streamed so the file is never
+// held in memory, and cancelling ctx aborts the upload.
+func FileUploaderClientContext(ctx context.Context, spec UploadClientSpec) ([]byte, error) {
+	if spec.FieldName == "" {
+		spec.FieldName = "file"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, spec.URL, nil)
 	if err != nil {
 		return nil, err
 	}
-	io.Copy(part, spec.Content)
-	writer.Close()
-
-	resp, err := http.Post(spec.URL, writer.FormDataContentType(), body)
+	body := newMultipartBody(spec)
+	defer func() { body.Close() }()
+	req.Body = body
+	if seeker, ok := spec.Content.(io.Seeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				// The previous attempt must stop reading Content before it is rewound
+				body.Close()
+				<-body.done
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return nil, err
+				}
+				body = body.restart(spec)
+				return body, nil
+			}
+		}
+	}
+	for k, v := range spec.Headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+body.boundary)
+	if spec.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+spec.BearerToken)
+	}
+	if spec.BasicAuth != nil {
+		req.SetBasicAuth(spec.BasicAuth.Username, spec.BasicAuth.Password)
+	}
+	resp, err := spec.client().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -38,33 +112,164 @@ func FileUploaderClient(spec UploadClientSpec) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return respContent, &StatusError{StatusCode: resp.StatusCode, Body: respContent}
+	}
 	return respContent, nil
 }
 
+// client picks the Client the upload is sent with
+func (spec UploadClientSpec) client() *Client {
+	if spec.Resilient != nil {
+		return spec.Resilient
+	}
+	if spec.Client != nil {
+		return NewClient(ClientSpec{HTTPClient: spec.Client})
+	}
+	return DefaultClient
+}
+
+// multipartBody streams the form through a pipe as the transport reads it. done is closed once the writing
+// goroutine has stopped reading Content.
+type multipartBody struct {
+	*io.PipeReader
+	boundary string
+	done     chan struct{}
+}
+
+func newMultipartBody(spec UploadClientSpec) *multipartBody {
+	return startMultipartBody(spec, multipart.NewWriter(nil).Boundary())
+}
+
+// restart writes the form again with the same boundary, so the Content-Type header still applies
+func (b *multipartBody) restart(spec UploadClientSpec) *multipartBody {
+	return startMultipartBody(spec, b.boundary)
+}
+
+func startMultipartBody(spec UploadClientSpec, boundary string) *multipartBody {
+	pr, pw := io.Pipe()
+	body := &multipartBody{PipeReader: pr, boundary: boundary, done: make(chan struct{})}
+	writer := multipart.NewWriter(pw)
+	writer.SetBoundary(boundary)
+	go func() {
+		defer close(body.done)
+		if err := writeFields(writer, spec.Fields); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		part, err := writer.CreateFormFile(spec.FieldName, spec.Filename)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(part, newProgressReader(spec)); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(writer.Close())
+	}()
+	return body
+}
+
+// writeFields writes the form values in a stable order
+func writeFields(writer *multipart.Writer, fields map[string]string) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writer.WriteField(name, fields[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// progressReader reports on the bytes read through it
+type progressReader struct {
+	r        io.Reader
+	sent     int64
+	total    int64
+	progress ProgressFunc
+}
+
+func newProgressReader(spec UploadClientSpec) io.Reader {
+	if spec.Progress == nil {
+		return spec.Content
+	}
+	total := spec.Size
+	if total <= 0 {
+		total = contentLength(spec.Content)
+	}
+	return &progressReader{r: spec.Content, total: total, progress: spec.Progress}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.sent += int64(n)
+		p.progress(p.sent, p.total)
+	}
+	return n, err
+}
+
+// contentLength works out how much is left to read from r, or -1 if that cannot be known without reading it
+func contentLength(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case io.Seeker:
+		pos, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		end, err := v.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1
+		}
+		if _, err := v.Seek(pos, io.SeekStart); err != nil {
+			return -1
+		}
+		return end - pos
+	}
+	return -1
+}
+
 // HTMLParser is a callback function once the client gets a successful response
 type HTMLParser func(io.Reader)
 
 // HTMLParserClientSpec is the spec that defines the HTMLParserClient
 type HTMLParserClientSpec struct {
-	URL     string
-	Parser  HTMLParser
+	URL    string
+	Parser HTMLParser
+	// Timeout bounds the whole call, retries and reading the body included
 	Timeout time.Duration
+	// Client sends the request. Defaults to DefaultClient.
+	Client *Client
 }
 
-// HTMLParserClient does a GET on the spec URL and calls the included Parser function
+// HTMLParserClient does a GET on the spec URL and calls the included Parser function. Failed attempts are
+// retried per the Client's spec before a non-200 response is returned as an error.
 func HTMLParserClient(spec HTMLParserClientSpec) error {
-	client := http.Client{}
+	client := spec.Client
+	if client == nil {
+		client = DefaultClient
+	}
+	ctx := context.Background()
 	if spec.Timeout > 0 {
-		client.Timeout = spec.Timeout
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, spec.Timeout)
+		defer cancel()
 	}
-	resp, err := client.Get(spec.URL)
+	resp, err := client.Get(ctx, spec.URL)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("expected 200 status code. Got: %d", resp.StatusCode)
 	}
-	defer resp.Body.Close()
 	spec.Parser(resp.Body)
 	return nil
 }
@@ -2,6 +2,9 @@ package httpclient
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +12,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestFileUploaderClient(t *testing.T) {
@@ -94,3 +98,229 @@ func TestHTMLParserClient(t *testing.T) {
 		t.Fatalf("Expected 6 lines instead got %d lines.", counter)
 	}
 }
+
+// gatedReader hands out its first block, then waits until the server has confirmed receiving it. If the
+// client buffered the whole body before sending, the gate would never open.
+type gatedReader struct {
+	blocks [][]byte
+	gate   chan struct{}
+	waited bool
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	if len(g.blocks) == 0 {
+		return 0, io.EOF
+	}
+	if len(g.blocks) == 1 && !g.waited {
+		g.waited = true
+		select {
+		case <-g.gate:
+		case <-time.After(5 * time.Second):
+			return 0, errors.New("server never received the first block; body was not streamed")
+		}
+	}
+	n := copy(p, g.blocks[0])
+	g.blocks[0] = g.blocks[0][n:]
+	if len(g.blocks[0]) == 0 {
+		g.blocks = g.blocks[1:]
+	}
+	return n, nil
+}
+
+func TestFileUploaderClientStreams(t *testing.T) {
+	first := bytes.Repeat([]byte("a"), 64*1024)
+	second := bytes.Repeat([]byte("b"), 64*1024)
+	gate := make(chan struct{})
+	var received int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		part, err := mr.NextPart()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		buf := make([]byte, len(first))
+		if _, err := io.ReadFull(part, buf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		close(gate)
+		rest, _ := ioutil.ReadAll(part)
+		received = int64(len(buf) + len(rest))
+		w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	var lastSent, lastTotal int64
+	resp, err := FileUploaderClient(UploadClientSpec{
+		URL:      ts.URL,
+		Content:  &gatedReader{blocks: [][]byte{first, second}, gate: gate},
+		Filename: "big.bin",
+		Size:     int64(len(first) + len(second)),
+		Progress: func(sent, total int64) {
+			if sent < lastSent {
+				t.Errorf("Progress went backwards: %d after %d", sent, lastSent)
+			}
+			lastSent, lastTotal = sent, total
+		},
+	})
+	if err != nil {
+		t.Fatal("Error during streamed upload: ", err)
+	}
+	if string(resp) != "OK" || received != int64(len(first)+len(second)) {
+		t.Errorf("Server did not receive the full file. Got %d bytes.", received)
+	}
+	if lastSent != lastTotal || lastTotal != int64(len(first)+len(second)) {
+		t.Errorf("Final progress was %d of %d", lastSent, lastTotal)
+	}
+}
+
+func TestFileUploaderClientProgressTotalFromContent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	var total int64
+	_, err := FileUploaderClient(UploadClientSpec{
+		URL:      ts.URL,
+		Content:  strings.NewReader("0123456789"),
+		Filename: "test.txt",
+		Progress: func(sent, t int64) { total = t },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 10 {
+		t.Error("Expected the total to be taken from the content length. Got:", total)
+	}
+}
+
+type brokenReader struct{}
+
+func (brokenReader) Read(p []byte) (int, error) { return 0, errors.New("disk on fire") }
+
+func TestFileUploaderClientErrors(t *testing.T) {
+	t.Run("Content read error", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+		}))
+		defer ts.Close()
+		_, err := FileUploaderClient(UploadClientSpec{URL: ts.URL, Content: brokenReader{}, Filename: "x"})
+		if err == nil || !strings.Contains(err.Error(), "disk on fire") {
+			t.Error("Expected the content read error to be returned. Got:", err)
+		}
+	})
+
+	t.Run("Non-2xx status", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			http.Error(w, "too big", http.StatusRequestEntityTooLarge)
+		}))
+		defer ts.Close()
+		body, err := FileUploaderClient(UploadClientSpec{URL: ts.URL, Content: strings.NewReader("x"), Filename: "x"})
+		statusErr, ok := err.(*StatusError)
+		if !ok {
+			t.Fatal("Expected a *StatusError. Got:", err)
+		}
+		if statusErr.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(string(body), "too big") {
+			t.Error("Unexpected status error:", statusErr)
+		}
+	})
+
+	t.Run("Context cancellation", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+		}))
+		defer ts.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		go func() {
+			pw.Write([]byte("some content"))
+			cancel()
+		}()
+		_, err := FileUploaderClientContext(ctx, UploadClientSpec{URL: ts.URL, Content: pr, Filename: "x"})
+		if err == nil || !errors.Is(err, context.Canceled) {
+			t.Error("Expected the upload to stop with context.Canceled. Got:", err)
+		}
+	})
+}
+
+type countingTransport struct {
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests++
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestFileUploaderClientRequestOptions(t *testing.T) {
+	var got *http.Request
+	var fields map[string][]string
+	var fileField string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got = r
+		fields = r.MultipartForm.Value
+		for name := range r.MultipartForm.File {
+			fileField = name
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	_, err := FileUploaderClient(UploadClientSpec{
+		URL:         ts.URL,
+		Content:     strings.NewReader("content"),
+		Filename:    "test.txt",
+		FieldName:   "document",
+		Fields:      map[string]string{"folder": "invoices", "owner": "finance"},
+		Headers:     http.Header{"X-Tenant": []string{"acme"}, "Content-Type": []string{"text/plain"}},
+		BearerToken: "s3cr3t",
+		Client:      &http.Client{Transport: transport},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileField != "document" {
+		t.Error("Expected the file in the \"document\" field. Got:", fileField)
+	}
+	if fields["folder"][0] != "invoices" || fields["owner"][0] != "finance" {
+		t.Error("Extra form fields were not sent:", fields)
+	}
+	if got.Header.Get("X-Tenant") != "acme" {
+		t.Error("Custom header was not sent.")
+	}
+	if !strings.HasPrefix(got.Header.Get("Content-Type"), "multipart/form-data") {
+		t.Error("Content-Type must stay multipart. Got:", got.Header.Get("Content-Type"))
+	}
+	if got.Header.Get("Authorization") != "Bearer s3cr3t" {
+		t.Error("Bearer token was not sent. Got:", got.Header.Get("Authorization"))
+	}
+	if transport.requests != 1 {
+		t.Error("Custom client was not used.")
+	}
+
+	_, err = FileUploaderClient(UploadClientSpec{
+		URL:       ts.URL,
+		Content:   strings.NewReader("content"),
+		Filename:  "test.txt",
+		BasicAuth: &BasicAuth{Username: "alice", Password: "pa55"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, pass, ok := got.BasicAuth(); !ok || user != "alice" || pass != "pa55" {
+		t.Error("Basic auth was not sent.")
+	}
+}
@@ -0,0 +1,300 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HeaderIdempotencyKey marks a request that is safe to retry whatever its method
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// Attempt describes one try at sending a request, as reported to ClientSpec.OnAttempt
+type Attempt struct {
+	Request *http.Request
+	// Number counts from 1
+	Number int
+	// StatusCode is 0 when no response was received
+	StatusCode int
+	Err        error
+	Duration   time.Duration
+	// Retry says whether another attempt follows, after Delay
+	Retry bool
+	Delay time.Duration
+}
+
+// ClientSpec captures the specification for a Client
+type ClientSpec struct {
+	// HTTPClient sends each attempt. Defaults to http.DefaultClient traced with TracingTransport.
+	HTTPClient *http.Client
+	// MaxAttempts bounds the tries at a request, the first included. Defaults to 3; 1 disables retries.
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry, doubling for each one after. Defaults to 200ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff. Defaults to 10s.
+	MaxDelay time.Duration
+	// MaxRetryAfter is the longest Retry-After the client waits for; a server asking for longer gets its
+	// response returned instead. Defaults to one minute.
+	MaxRetryAfter time.Duration
+	// RetryStatuses are the response statuses worth retrying. Defaults to 429, 502, 503 and 504.
+	RetryStatuses []int
+	// Breaker configures the circuit breaker kept for each host
+	Breaker BreakerSpec
+	// OnAttempt, when set, is called after every attempt
+	OnAttempt func(Attempt)
+	// OnBreakerChange, when set, is called when a host's breaker changes state
+	OnBreakerChange func(host string, from, to BreakerState)
+}
+
+// ClientStats counts what a Client has done since it was created
+type ClientStats struct {
+	Requests uint64
+	Attempts uint64
+	Retries  uint64
+	// Failures counts attempts that ended in a transport error or a 5xx response
+	Failures uint64
+	// Rejected counts requests refused by an open circuit breaker
+	Rejected uint64
+}
+
+// Client sends requests with retries and per host circuit breakers. Idempotent requests (GET, HEAD, OPTIONS,
+// TRACE, PUT and DELETE, or any request with an Idempotency-Key header) are retried after transport errors and
+// the spec's RetryStatuses, with exponential backoff and full jitter, or after the delay a Retry-After header
+// asks for. A request body can only be sent again if the request has GetBody, as http.NewRequest sets for
+// in-memory bodies. A Client is safe for concurrent use; share one so its breakers see all traffic to a host.
+type Client struct {
+	spec ClientSpec
+	now  func() time.Time
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+	swept    time.Time
+	stats    ClientStats
+}
+
+// NewClient returns a Client per the spec
+func NewClient(spec ClientSpec) *Client {
+	if spec.HTTPClient == nil {
+		spec.HTTPClient = defaultClient
+	}
+	if spec.MaxAttempts <= 0 {
+		spec.MaxAttempts = 3
+	}
+	if spec.BaseDelay <= 0 {
+		spec.BaseDelay = 200 * time.Millisecond
+	}
+	if spec.MaxDelay <= 0 {
+		spec.MaxDelay = 10 * time.Second
+	}
+	if spec.MaxRetryAfter <= 0 {
+		spec.MaxRetryAfter = time.Minute
+	}
+	if spec.RetryStatuses == nil {
+		spec.RetryStatuses = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if spec.Breaker.FailureThreshold <= 0 {
+		spec.Breaker.FailureThreshold = 5
+	}
+	if spec.Breaker.OpenDuration <= 0 {
+		spec.Breaker.OpenDuration = 30 * time.Second
+	}
+	if spec.Breaker.IdleTimeout <= 0 {
+		spec.Breaker.IdleTimeout = 10 * time.Minute
+	}
+	return &Client{spec: spec, now: time.Now, breakers: make(map[string]*circuitBreaker)}
+}
+
+// DefaultClient is the Client used by FileUploaderClient and HTMLParserClient unless their spec names another
+var DefaultClient = NewClient(ClientSpec{})
+
+// Get sends a GET request for url within ctx
+func (c *Client) Get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends the request, retrying it per the spec. The response to the last attempt is returned as
+// http.Client.Do would; the bodies of earlier responses are drained and closed. Requests to a host whose breaker
+// is open fail straight away with a *CircuitOpenError.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	breaker := c.breaker(req.URL.Host)
+	retryable := isIdempotent(req) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+	c.count(func(s *ClientStats) { s.Requests++ })
+	for number := 1; ; number++ {
+		var trial bool
+		if breaker != nil {
+			var err error
+			if trial, err = breaker.allow(c.now()); err != nil {
+				c.count(func(s *ClientStats) { s.Rejected++ })
+				return nil, err
+			}
+		}
+		attemptReq := req
+		if number > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+
+		start := c.now()
+		resp, err := c.spec.HTTPClient.Do(attemptReq)
+		attempt := Attempt{Request: attemptReq, Number: number, Err: err, Duration: c.now().Sub(start)}
+		if resp != nil {
+			attempt.StatusCode = resp.StatusCode
+		}
+		failed := err != nil || resp.StatusCode >= 500
+		c.count(func(s *ClientStats) {
+			s.Attempts++
+			if failed {
+				s.Failures++
+			}
+		})
+		if breaker != nil {
+			switch {
+			case ctx.Err() != nil:
+				breaker.record(outcomeIgnored, trial, c.now())
+			case failed:
+				breaker.record(outcomeFailure, trial, c.now())
+			default:
+				breaker.record(outcomeSuccess, trial, c.now())
+			}
+		}
+
+		if retryable && number < c.spec.MaxAttempts && ctx.Err() == nil && c.shouldRetry(resp, err) {
+			attempt.Delay, attempt.Retry = c.delay(number, resp)
+		}
+		if c.spec.OnAttempt != nil {
+			c.spec.OnAttempt(attempt)
+		}
+		if !attempt.Retry {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		c.count(func(s *ClientStats) { s.Retries++ })
+		timer := time.NewTimer(attempt.Delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// BreakerState returns the state of the circuit breaker for host, e.g. "example.com:443"
+func (c *Client) BreakerState(host string) BreakerState {
+	c.mu.Lock()
+	b := c.breakers[host]
+	c.mu.Unlock()
+	if b == nil {
+		return BreakerClosed
+	}
+	return b.current()
+}
+
+// Stats returns the counts so far
+func (c *Client) Stats() ClientStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *Client) count(update func(*ClientStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	update(&c.stats)
+}
+
+func (c *Client) breaker(host string) *circuitBreaker {
+	if c.spec.Breaker.Disabled {
+		return nil
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.swept) >= c.spec.Breaker.IdleTimeout {
+		// Forget idle hosts so the map does not grow with every host the client has ever seen
+		for h, b := range c.breakers {
+			if b.idle(now) {
+				delete(c.breakers, h)
+			}
+		}
+		c.swept = now
+	}
+	b, ok := c.breakers[host]
+	if !ok {
+		b = &circuitBreaker{spec: &c.spec.Breaker, host: host, onChange: c.spec.OnBreakerChange, lastUsed: now}
+		c.breakers[host] = b
+	}
+	return b
+}
+
+func (c *Client) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	for _, status := range c.spec.RetryStatuses {
+		if resp.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// delay works out the wait before the next attempt, from Retry-After when the server sent one. A Retry-After
+// longer than MaxRetryAfter means the request is not retried.
+func (c *Client) delay(number int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if wait, ok := retryAfter(resp.Header.Get("Retry-After"), c.now()); ok {
+			return wait, wait <= c.spec.MaxRetryAfter
+		}
+	}
+	backoff := c.spec.MaxDelay
+	if shift := uint(number - 1); shift < 32 {
+		if d := c.spec.BaseDelay << shift; d > 0 && d < backoff {
+			backoff = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1)), true
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		if wait := at.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get(HeaderIdempotencyKey) != ""
+}
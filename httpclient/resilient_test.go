@@ -0,0 +1,240 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer fails its first failures requests with status, then answers "ok"
+func flakyServer(failures, status int, header http.Header) (*httptest.Server, *int) {
+	var mu sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		if n <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	return ts, &requests
+}
+
+func TestClientRetries(t *testing.T) {
+	ts, requests := flakyServer(2, http.StatusServiceUnavailable, nil)
+	defer ts.Close()
+	var attempts []Attempt
+	c := NewClient(ClientSpec{BaseDelay: time.Millisecond, OnAttempt: func(a Attempt) { attempts = append(attempts, a) }})
+
+	resp, err := c.Get(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" || *requests != 3 {
+		t.Error("Expected the third attempt to succeed. Got: ", resp.StatusCode, *requests)
+	}
+	if len(attempts) != 3 || !attempts[0].Retry || attempts[0].StatusCode != http.StatusServiceUnavailable || attempts[2].Retry || attempts[2].Number != 3 {
+		t.Errorf("Unexpected attempts: %+v", attempts)
+	}
+	if attempts[0].Delay > time.Millisecond || attempts[1].Delay > 2*time.Millisecond {
+		t.Errorf("Expected jittered exponential backoff: %v %v", attempts[0].Delay, attempts[1].Delay)
+	}
+	if s := c.Stats(); s.Requests != 1 || s.Attempts != 3 || s.Retries != 2 || s.Failures != 2 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+
+	ts, requests = flakyServer(5, http.StatusBadGateway, nil)
+	defer ts.Close()
+	resp, err = NewClient(ClientSpec{BaseDelay: time.Millisecond}).Get(context.Background(), ts.URL)
+	if err != nil || resp.StatusCode != http.StatusBadGateway || *requests != 3 {
+		t.Error("Expected the last response after MaxAttempts. Got: ", err, *requests)
+	}
+}
+
+func TestClientRetryPolicy(t *testing.T) {
+	c := NewClient(ClientSpec{BaseDelay: time.Millisecond})
+
+	ts, requests := flakyServer(1, http.StatusServiceUnavailable, nil)
+	defer ts.Close()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("payment"))
+	resp, _ := c.Do(req)
+	if resp.StatusCode != http.StatusServiceUnavailable || *requests != 1 {
+		t.Error("A POST should not be retried. Got: ", resp.StatusCode, *requests)
+	}
+
+	ts, requests = flakyServer(1, http.StatusServiceUnavailable, nil)
+	defer ts.Close()
+	req, _ = http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("payment"))
+	req.Header.Set(HeaderIdempotencyKey, "order-1")
+	if resp, _ := c.Do(req); resp.StatusCode != http.StatusOK || *requests != 2 {
+		t.Error("Expected a POST with an Idempotency-Key to be retried. Got: ", resp.StatusCode, *requests)
+	}
+
+	ts, requests = flakyServer(1, http.StatusInternalServerError, nil)
+	defer ts.Close()
+	if resp, _ := c.Get(context.Background(), ts.URL); resp.StatusCode != http.StatusInternalServerError || *requests != 1 {
+		t.Error("A 500 is not in the default RetryStatuses. Got: ", resp.StatusCode, *requests)
+	}
+
+	ts, requests = flakyServer(1, http.StatusServiceUnavailable, nil)
+	defer ts.Close()
+	req, _ = http.NewRequest(http.MethodPut, ts.URL, ioutil.NopCloser(strings.NewReader("streamed")))
+	if resp, _ := c.Do(req); resp.StatusCode != http.StatusServiceUnavailable || *requests != 1 {
+		t.Error("A body that cannot be sent again should not be retried. Got: ", resp.StatusCode, *requests)
+	}
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	ts, requests := flakyServer(1, http.StatusTooManyRequests, http.Header{"Retry-After": []string{"0"}})
+	defer ts.Close()
+	var delays []time.Duration
+	c := NewClient(ClientSpec{BaseDelay: time.Hour, OnAttempt: func(a Attempt) { delays = append(delays, a.Delay) }})
+	if resp, err := c.Get(context.Background(), ts.URL); err != nil || resp.StatusCode != http.StatusOK || *requests != 2 {
+		t.Fatal("Expected Retry-After to set the delay. Got: ", err, *requests)
+	}
+	if delays[0] != 0 {
+		t.Error("Expected the Retry-After delay. Got: ", delays[0])
+	}
+
+	ts, requests = flakyServer(1, http.StatusServiceUnavailable, http.Header{"Retry-After": []string{"3600"}})
+	defer ts.Close()
+	if resp, _ := c.Get(context.Background(), ts.URL); resp.StatusCode != http.StatusServiceUnavailable || *requests != 1 {
+		t.Error("Expected a Retry-After past MaxRetryAfter to end the retries. Got: ", *requests)
+	}
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if wait, ok := retryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now); !ok || wait != 90*time.Second {
+		t.Error("Expected an HTTP date Retry-After to be understood. Got: ", wait, ok)
+	}
+	if _, ok := retryAfter("soon", now); ok {
+		t.Error("Expected an invalid Retry-After to be ignored.")
+	}
+}
+
+func TestClientCancelledDuringBackoff(t *testing.T) {
+	ts, _ := flakyServer(5, http.StatusServiceUnavailable, nil)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c := NewClient(ClientSpec{BaseDelay: time.Hour, MaxDelay: time.Hour})
+	start := time.Now()
+	if _, err := c.Get(ctx, ts.URL); !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Error("Expected the backoff to stop with the context. Got: ", err)
+	}
+}
+
+func TestFileUploaderClientRetries(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, _, _ := r.FormFile("file")
+		content, _ := ioutil.ReadAll(f)
+		mu.Lock()
+		bodies = append(bodies, string(content))
+		n := len(bodies)
+		mu.Unlock()
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("stored"))
+	}))
+	defer ts.Close()
+
+	resp, err := FileUploaderClient(UploadClientSpec{
+		URL:       ts.URL,
+		Content:   bytes.NewReader([]byte("report contents")),
+		Filename:  "report.txt",
+		Headers:   http.Header{HeaderIdempotencyKey: []string{"report-1"}},
+		Resilient: NewClient(ClientSpec{BaseDelay: time.Millisecond}),
+	})
+	if err != nil || string(resp) != "stored" {
+		t.Fatal("Expected the upload to be retried. Got: ", err)
+	}
+	if len(bodies) != 2 || bodies[0] != "report contents" || bodies[1] != "report contents" {
+		t.Error("Expected the whole file to be sent again. Got: ", bodies)
+	}
+
+	bodies = nil
+	_, err = FileUploaderClient(UploadClientSpec{
+		URL:       ts.URL,
+		Content:   io.MultiReader(strings.NewReader("streamed")),
+		Filename:  "report.txt",
+		Headers:   http.Header{HeaderIdempotencyKey: []string{"report-2"}},
+		Resilient: NewClient(ClientSpec{BaseDelay: time.Millisecond}),
+	})
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.StatusCode != http.StatusServiceUnavailable || len(bodies) != 1 {
+		t.Error("Expected content that cannot be rewound to be sent once. Got: ", err)
+	}
+}
+
+func TestHTMLParserClientRetries(t *testing.T) {
+	ts, requests := flakyServer(1, http.StatusBadGateway, nil)
+	defer ts.Close()
+	var parsed string
+	err := HTMLParserClient(HTMLParserClientSpec{
+		URL:    ts.URL,
+		Parser: func(r io.Reader) { b, _ := ioutil.ReadAll(r); parsed = string(b) },
+		Client: NewClient(ClientSpec{BaseDelay: time.Millisecond}),
+	})
+	if err != nil || parsed != "ok" || *requests != 2 {
+		t.Error("Expected the page to be fetched on the second attempt. Got: ", err, *requests)
+	}
+
+	ts, _ = flakyServer(1, http.StatusNotFound, nil)
+	defer ts.Close()
+	err = HTMLParserClient(HTMLParserClientSpec{URL: ts.URL, Parser: func(io.Reader) {}})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Error("Expected a non-200 status to fail. Got: ", err)
+	}
+}
+
+func TestFileUploaderClientBreakers(t *testing.T) {
+	ts, requests := flakyServer(100, http.StatusInternalServerError, nil)
+	defer ts.Close()
+	upload := func(spec UploadClientSpec) error {
+		spec.URL, spec.Filename, spec.Content = ts.URL, "report.txt", strings.NewReader("report")
+		_, err := FileUploaderClient(spec)
+		return err
+	}
+
+	hc := &http.Client{}
+	for i := 0; i < 6; i++ {
+		if err := upload(UploadClientSpec{Client: hc}); errors.Is(err, ErrCircuitOpen) {
+			t.Fatal("Expected uploads with only an http.Client not to share a breaker.")
+		}
+	}
+	if *requests != 6 {
+		t.Error("Expected every upload to reach the server. Got: ", *requests)
+	}
+
+	resilient := NewClient(ClientSpec{HTTPClient: hc})
+	for i := 0; i < 5; i++ {
+		upload(UploadClientSpec{Resilient: resilient})
+	}
+	if err := upload(UploadClientSpec{Resilient: resilient}); !errors.Is(err, ErrCircuitOpen) || *requests != 11 {
+		t.Error("Expected uploads through the same Resilient to share a breaker. Got: ", err, *requests)
+	}
+}
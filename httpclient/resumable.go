@@ -0,0 +1,193 @@
+package httpclient
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ResumableUploadClientSpec specifies the requirements for the ResumableUploadClient
+type ResumableUploadClientSpec struct {
+	// URL is where the ResumableUploadHandler is mounted, e.g. http://localhost:8087/resumable/
+	URL      string
+	Content  io.ReadSeeker
+	Filename string
+	// Size of Content in bytes. Worked out by seeking to the end of Content when zero.
+	Size int64
+	// ChunkSize is the most sent in a single PATCH. Defaults to 8 MiB.
+	ChunkSize int64
+	// MaxRetries is how many times in a row a chunk may fail before giving up. Defaults to 5.
+	MaxRetries int
+	// RetryDelay is the wait before the first retry; it doubles with each further retry. Defaults to 1 second.
+	RetryDelay time.Duration
+	Client     *http.Client
+}
+
+// ResumableUploadClient uploads Content in chunks to a ResumableUploadHandler. When a chunk fails it asks
+// the server for the last acknowledged offset and carries on from there. Returns the body of the finalise
+// response.
+func ResumableUploadClient(spec ResumableUploadClientSpec) ([]byte, error) {
+	return ResumableUploadClientContext(context.Background(), spec)
+}
+
+// ResumableUploadClientContext uploads Content in chunks per the spec. Cancelling ctx stops the upload, leaving
+// it on the server to be resumed or to expire. A chunk the server acknowledges without moving the offset on
+// counts as a failure, so a server that makes no progress is given up on after MaxRetries.
+func ResumableUploadClientContext(ctx context.Context, spec ResumableUploadClientSpec) ([]byte, error) {
+	if spec.ChunkSize <= 0 {
+		spec.ChunkSize = 8 << 20
+	}
+	if spec.MaxRetries <= 0 {
+		spec.MaxRetries = 5
+	}
+	if spec.RetryDelay <= 0 {
+		spec.RetryDelay = time.Second
+	}
+	if spec.Client == nil {
+		spec.Client = http.DefaultClient
+	}
+	if spec.Size == 0 {
+		size, err := spec.Content.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		spec.Size = size
+	}
+
+	location, err := createResumableUpload(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	var offset int64
+	failures := 0
+	for offset < spec.Size {
+		next, err := sendChunk(ctx, spec, location, offset)
+		if err == nil {
+			offset = next
+			failures = 0
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		failures++
+		if failures > spec.MaxRetries {
+			return nil, fmt.Errorf("upload stopped at offset %d after %d retries: %v", offset, spec.MaxRetries, err)
+		}
+		timer := time.NewTimer(spec.RetryDelay << uint(failures-1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		if current, headErr := resumableOffset(ctx, spec, location); headErr == nil {
+			offset = current
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := spec.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return body, fmt.Errorf("finalising upload failed with status %d: %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+func createResumableUpload(ctx context.Context, spec ResumableUploadClientSpec) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, spec.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Upload-Length", strconv.FormatInt(spec.Size, 10))
+	if spec.Filename != "" {
+		req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(spec.Filename)))
+	}
+	resp, err := spec.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("creating upload failed with status %d: %s", resp.StatusCode, body)
+	}
+	base, err := url.Parse(spec.URL)
+	if err != nil {
+		return "", err
+	}
+	location, err := base.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	return location.String(), nil
+}
+
+// sendChunk PATCHes the chunk starting at offset and returns the offset the server acknowledged
+func sendChunk(ctx context.Context, spec ResumableUploadClientSpec, location string, offset int64) (int64, error) {
+	if _, err := spec.Content.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	length := spec.Size - offset
+	if length > spec.ChunkSize {
+		length = spec.ChunkSize
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, location, ioutil.NopCloser(io.LimitReader(spec.Content, length)))
+	if err != nil {
+		return offset, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	resp, err := spec.Client.Do(req)
+	if err != nil {
+		return offset, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent {
+		return offset, fmt.Errorf("chunk at offset %d failed with status %d", offset, resp.StatusCode)
+	}
+	next, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return offset, err
+	}
+	if next <= offset {
+		return offset, fmt.Errorf("chunk at offset %d was acknowledged without progress", offset)
+	}
+	return next, nil
+}
+
+// resumableOffset asks the server how much of the upload it has
+func resumableOffset(ctx context.Context, spec ResumableUploadClientSpec, location string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, location, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := spec.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("checking upload offset failed with status %d", resp.StatusCode)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
@@ -0,0 +1,158 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyResumableServer keeps a single upload in memory and fails every third chunk after accepting part of it
+type flakyResumableServer struct {
+	mu      sync.Mutex
+	data    []byte
+	length  int64
+	patches int
+	done    bool
+}
+
+func (s *flakyResumableServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/files/":
+		s.length, _ = strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		w.Header().Set("Location", "/files/1")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(s.data)))
+	case r.Method == http.MethodPatch:
+		if r.Header.Get("Upload-Offset") != strconv.Itoa(len(s.data)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		s.patches++
+		if s.patches%3 == 0 {
+			s.data = append(s.data, body[:len(body)/2]...)
+			http.Error(w, "interrupted", http.StatusBadGateway)
+			return
+		}
+		s.data = append(s.data, body...)
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(s.data)))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost:
+		if int64(len(s.data)) != s.length {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.done = true
+		w.Write([]byte("DONE"))
+	}
+}
+
+func TestResumableUploadClient(t *testing.T) {
+	server := &flakyResumableServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	data := strings.Repeat("this is test content of the file that will be uploaded.", 20)
+	resp, err := ResumableUploadClient(ResumableUploadClientSpec{
+		URL:        ts.URL + "/files/",
+		Content:    strings.NewReader(data),
+		Filename:   "test.txt",
+		ChunkSize:  100,
+		RetryDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Error during resumable upload: ", err)
+	}
+	if string(resp) != "DONE" {
+		t.Error("Did not find the right response: ", string(resp))
+	}
+	if !server.done || !bytes.Equal(server.data, []byte(data)) {
+		t.Error("Server did not receive the complete content.")
+	}
+}
+
+func TestResumableUploadClientGivesUp(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.Header().Set("Location", "/files/1")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	_, err := ResumableUploadClient(ResumableUploadClientSpec{
+		URL:        ts.URL + "/files/",
+		Content:    strings.NewReader("content"),
+		MaxRetries: 2,
+		RetryDelay: time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("Expected an error once retries were exhausted.")
+	}
+}
+
+func TestResumableUploadClientNoProgress(t *testing.T) {
+	patches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			w.Header().Set("Location", "/files/1")
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodPatch:
+			patches++
+			fallthrough
+		default:
+			ioutil.ReadAll(r.Body)
+			w.Header().Set("Upload-Offset", "0")
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	_, err := ResumableUploadClient(ResumableUploadClientSpec{
+		URL:        ts.URL + "/files/",
+		Content:    strings.NewReader("content"),
+		MaxRetries: 2,
+		RetryDelay: time.Millisecond,
+	})
+	if err == nil || !strings.Contains(err.Error(), "without progress") || patches != 3 {
+		t.Error("Expected to give up on a server that makes no progress. Got: ", err, patches)
+	}
+}
+
+func TestResumableUploadClientContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.Header().Set("Location", "/files/1")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := ResumableUploadClientContext(ctx, ResumableUploadClientSpec{
+		URL:        ts.URL + "/files/",
+		Content:    strings.NewReader("content"),
+		RetryDelay: time.Hour,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Error("Expected the upload to stop with the context. Got: ", err)
+	}
+}
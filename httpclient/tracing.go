@@ -0,0 +1,69 @@
+package httpclient
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/arunsworld/go-service/tracing"
+)
+
+// TracingTransport starts a client span for every request, as a child of the span in the request context, and
+// sends it downstream in the traceparent header
+type TracingTransport struct {
+	// Base sends the requests. Defaults to http.DefaultTransport.
+	Base http.RoundTripper
+	// Tracer starts the spans. Defaults to the tracer of the span in the request context, or tracing.Default().
+	Tracer *tracing.Tracer
+}
+
+// RoundTrip sends the request with the trace headers
+func (t *TracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	tracer := t.Tracer
+	if tracer == nil {
+		tracer = tracing.TracerFromContext(req.Context())
+	}
+	ctx, span := tracer.Start(req.Context(), "HTTP "+req.Method, tracing.SpanKindClient)
+	defer span.End()
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", redactedURL(req))
+
+	req = req.Clone(ctx)
+	tracing.Inject(ctx, req.Header)
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.SetStatus(tracing.StatusError, fmt.Sprintf("status %d", resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// redactedURL leaves credentials and the query, which may carry signatures or tokens, out of the span
+func redactedURL(req *http.Request) string {
+	u := *req.URL
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	return u.String()
+}
+
+// TracedClient returns a copy of c, or of http.DefaultClient when c is nil, whose requests are traced.
+// Pass the request context, e.g. with FileUploaderClientContext, for calls to join the caller's trace.
+func TracedClient(c *http.Client) *http.Client {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	traced := *c
+	traced.Transport = &TracingTransport{Base: c.Transport}
+	return &traced
+}
+
+// defaultClient is used when a spec leaves Client unset
+var defaultClient = TracedClient(nil)
@@ -0,0 +1,75 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arunsworld/go-service/tracing"
+)
+
+func TestTracingTransport(t *testing.T) {
+	var received string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(tracing.HeaderTraceparent)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer ts.Close()
+
+	exporter := tracing.NewMemoryExporter()
+	tracer := tracing.NewTracer(tracing.TracerSpec{Exporter: exporter})
+	ctx, parent := tracer.Start(context.Background(), "handler", tracing.SpanKindServer)
+	client := TracedClient(nil)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/ok?signature=secret", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if req.Header.Get(tracing.HeaderTraceparent) != "" {
+		t.Error("The caller's request should not be modified.")
+	}
+	sc, err := tracing.ParseTraceparent(received)
+	if err != nil || sc.TraceID != parent.SpanContext().TraceID {
+		t.Fatal("Expected the caller's trace downstream. Got: ", received)
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatal("Expected a client span. Got: ", len(spans))
+	}
+	span := spans[0]
+	if span.Kind != tracing.SpanKindClient || span.SpanID != sc.SpanID.String() || span.ParentSpanID != parent.SpanContext().SpanID.String() {
+		t.Errorf("Unexpected client span: %+v", span)
+	}
+	if span.Attributes["http.status_code"] != http.StatusOK || strings.Contains(span.Attributes["http.url"].(string), "secret") {
+		t.Errorf("Unexpected client span attributes: %+v", span.Attributes)
+	}
+
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/fail", nil)
+	resp, _ = client.Do(req)
+	resp.Body.Close()
+	failing := &TracingTransport{Base: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})}
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	if _, err := (&http.Client{Transport: failing}).Do(req); err == nil {
+		t.Error("Expected the transport error.")
+	}
+	spans = exporter.Spans()
+	if len(spans) != 3 || spans[1].Status != tracing.StatusError || spans[2].Status != tracing.StatusError {
+		t.Errorf("Expected failed calls to be marked as errors: %+v", spans)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
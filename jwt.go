@@ -0,0 +1,348 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned when verifying a JWT
+var (
+	ErrTokenInvalid    = errors.New("token is invalid")
+	ErrTokenExpired    = errors.New("token has expired")
+	ErrTokenClaims     = errors.New("token audience or issuer does not match")
+	ErrUnsupportedAlgo = errors.New("token algorithm is not accepted")
+)
+
+// jwksMinReload stops tokens naming unknown key ids from hammering the JWKS source
+const jwksMinReload = time.Minute
+
+// jwksRetryDelay is the wait after a failed JWKS load before another is tried
+const jwksRetryDelay = 5 * time.Second
+
+// jwksFetchTimeout bounds a JWKS fetch when the HTTPClient has no timeout of its own
+const jwksFetchTimeout = 10 * time.Second
+
+// JWTSpec captures the specification for a JWTAuthenticator. Only HS256 and RS256 tokens are accepted, and
+// only for the kinds of key configured, so a token cannot pick its own algorithm.
+type JWTSpec struct {
+	// HMACSecret verifies HS256 tokens. HS256 is refused without it.
+	HMACSecret []byte
+	// RSAKeys verify RS256 tokens by key id
+	RSAKeys map[string]*rsa.PublicKey
+	// JWKSFile or JWKSURL load further RS256 keys from a JSON Web Key Set. They are reloaded every JWKSRefresh,
+	// one hour by default, and when a token names an unknown key id.
+	JWKSFile    string
+	JWKSURL     string
+	JWKSRefresh time.Duration
+	// HTTPClient fetches JWKSURL. Defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+	// Audience and Issuer, when set, must match the aud and iss claims
+	Audience string
+	Issuer   string
+	// Leeway allows for clock skew when checking exp and nbf
+	Leeway time.Duration
+}
+
+// JWTAuthenticator authenticates requests carrying an "Authorization: Bearer" JWT. Tokens must have an exp claim.
+// The principal's subject is the sub claim.
+type JWTAuthenticator struct {
+	spec JWTSpec
+	now  func() time.Time
+
+	mu       sync.Mutex
+	jwks     map[string]*rsa.PublicKey
+	loadedAt time.Time
+	retryAt  time.Time
+	loading  chan struct{}
+}
+
+// NewJWTAuthenticator returns an authenticator for the spec. The JWKS is loaded when first needed.
+func NewJWTAuthenticator(spec JWTSpec) *JWTAuthenticator {
+	if spec.JWKSRefresh == 0 {
+		spec.JWKSRefresh = time.Hour
+	}
+	if spec.HTTPClient == nil {
+		spec.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &JWTAuthenticator{spec: spec, now: time.Now}
+}
+
+// Authenticate verifies the bearer token on r
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return Principal{}, ErrNoCredentials
+	}
+	p := Principal{Method: AuthMethodJWT}
+	claims, err := a.Verify(r.Context(), strings.TrimSpace(auth[7:]))
+	if err != nil {
+		return p, err
+	}
+	p.Subject, _ = claims["sub"].(string)
+	p.Claims = claims
+	return p, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks the token's signature and claims and returns the claims
+func (a *JWTAuthenticator) Verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch header.Alg {
+	case "HS256":
+		if len(a.spec.HMACSecret) == 0 {
+			return nil, ErrUnsupportedAlgo
+		}
+		mac := hmac.New(sha256.New, a.spec.HMACSecret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, ErrTokenInvalid
+		}
+	case "RS256":
+		key, err := a.rsaKey(ctx, header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return nil, ErrTokenInvalid
+		}
+	default:
+		return nil, ErrUnsupportedAlgo
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (a *JWTAuthenticator) checkClaims(claims map[string]interface{}) error {
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return ErrTokenInvalid
+	}
+	if !now.Before(time.Unix(int64(exp), 0).Add(a.spec.Leeway)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.spec.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return ErrTokenInvalid
+	}
+	if a.spec.Issuer != "" && claims["iss"] != a.spec.Issuer {
+		return ErrTokenClaims
+	}
+	if a.spec.Audience != "" && !hasAudience(claims["aud"], a.spec.Audience) {
+		return ErrTokenClaims
+	}
+	return nil
+}
+
+// hasAudience handles aud being either a string or an array of them
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, v := range aud {
+			if v == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rsaKey finds the key for kid. A token without a kid is accepted when there is only one key.
+func (a *JWTAuthenticator) rsaKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	hasJWKS := a.spec.JWKSFile != "" || a.spec.JWKSURL != ""
+	a.mu.Lock()
+	stale := a.jwks == nil || a.now().Sub(a.loadedAt) >= a.spec.JWKSRefresh
+	a.mu.Unlock()
+	if hasJWKS && stale {
+		a.reload(ctx, a.spec.JWKSRefresh)
+	}
+	a.mu.Lock()
+	key := a.lookup(kid)
+	a.mu.Unlock()
+	if key == nil && hasJWKS {
+		a.reload(ctx, jwksMinReload)
+		a.mu.Lock()
+		key = a.lookup(kid)
+		a.mu.Unlock()
+	}
+	if key == nil {
+		return nil, ErrTokenInvalid
+	}
+	return key, nil
+}
+
+// lookup is called with a.mu held
+func (a *JWTAuthenticator) lookup(kid string) *rsa.PublicKey {
+	if kid == "" {
+		if len(a.spec.RSAKeys)+len(a.jwks) != 1 {
+			return nil
+		}
+		for _, key := range a.spec.RSAKeys {
+			return key
+		}
+		for _, key := range a.jwks {
+			return key
+		}
+	}
+	if key, ok := a.spec.RSAKeys[kid]; ok {
+		return key
+	}
+	return a.jwks[kid]
+}
+
+// reload loads the JWKS unless it was loaded within minAge or a failed load is backing off, and waits for it
+// until ctx is done. A single load runs at a time, outside a.mu and apart from any request, so a slow or
+// cancelled request cannot hold up other verifications or fail the load.
+func (a *JWTAuthenticator) reload(ctx context.Context, minAge time.Duration) {
+	a.mu.Lock()
+	now := a.now()
+	done := a.loading
+	if done == nil {
+		if (a.jwks != nil && now.Sub(a.loadedAt) < minAge) || now.Before(a.retryAt) {
+			a.mu.Unlock()
+			return
+		}
+		done = make(chan struct{})
+		a.loading = done
+		go a.load(done)
+	}
+	a.mu.Unlock()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// load fetches the keys and swaps them in. On failure the previous keys are kept.
+func (a *JWTAuthenticator) load(done chan struct{}) {
+	timeout := a.spec.HTTPClient.Timeout
+	if timeout <= 0 {
+		timeout = jwksFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	keys, err := a.loadJWKS(ctx)
+
+	a.mu.Lock()
+	if err != nil {
+		Logger(ctx).Error("Could not load JWKS", "error", err)
+		a.retryAt = a.now().Add(jwksRetryDelay)
+	} else {
+		a.jwks = keys
+		a.loadedAt = a.now()
+	}
+	a.loading = nil
+	a.mu.Unlock()
+	close(done)
+}
+
+func (a *JWTAuthenticator) loadJWKS(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	var data []byte
+	var err error
+	if a.spec.JWKSFile != "" {
+		data, err = ioutil.ReadFile(a.spec.JWKSFile)
+	} else {
+		data, err = a.fetchJWKS(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+func (a *JWTAuthenticator) fetchJWKS(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequest("GET", a.spec.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.spec.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// ParseJWKS returns the RSA signing keys of a JSON Web Key Set by key id. Other keys are skipped.
+func ParseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("JWK %s: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("JWK %s: bad exponent", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// signJWT builds a token signed with key, a []byte for HS256 or an *rsa.PrivateKey for RS256
+func signJWT(t *testing.T, alg, kid string, claims map[string]interface{}, key interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwksFor(keys map[string]*rsa.PublicKey) []byte {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, k := range keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "RSA", Kid: kid, Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		})
+	}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+func TestJWTHS256(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	secret := []byte("hmac-secret")
+	a := NewJWTAuthenticator(JWTSpec{HMACSecret: secret, Audience: "uploads", Issuer: "https://issuer.test", Leeway: time.Minute})
+	a.now = func() time.Time { return now }
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "alice", "aud": "uploads", "iss": "https://issuer.test", "exp": now.Add(time.Hour).Unix()}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	got, err := a.Verify(context.Background(), signJWT(t, "HS256", "", claims(nil), secret))
+	if err != nil || got["sub"] != "alice" {
+		t.Fatal("Expected a valid token: ", err)
+	}
+	if _, err := a.Verify(context.Background(), signJWT(t, "HS256", "", claims(map[string]interface{}{"aud": []string{"other", "uploads"}}), secret)); err != nil {
+		t.Error("Expected aud to match from an array: ", err)
+	}
+
+	cases := map[string]struct {
+		token    string
+		expected error
+	}{
+		"wrong secret": {signJWT(t, "HS256", "", claims(nil), []byte("other")), ErrTokenInvalid},
+		"expired":      {signJWT(t, "HS256", "", claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}), secret), ErrTokenExpired},
+		"no expiry":    {signJWT(t, "HS256", "", claims(map[string]interface{}{"exp": nil}), secret), ErrTokenInvalid},
+		"not yet":      {signJWT(t, "HS256", "", claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}), secret), ErrTokenInvalid},
+		"audience":     {signJWT(t, "HS256", "", claims(map[string]interface{}{"aud": "other"}), secret), ErrTokenClaims},
+		"issuer":       {signJWT(t, "HS256", "", claims(map[string]interface{}{"iss": "evil"}), secret), ErrTokenClaims},
+		"alg none":     {signJWT(t, "none", "", claims(nil), nil), ErrUnsupportedAlgo},
+		"rs256":        {signJWT(t, "RS256", "", claims(nil), secret), ErrTokenInvalid},
+		"garbage":      {"a.b", ErrTokenInvalid},
+	}
+	for name, c := range cases {
+		if _, err := a.Verify(context.Background(), c.token); err != c.expected {
+			t.Errorf("%s: expected %v, got %v", name, c.expected, err)
+		}
+	}
+	// Within the leeway
+	if _, err := a.Verify(context.Background(), signJWT(t, "HS256", "", claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}), secret)); err != nil {
+		t.Error("Expected the leeway to allow slightly expired tokens: ", err)
+	}
+}
+
+func TestJWTRS256WithJWKSFile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(file, jwksFor(map[string]*rsa.PublicKey{"k1": &key.PublicKey}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("hmac-secret")
+	a := NewJWTAuthenticator(JWTSpec{JWKSFile: file})
+	claims := map[string]interface{}{"sub": "svc", "exp": time.Now().Add(time.Hour).Unix()}
+
+	if _, err := a.Verify(context.Background(), signJWT(t, "RS256", "k1", claims, key)); err != nil {
+		t.Error("Expected the JWKS key to verify: ", err)
+	}
+	if _, err := a.Verify(context.Background(), signJWT(t, "RS256", "", claims, key)); err != nil {
+		t.Error("Expected the only key to be used without a kid: ", err)
+	}
+	if _, err := a.Verify(context.Background(), signJWT(t, "RS256", "k2", claims, key)); err != ErrTokenInvalid {
+		t.Error("Expected an unknown kid to be refused. Got: ", err)
+	}
+	// Without an HMAC secret, an HS256 token signed with the public key must not be accepted
+	pub := jwksFor(map[string]*rsa.PublicKey{"k1": &key.PublicKey})
+	if _, err := a.Verify(context.Background(), signJWT(t, "HS256", "k1", claims, pub)); err != ErrUnsupportedAlgo {
+		t.Error("Expected HS256 to be refused. Got: ", err)
+	}
+	if _, err := a.Verify(context.Background(), signJWT(t, "HS256", "", claims, secret)); err != ErrUnsupportedAlgo {
+		t.Error("Expected HS256 to be refused. Got: ", err)
+	}
+}
+
+func TestJWTJWKSURLRotation(t *testing.T) {
+	k1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	k2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	published := map[string]*rsa.PublicKey{"k1": &k1.PublicKey}
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(jwksFor(published))
+	}))
+	defer ts.Close()
+
+	now := time.Unix(1600000000, 0)
+	a := NewJWTAuthenticator(JWTSpec{JWKSURL: ts.URL})
+	a.now = func() time.Time { return now }
+	claims := map[string]interface{}{"sub": "svc", "exp": now.Add(time.Hour).Unix()}
+	h := Authenticate(AuthSpec{Authenticators: []Authenticator{a}})(http.HandlerFunc(principalHandler))
+	serve := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve(signJWT(t, "RS256", "k1", claims, k1)); w.Code != http.StatusOK || w.Body.String() != "jwt:svc" {
+		t.Fatal("Expected k1 to authenticate. Got: ", w.Code, w.Body.String())
+	}
+	published["k2"] = &k2.PublicKey
+	if w := serve(signJWT(t, "RS256", "k2", claims, k2)); w.Code != http.StatusUnauthorized || fetches != 1 {
+		t.Error("Unknown keys should not refetch the JWKS within a minute. Fetches: ", fetches)
+	}
+	now = now.Add(jwksMinReload)
+	if w := serve(signJWT(t, "RS256", "k2", claims, k2)); w.Code != http.StatusOK || fetches != 2 {
+		t.Error("Expected the JWKS to be refetched for the new key. Got: ", w.Code, fetches)
+	}
+	if w := serve("not-a-token"); w.Code != http.StatusUnauthorized {
+		t.Error("Expected a malformed token to be refused. Got: ", w.Code)
+	}
+}
+
+func TestJWTJWKSURLFailures(t *testing.T) {
+	k1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var fetches int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&fetches, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			<-release
+			w.Write(jwksFor(map[string]*rsa.PublicKey{"k1": &k1.PublicKey}))
+		default:
+			w.Write(jwksFor(map[string]*rsa.PublicKey{"k1": &k1.PublicKey}))
+		}
+	}))
+	defer ts.Close()
+
+	now := time.Unix(1600000000, 0)
+	var mu sync.Mutex
+	a := NewJWTAuthenticator(JWTSpec{JWKSURL: ts.URL})
+	a.now = func() time.Time { mu.Lock(); defer mu.Unlock(); return now }
+	token := signJWT(t, "RS256", "k1", map[string]interface{}{"sub": "svc", "exp": now.Add(time.Hour).Unix()}, k1)
+
+	if _, err := a.Verify(context.Background(), token); err != ErrTokenInvalid || atomic.LoadInt32(&fetches) != 1 {
+		t.Fatal("Expected the failed fetch to refuse the token. Got: ", err)
+	}
+	if _, err := a.Verify(context.Background(), token); err != ErrTokenInvalid || atomic.LoadInt32(&fetches) != 1 {
+		t.Error("Expected a failed fetch to back off. Fetches: ", atomic.LoadInt32(&fetches))
+	}
+
+	mu.Lock()
+	now = now.Add(jwksRetryDelay)
+	mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.Verify(ctx, token); err != ErrTokenInvalid {
+		t.Error("Expected a cancelled request to stop waiting for the JWKS. Got: ", err)
+	}
+	close(release)
+	if _, err := a.Verify(context.Background(), token); err != nil || atomic.LoadInt32(&fetches) != 2 {
+		t.Error("Expected the fetch started for the cancelled request to load the keys. Got: ", err, atomic.LoadInt32(&fetches))
+	}
+}
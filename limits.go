@@ -0,0 +1,226 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ReasonTimeout is reported in the ErrorResponse when a handler did not finish within its timeout
+const ReasonTimeout = "timeout"
+
+// TimeoutSpec captures the specification for Timeout
+type TimeoutSpec struct {
+	Timeout time.Duration
+	// Status sent when the timeout passes before the handler responds. Defaults to 503 Service Unavailable;
+	// 504 Gateway Timeout suits handlers that mostly wait on upstream services.
+	Status int
+}
+
+// Timeout cancels the request context once the spec's Timeout passes. If the handler has not started its response
+// by then the client gets a JSON error, and anything the handler writes afterwards fails with
+// http.ErrHandlerTimeout. A response that had already started is cut off by aborting the connection, so the client
+// cannot mistake it for a complete one.
+func Timeout(spec TimeoutSpec) Middleware {
+	if spec.Status == 0 {
+		spec.Status = http.StatusServiceUnavailable
+	}
+	return func(h http.Handler) http.Handler {
+		if spec.Timeout <= 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), spec.Timeout)
+			defer cancel()
+			tw := &timeoutWriter{w: w, h: w.Header().Clone(), ctx: ctx}
+			done := make(chan struct{})
+			panicked := make(chan interface{}, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+						return
+					}
+					close(done)
+				}()
+				h.ServeHTTP(tw, r.WithContext(ctx))
+			}()
+
+			finished := false
+			select {
+			case p := <-panicked:
+				panic(p)
+			case <-done:
+				finished = true
+			case <-ctx.Done():
+			}
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			if !finished {
+				select {
+				case <-done:
+					finished = true
+				default:
+				}
+			}
+			tw.timedOut = true
+			if ctx.Err() == nil || r.Context().Err() != nil || (finished && tw.wroteHeader) {
+				// Finished in time, the client went away, or the handler completed its response regardless
+				return
+			}
+			Logger(r.Context()).Warn("Request timed out", "timeout", spec.Timeout.String(), "responding", tw.wroteHeader)
+			if tw.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			writeJSONError(w, spec.Status, ReasonTimeout, "the request took too long")
+		})
+	}
+}
+
+// timeoutWriter gives the handler its own header map, so it cannot race with the timeout response, and stops
+// writes once the context is done
+type timeoutWriter struct {
+	w   http.ResponseWriter
+	h   http.Header
+	ctx context.Context
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.expired() || tw.wroteHeader {
+		return
+	}
+	tw.writeHeader(status)
+}
+
+// expired is called with tw.mu held. Checking the context as well means a handler that noticed the cancellation
+// cannot write before Timeout does.
+func (tw *timeoutWriter) expired() bool {
+	if tw.ctx.Err() != nil {
+		tw.timedOut = true
+	}
+	return tw.timedOut
+}
+
+// writeHeader is called with tw.mu held
+func (tw *timeoutWriter) writeHeader(status int) {
+	dst := tw.w.Header()
+	for k := range dst {
+		if _, ok := tw.h[k]; !ok {
+			delete(dst, k)
+		}
+	}
+	for k, v := range tw.h {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(status)
+	if status >= 200 {
+		tw.wroteHeader = true
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.expired() {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeader(http.StatusOK)
+	}
+	return tw.w.Write(b)
+}
+
+// Flush passes through to the underlying writer so streaming handlers keep working
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.expired() {
+		return
+	}
+	if !tw.wroteHeader {
+		tw.writeHeader(http.StatusOK)
+	}
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// MaxBody refuses request bodies larger than limit bytes with a 413. Bodies without a Content-Length are cut off
+// by http.MaxBytesReader, so handlers reading past the limit get an *http.MaxBytesError.
+func MaxBody(limit int64) Middleware {
+	return func(h http.Handler) http.Handler {
+		if limit <= 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, ReasonTooLarge, fmt.Sprintf("request bodies are limited to %d bytes", limit))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RouteLimit bounds how long a route may take and how much it may be sent. Zero values mean no limit.
+type RouteLimit struct {
+	Timeout time.Duration
+	// TimeoutStatus defaults to 503, see TimeoutSpec
+	TimeoutStatus int
+	MaxBody       int64
+}
+
+// Middleware applies the limits
+func (l RouteLimit) Middleware() Middleware {
+	return func(h http.Handler) http.Handler {
+		return Chain(h, MaxBody(l.MaxBody), Timeout(TimeoutSpec{Timeout: l.Timeout, Status: l.TimeoutStatus}))
+	}
+}
+
+// HandleWithLimits registers h on router for path with its own limits, restricted to methods if any are given
+func HandleWithLimits(router *mux.Router, path string, limit RouteLimit, h http.Handler, methods ...string) *mux.Route {
+	route := router.Handle(path, limit.Middleware()(h))
+	if len(methods) > 0 {
+		route.Methods(methods...)
+	}
+	return route
+}
+
+// RouteLimits applies limits to routes by their path template, e.g. "/uploads/{name}", falling back to Default.
+// Add it with router.Use so the matched route is known.
+type RouteLimits struct {
+	Default RouteLimit
+	Routes  map[string]RouteLimit
+}
+
+// Middleware returns the router middleware
+func (l RouteLimits) Middleware() mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := l.Default
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					if routeLimit, ok := l.Routes[template]; ok {
+						limit = routeLimit
+					}
+				}
+			}
+			limit.Middleware()(h).ServeHTTP(w, r)
+		})
+	}
+}
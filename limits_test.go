@@ -0,0 +1,150 @@
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTimeout(t *testing.T) {
+	cancelled := make(chan error, 1)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handler", "slow")
+		<-r.Context().Done()
+		_, err := w.Write([]byte("too late"))
+		cancelled <- err
+	})
+	w := httptest.NewRecorder()
+	w.Header().Set(HeaderRequestID, "req-1")
+	Timeout(TimeoutSpec{Timeout: 20 * time.Millisecond})(slow).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("Expected 503. Got: ", w.Code)
+	}
+	e := decodeErrorResponse(t, w)
+	if e.Reason != ReasonTimeout || e.RequestID != "req-1" {
+		t.Error("Unexpected error response: ", e)
+	}
+	if err := <-cancelled; err != http.ErrHandlerTimeout {
+		t.Error("Expected writes after the timeout to fail. Got: ", err)
+	}
+	if w.Header().Get("X-Handler") != "" || strings.Contains(w.Body.String(), "too late") {
+		t.Error("The handler's response should not leak into the timeout response.")
+	}
+
+	w = httptest.NewRecorder()
+	Timeout(TimeoutSpec{Timeout: 20 * time.Millisecond, Status: http.StatusGatewayTimeout})(slow).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	<-cancelled
+	if w.Code != http.StatusGatewayTimeout {
+		t.Error("Expected 504. Got: ", w.Code)
+	}
+}
+
+func TestTimeoutFastHandler(t *testing.T) {
+	h := Timeout(TimeoutSpec{Timeout: time.Second})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("Expected the context to carry the deadline.")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Del("X-Outer-Remove")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("done"))
+	}))
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Outer", "kept")
+	w.Header().Set("X-Outer-Remove", "gone")
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusCreated || w.Body.String() != "done" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Error("Unexpected response: ", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Outer") != "kept" || w.Header().Get("X-Outer-Remove") != "" {
+		t.Error("Expected the handler to see and edit headers set before it: ", w.Header())
+	}
+}
+
+func TestTimeoutAfterResponseStarted(t *testing.T) {
+	h := Timeout(TimeoutSpec{Timeout: 20 * time.Millisecond})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		time.Sleep(100 * time.Millisecond)
+	}))
+	if v := serveRecovered(h, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); v != http.ErrAbortHandler {
+		t.Error("Expected a started response to be aborted. Got: ", v)
+	}
+
+	boom := Timeout(TimeoutSpec{Timeout: time.Second})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	if v := serveRecovered(boom, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); v != "boom" {
+		t.Error("Expected the handler's panic to reach the caller. Got: ", v)
+	}
+}
+
+func TestMaxBody(t *testing.T) {
+	var readErr error
+	h := MaxBody(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = ioutil.ReadAll(r.Body)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("way more than ten bytes")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Expected 413. Got: ", w.Code)
+	}
+	if e := decodeErrorResponse(t, w); e.Reason != ReasonTooLarge {
+		t.Error("Unexpected reason: ", e.Reason)
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader("way more than ten bytes"))
+	req.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	var maxErr *http.MaxBytesError
+	if !errors.As(readErr, &maxErr) {
+		t.Error("Expected reading past the limit to fail. Got: ", readErr)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("small")))
+	if readErr != nil {
+		t.Error("Expected a small body to be read. Got: ", readErr)
+	}
+}
+
+func TestRouteLimits(t *testing.T) {
+	wait := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(100 * time.Millisecond):
+			w.Write([]byte("waited"))
+		}
+	})
+	router := mux.NewRouter()
+	router.Handle("/reports/{id}", wait)
+	router.Handle("/exports", wait)
+	HandleWithLimits(router, "/upload", RouteLimit{MaxBody: 4}, getGenericHandler(), http.MethodPost)
+	router.Use(RouteLimits{
+		Default: RouteLimit{Timeout: time.Second},
+		Routes:  map[string]RouteLimit{"/reports/{id}": {Timeout: 10 * time.Millisecond, TimeoutStatus: http.StatusGatewayTimeout}},
+	}.Middleware())
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	if w := serve("GET", "/reports/7", ""); w.Code != http.StatusGatewayTimeout {
+		t.Error("Expected the report route's own timeout. Got: ", w.Code)
+	}
+	if w := serve("GET", "/exports", ""); w.Code != http.StatusOK || w.Body.String() != "waited" {
+		t.Error("Expected the default timeout to allow the export. Got: ", w.Code)
+	}
+	if w := serve("POST", "/upload", "too big"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Expected the upload route's body limit. Got: ", w.Code)
+	}
+	if w := serve("GET", "/upload", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Error("Expected the route to be limited to POST. Got: ", w.Code)
+	}
+}
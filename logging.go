@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+)
+
+// HeaderRequestID carries the request ID from clients and proxies and back in responses
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLength bounds request IDs accepted from clients
+const maxRequestIDLength = 128
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	loggerKey
+)
+
+// LoggingSpec captures the specification for RequestLogger
+type LoggingSpec struct {
+	// Logger receives one access log line per request and is the base of the request loggers returned by
+	// Logger. Defaults to slog.Default(); see NewJSONLogger and NewLogfmtLogger.
+	Logger *slog.Logger
+	// Router labels each line with the matched route template such as "/files/{id}"
+	Router *mux.Router
+	// IgnoreIncomingRequestID always generates a fresh ID instead of propagating X-Request-ID from the client
+	IgnoreIncomingRequestID bool
+}
+
+// NewJSONLogger returns a logger writing one JSON object per line to w
+func NewJSONLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, nil))
+}
+
+// NewLogfmtLogger returns a logger writing key=value lines to w
+func NewLogfmtLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, nil))
+}
+
+// RequestLogger assigns every request an ID, or propagates the X-Request-ID it came with, puts the ID and a
+// logger carrying it in the request context and writes an access log line once the request is handled
+func RequestLogger(spec LoggingSpec) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			base := spec.Logger
+			if base == nil {
+				base = slog.Default()
+			}
+			id := r.Header.Get(HeaderRequestID)
+			if spec.IgnoreIncomingRequestID || !validRequestID(id) {
+				id = newRequestID()
+			}
+			logger := base.With("request_id", id)
+			ctx := context.WithValue(r.Context(), requestIDKey, id)
+			ctx = context.WithValue(ctx, loggerKey, logger)
+			r = r.WithContext(ctx)
+			w.Header().Set(HeaderRequestID, id)
+
+			start := time.Now()
+			rec := newStatusRecorder(w)
+			h.ServeHTTP(rec, r)
+
+			level := slog.LevelInfo
+			if rec.Status() >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			logger.LogAttrs(ctx, level, "request",
+				slog.String("method", r.Method),
+				slog.String("route", routeTemplate(spec.Router, r)),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", rec.Status()),
+				slog.Int64("bytes", rec.written),
+				slog.Float64("duration_ms", float64(time.Since(start))/float64(time.Millisecond)),
+				slog.String("remote_ip", remoteIP(r)),
+			)
+		})
+	}
+}
+
+// RequestID returns the ID RequestLogger gave the request, or "" outside of it
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Logger returns the request's logger set by RequestLogger, or slog.Default() outside of it
+func Logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func newRequestID() string {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return "unknown"
+	}
+	return u.String()
+}
+
+// validRequestID accepts IDs that are safe to echo in headers and logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '/' || c == '+' || c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// remoteIP is the address of the connection the request came over
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
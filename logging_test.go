@@ -0,0 +1,115 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func decodeLogLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal("Log line is not JSON: ", line)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	router := mux.NewRouter()
+	var seenID string
+	router.HandleFunc("/files/{id}", func(w http.ResponseWriter, r *http.Request) {
+		seenID = RequestID(r.Context())
+		Logger(r.Context()).Info("handling")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+	h := RequestLogger(LoggingSpec{Logger: NewJSONLogger(&buf), Router: router})(router)
+
+	req := httptest.NewRequest("PUT", "/files/42", nil)
+	req.RemoteAddr = "192.0.2.10:5555"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	id := w.Header().Get(HeaderRequestID)
+	if id == "" || id != seenID {
+		t.Fatal("Expected the generated request ID in the response and the context: ", id, seenID)
+	}
+	lines := decodeLogLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatal("Expected a handler line and an access line. Got: ", buf.String())
+	}
+	if lines[0]["msg"] != "handling" || lines[0]["request_id"] != id {
+		t.Error("Handler log line is not tied to the request: ", lines[0])
+	}
+	access := lines[1]
+	expected := map[string]interface{}{
+		"msg":        "request",
+		"request_id": id,
+		"method":     "PUT",
+		"route":      "/files/{id}",
+		"path":       "/files/42",
+		"status":     float64(201),
+		"bytes":      float64(5),
+		"remote_ip":  "192.0.2.10",
+	}
+	for k, v := range expected {
+		if access[k] != v {
+			t.Errorf("Access log %s: expected %v, got %v", k, v, access[k])
+		}
+	}
+	if _, ok := access["duration_ms"].(float64); !ok {
+		t.Error("Access log has no duration: ", access)
+	}
+}
+
+func TestRequestLoggerPropagatesRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	h := RequestLogger(LoggingSpec{Logger: NewLogfmtLogger(&buf)})(getGenericHandler())
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(HeaderRequestID, "upstream-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Header().Get(HeaderRequestID) != "upstream-123" {
+		t.Error("Expected the incoming request ID to be propagated: ", w.Header().Get(HeaderRequestID))
+	}
+	if !strings.Contains(buf.String(), "request_id=upstream-123") || !strings.Contains(buf.String(), "status=200") {
+		t.Error("Unexpected logfmt line: ", buf.String())
+	}
+
+	for _, bad := range []string{"has spaces", "new\nline", strings.Repeat("a", 200)} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(HeaderRequestID, bad)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if id := w.Header().Get(HeaderRequestID); id == bad || id == "" {
+			t.Errorf("Expected %q to be replaced. Got: %q", bad, id)
+		}
+	}
+}
+
+func TestUploadHandlerLogsWithRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	h := RequestLogger(LoggingSpec{Logger: NewJSONLogger(&buf)})(GetUploadHandler(UploadHandlerSpec{Store: NewMemoryUploadStore()}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/upload", strings.NewReader("not multipart")))
+
+	id := w.Header().Get(HeaderRequestID)
+	lines := decodeLogLines(t, &buf)
+	if len(lines) != 2 || lines[0]["msg"] != "Bad request being sent to UploadHandler" || lines[0]["request_id"] != id {
+		t.Error("Expected the upload error to be logged with the request ID: ", buf.String())
+	}
+}
@@ -0,0 +1,347 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DefaultBuckets are the request duration histogram buckets in seconds, as used by the Prometheus clients
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// routeUnmatched labels requests that did not match a route, so arbitrary paths cannot blow up the label space
+const routeUnmatched = "unmatched"
+
+// methodOther labels requests with a non standard method, so arbitrary method tokens cannot blow up the label space
+const methodOther = "other"
+
+// MetricsSpec captures the specification for Metrics
+type MetricsSpec struct {
+	// Namespace prefixes every metric name, e.g. "myservice" gives myservice_http_requests_total
+	Namespace string
+	// Buckets of the request duration histogram in seconds. Defaults to DefaultBuckets.
+	Buckets []float64
+}
+
+type requestKey struct {
+	route, method, code string
+}
+
+type routeKey struct {
+	route, method string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics records request and upload metrics and serves them in the Prometheus text exposition format.
+// All methods are safe on a nil *Metrics, which records nothing.
+type Metrics struct {
+	spec MetricsSpec
+
+	mu             sync.Mutex
+	requests       map[requestKey]uint64
+	durations      map[routeKey]*histogram
+	inFlight       map[string]int64
+	uploadFiles    uint64
+	uploadBytes    uint64
+	uploadFailures map[string]uint64
+}
+
+// NewMetrics returns empty Metrics
+func NewMetrics(spec MetricsSpec) *Metrics {
+	if len(spec.Buckets) == 0 {
+		spec.Buckets = DefaultBuckets
+	}
+	spec.Buckets = append([]float64(nil), spec.Buckets...)
+	sort.Float64s(spec.Buckets)
+	return &Metrics{
+		spec:           spec,
+		requests:       make(map[requestKey]uint64),
+		durations:      make(map[routeKey]*histogram),
+		inFlight:       make(map[string]int64),
+		uploadFailures: make(map[string]uint64),
+	}
+}
+
+// Middleware records the count, duration and in-flight number of requests, labelled by the route template
+// of router such as "/files/{id}". With a nil router it must be added with Router.Use so the current route is known.
+func (m *Metrics) Middleware(router *mux.Router) Middleware {
+	return func(h http.Handler) http.Handler {
+		if m == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route, method := routeTemplate(router, r), methodLabel(r.Method)
+			m.addInFlight(route, 1)
+			defer m.addInFlight(route, -1)
+
+			start := time.Now()
+			rec := newStatusRecorder(w)
+			defer func() {
+				// A panicking handler is counted as a 500 before the panic goes on to Recovery
+				if v := recover(); v != nil {
+					m.observe(route, method, http.StatusInternalServerError, time.Since(start))
+					panic(v)
+				}
+				m.observe(route, method, rec.Status(), time.Since(start))
+			}()
+			h.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// Handler serves the metrics for Prometheus to scrape, typically at /metrics
+func (m *Metrics) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WriteTo(w)
+	}
+}
+
+func routeTemplate(router *mux.Router, r *http.Request) string {
+	var route *mux.Route
+	if router == nil {
+		route = mux.CurrentRoute(r)
+	} else {
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.MatchErr == nil {
+			route = match.Route
+		}
+	}
+	if route == nil {
+		return routeUnmatched
+	}
+	if tpl, err := route.GetPathTemplate(); err == nil {
+		return tpl
+	}
+	if tpl, err := route.GetPathRegexp(); err == nil {
+		return tpl
+	}
+	return routeUnmatched
+}
+
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return methodOther
+}
+
+func (m *Metrics) addInFlight(route string, delta int64) {
+	m.mu.Lock()
+	m.inFlight[route] += delta
+	m.mu.Unlock()
+}
+
+func (m *Metrics) observe(route, method string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{route, method, strconv.Itoa(status)}]++
+	key := routeKey{route, method}
+	hist, ok := m.durations[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(m.spec.Buckets))}
+		m.durations[key] = hist
+	}
+	seconds := d.Seconds()
+	for i, le := range m.spec.Buckets {
+		if seconds <= le {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += seconds
+	hist.count++
+}
+
+// uploadStored records a file stored by an upload handler
+func (m *Metrics) uploadStored(size int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.uploadFiles++
+	m.uploadBytes += uint64(size)
+	m.mu.Unlock()
+}
+
+// uploadFailed records an upload refused for reason
+func (m *Metrics) uploadFailed(reason string) {
+	if m == nil {
+		return
+	}
+	if reason == "" {
+		reason = "internal"
+	}
+	m.mu.Lock()
+	m.uploadFailures[reason]++
+	m.mu.Unlock()
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+
+	m.header(&b, "http_requests_total", "counter", "Number of HTTP requests handled.")
+	requests := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requests = append(requests, k)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, c := requests[i], requests[j]
+		return a.route+"\x00"+a.method+"\x00"+a.code < c.route+"\x00"+c.method+"\x00"+c.code
+	})
+	for _, k := range requests {
+		m.sample(&b, "http_requests_total", labels("code", k.code, "method", k.method, "route", k.route), float64(m.requests[k]))
+	}
+
+	m.header(&b, "http_request_duration_seconds", "histogram", "Time taken to handle HTTP requests.")
+	durations := make([]routeKey, 0, len(m.durations))
+	for k := range m.durations {
+		durations = append(durations, k)
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i].route+"\x00"+durations[i].method < durations[j].route+"\x00"+durations[j].method
+	})
+	for _, k := range durations {
+		hist := m.durations[k]
+		var cumulative uint64
+		for i, le := range m.spec.Buckets {
+			cumulative += hist.counts[i]
+			m.sample(&b, "http_request_duration_seconds_bucket", labels("method", k.method, "route", k.route, "le", formatFloat(le)), float64(cumulative))
+		}
+		m.sample(&b, "http_request_duration_seconds_bucket", labels("method", k.method, "route", k.route, "le", "+Inf"), float64(hist.count))
+		m.sample(&b, "http_request_duration_seconds_sum", labels("method", k.method, "route", k.route), hist.sum)
+		m.sample(&b, "http_request_duration_seconds_count", labels("method", k.method, "route", k.route), float64(hist.count))
+	}
+
+	m.header(&b, "http_requests_in_flight", "gauge", "Number of HTTP requests being handled.")
+	for _, route := range sortedKeys(m.inFlight) {
+		m.sample(&b, "http_requests_in_flight", labels("route", route), float64(m.inFlight[route]))
+	}
+
+	m.header(&b, "upload_files_total", "counter", "Number of uploaded files stored.")
+	m.sample(&b, "upload_files_total", "", float64(m.uploadFiles))
+	m.header(&b, "upload_bytes_total", "counter", "Bytes of uploaded files stored.")
+	m.sample(&b, "upload_bytes_total", "", float64(m.uploadBytes))
+	m.header(&b, "upload_failures_total", "counter", "Number of uploads refused, by reason.")
+	reasons := make([]string, 0, len(m.uploadFailures))
+	for reason := range m.uploadFailures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		m.sample(&b, "upload_failures_total", labels("reason", reason), float64(m.uploadFailures[reason]))
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (m *Metrics) name(name string) string {
+	if m.spec.Namespace == "" {
+		return name
+	}
+	return m.spec.Namespace + "_" + name
+}
+
+func (m *Metrics) header(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name(name), help, m.name(name), kind)
+}
+
+func (m *Metrics) sample(b *strings.Builder, name, labels string, value float64) {
+	fmt.Fprintf(b, "%s%s %s\n", m.name(name), labels, formatFloat(value))
+}
+
+// labels formats name/value pairs as a Prometheus label set
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w}
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+// Status is the status code sent, 200 if the handler wrote nothing
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Flush passes through to the underlying writer so streaming handlers keep working
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
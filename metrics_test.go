@@ -0,0 +1,152 @@
+package service
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	w := httptest.NewRecorder()
+	m.Handler()(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Error("Unexpected Content-Type: ", ct)
+	}
+	return w.Body.String()
+}
+
+func expectLines(t *testing.T, body string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	m := NewMetrics(MetricsSpec{Buckets: []float64{0.05, 1}})
+	router := mux.NewRouter()
+	router.HandleFunc("/files/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if mux.Vars(r)["id"] == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Write([]byte("OK"))
+	})
+	h := m.Middleware(router)(router)
+	for _, path := range []string{"/files/1", "/files/2", "/files/missing", "/files/slow", "/other"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	body := scrape(t, m)
+	expectLines(t, body,
+		"# TYPE http_requests_total counter",
+		`http_requests_total{code="200",method="GET",route="/files/{id}"} 3`,
+		`http_requests_total{code="404",method="GET",route="/files/{id}"} 1`,
+		`http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		"# TYPE http_request_duration_seconds histogram",
+		`http_request_duration_seconds_bucket{method="GET",route="/files/{id}",le="0.05"} 3`,
+		`http_request_duration_seconds_bucket{method="GET",route="/files/{id}",le="1"} 4`,
+		`http_request_duration_seconds_bucket{method="GET",route="/files/{id}",le="+Inf"} 4`,
+		`http_request_duration_seconds_count{method="GET",route="/files/{id}"} 4`,
+		`http_requests_in_flight{route="/files/{id}"} 0`,
+	)
+	if strings.Contains(body, "/files/1") || strings.Contains(body, "/other") {
+		t.Error("Raw paths must not be used as labels:\n", body)
+	}
+}
+
+func TestMetricsInFlightWithRouterUse(t *testing.T) {
+	m := NewMetrics(MetricsSpec{Namespace: "svc"})
+	router := mux.NewRouter()
+	router.Use(mux.MiddlewareFunc(m.Middleware(nil)))
+	var during string
+	router.HandleFunc("/scrape", func(w http.ResponseWriter, r *http.Request) {
+		during = scrape(t, m)
+	})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/scrape", nil))
+
+	expectLines(t, during, `svc_http_requests_in_flight{route="/scrape"} 1`)
+	expectLines(t, scrape(t, m),
+		`svc_http_requests_in_flight{route="/scrape"} 0`,
+		`svc_http_requests_total{code="200",method="POST",route="/scrape"} 1`,
+	)
+}
+
+func TestMetricsUnknownMethods(t *testing.T) {
+	m := NewMetrics(MetricsSpec{})
+	router := mux.NewRouter()
+	router.HandleFunc("/files", func(w http.ResponseWriter, r *http.Request) {})
+	h := m.Middleware(router)(router)
+	for _, method := range []string{"GET", "FOO", "BAR", "get"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/files", nil))
+	}
+
+	body := scrape(t, m)
+	expectLines(t, body,
+		`http_requests_total{code="200",method="GET",route="/files"} 1`,
+		`http_requests_total{code="200",method="other",route="/files"} 3`,
+		`http_request_duration_seconds_count{method="other",route="/files"} 3`,
+		`http_requests_in_flight{route="/files"} 0`,
+	)
+	if strings.Contains(body, "FOO") || strings.Contains(body, "BAR") || strings.Contains(body, `"get"`) {
+		t.Error("Unknown methods must not be used as labels:\n", body)
+	}
+}
+
+func TestMetricsPanics(t *testing.T) {
+	m := NewMetrics(MetricsSpec{})
+	router := mux.NewRouter()
+	router.HandleFunc("/boom", func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	h := Chain(router, Recovery(RecoverySpec{}), m.Middleware(router))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/boom", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Error("Expected Recovery to still answer the panic. Got: ", w.Code)
+	}
+	expectLines(t, scrape(t, m),
+		`http_requests_total{code="500",method="GET",route="/boom"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/boom"} 1`,
+		`http_requests_in_flight{route="/boom"} 0`,
+	)
+}
+
+func TestUploadMetrics(t *testing.T) {
+	m := NewMetrics(MetricsSpec{})
+	handler := GetUploadHandler(UploadHandlerSpec{
+		Store:             NewMemoryUploadStore(),
+		AllowedExtensions: []string{".txt"},
+		MaxBytes:          1024,
+		Metrics:           m,
+	})
+	handler(httptest.NewRecorder(), multipartUpload(t, "a.txt", "text/plain", []byte("12345")))
+	handler(httptest.NewRecorder(), multipartUpload(t, "b.txt", "text/plain", []byte("123")))
+	handler(httptest.NewRecorder(), multipartUpload(t, "c.exe", "text/plain", []byte("123")))
+	handler(httptest.NewRecorder(), multipartUpload(t, "d.txt", "text/plain", bytes.Repeat([]byte("x"), 2048)))
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("not multipart")))
+
+	expectLines(t, scrape(t, m),
+		"upload_files_total 2",
+		"upload_bytes_total 8",
+		`upload_failures_total{reason="bad_request"} 1`,
+		`upload_failures_total{reason="extension_not_allowed"} 1`,
+		`upload_failures_total{reason="too_large"} 1`,
+	)
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	if l := labels("route", "a\"b\\c\nd"); l != `{route="a\"b\\c\nd"}` {
+		t.Error("Label values were not escaped: ", l)
+	}
+	var m *Metrics
+	m.uploadStored(1)
+	m.Middleware(nil)(getGenericHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
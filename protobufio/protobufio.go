@@ -2,6 +2,7 @@ package protobufio
 
 import (
 	"archive/zip"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -11,6 +12,8 @@ import (
 
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/timestamp"
+
+	"github.com/arunsworld/go-service/tracing"
 )
 
 // MustConvertTimestamp converts given time otherwise panics
@@ -31,6 +34,8 @@ func ConvertTimestamp(t time.Time) (*timestamp.Timestamp, error) {
 type ZipWriter struct {
 	zipWriter *zip.Writer
 	w         io.Writer
+	span      *tracing.Span
+	messages  int
 }
 
 // Write writes proto.Message to writer
@@ -48,28 +53,44 @@ func (z *ZipWriter) Write(msg proto.Message) error {
 	if err != nil {
 		return fmt.Errorf("failed to write proto message to zip file: %v", err)
 	}
+	z.messages++
 	return nil
 }
 
 // Close closes out the writer stream
 func (z *ZipWriter) Close() error {
-	return z.zipWriter.Close()
+	err := z.zipWriter.Close()
+	z.span.SetAttribute("protobuf.messages", z.messages)
+	z.span.RecordError(err)
+	z.span.End()
+	return err
 }
 
 // NewZipWriter creates a new ZipWriter
 func NewZipWriter(w io.Writer) (*ZipWriter, error) {
+	return NewZipWriterContext(context.Background(), w)
+}
+
+// NewZipWriterContext creates a new ZipWriter, recording a span in the trace carried by ctx that ends when the
+// writer is closed
+func NewZipWriterContext(ctx context.Context, w io.Writer) (*ZipWriter, error) {
+	_, span := tracing.Start(ctx, "protobufio.NewZipWriter")
 	zipWriter := zip.NewWriter(w)
 	f, err := zipWriter.Create("protobuf.db")
 	if err != nil {
+		span.RecordError(err)
+		span.End()
 		return nil, err
 	}
-	return &ZipWriter{zipWriter: zipWriter, w: f}, nil
+	return &ZipWriter{zipWriter: zipWriter, w: f, span: span}, nil
 }
 
 // ZipReader holds state for reading from zip
 type ZipReader struct {
 	zipReader *zip.ReadCloser
 	r         io.ReadCloser
+	span      *tracing.Span
+	messages  int
 }
 
 func (z *ZipReader) Read(msg proto.Message) error {
@@ -99,11 +120,14 @@ func (z *ZipReader) Read(msg proto.Message) error {
 	if err != nil {
 		return err
 	}
+	z.messages++
 	return nil
 }
 
 // Close closes the open handlers for the ZipReader
 func (z *ZipReader) Close() error {
+	z.span.SetAttribute("protobuf.messages", z.messages)
+	z.span.End()
 	err1 := z.r.Close()
 	err2 := z.zipReader.Close()
 	if err1 != nil {
@@ -117,16 +141,28 @@ func (z *ZipReader) Close() error {
 
 // NewZipReader creates a new ZipReader
 func NewZipReader(filename string) (*ZipReader, error) {
+	return NewZipReaderContext(context.Background(), filename)
+}
+
+// NewZipReaderContext creates a new ZipReader, recording a span in the trace carried by ctx that ends when the
+// reader is closed
+func NewZipReaderContext(ctx context.Context, filename string) (*ZipReader, error) {
+	_, span := tracing.Start(ctx, "protobufio.NewZipReader")
+	span.SetAttribute("file.path", filename)
 	zipReader, err := zip.OpenReader(filename)
 	if err != nil {
+		span.RecordError(err)
+		span.End()
 		return nil, err
 	}
 
 	f, err := zipReader.File[0].Open()
 	if err != nil {
 		zipReader.Close()
+		span.RecordError(err)
+		span.End()
 		return nil, err
 	}
 
-	return &ZipReader{zipReader: zipReader, r: f}, nil
+	return &ZipReader{zipReader: zipReader, r: f, span: span}, nil
 }
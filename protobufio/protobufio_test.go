@@ -2,15 +2,18 @@ package protobufio
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/arunsworld/go-service/protobufio/testapi"
+	"github.com/arunsworld/go-service/tracing"
 )
 
 func TestWriteProtobufsToZipFile(t *testing.T) {
@@ -110,3 +113,40 @@ func TestReadProtobufsToZipFile(t *testing.T) {
 		t.Fatal("Expecting to get 99999 messages but got:", counter)
 	}
 }
+
+func TestZipContextSpans(t *testing.T) {
+	exporter := tracing.NewMemoryExporter()
+	ctx, parent := tracing.NewTracer(tracing.TracerSpec{Exporter: exporter}).Start(context.Background(), "job", tracing.SpanKindInternal)
+	filename := filepath.Join(t.TempDir(), "spans.zip")
+
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw, err := NewZipWriterContext(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(&testapi.Test{ID: 1, Message: "hello"})
+	zw.Write(&testapi.Test{ID: 2, Message: "bye"})
+	zw.Close()
+	f.Close()
+
+	zr, err := NewZipReaderContext(ctx, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for zr.Read(&testapi.Test{}) == nil {
+	}
+	zr.Close()
+
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatal("Expected a span per zip. Got: ", len(spans))
+	}
+	for i, name := range []string{"protobufio.NewZipWriter", "protobufio.NewZipReader"} {
+		if spans[i].Name != name || spans[i].ParentSpanID != parent.SpanContext().SpanID.String() || spans[i].Attributes["protobuf.messages"] != 2 {
+			t.Errorf("Unexpected span: %+v", spans[i])
+		}
+	}
+}
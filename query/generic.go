@@ -1,6 +1,11 @@
 package query
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+
+	"github.com/arunsworld/go-service/tracing"
+)
 
 // ColumnHandler is a function that handles a callback for the columns (Names & Types)
 type ColumnHandler func([]*sql.ColumnType)
@@ -16,7 +21,22 @@ type GenericQueryHandlers struct {
 
 // GenericQuery performs the given query on the given DB; and calls the callbacks
 func GenericQuery(db *sql.DB, query string, handlers GenericQueryHandlers) error {
-	rows, err := db.Query(query)
+	return GenericQueryContext(context.Background(), db, query, handlers)
+}
+
+// GenericQueryContext performs the given query on the given DB within ctx; and calls the callbacks. The query
+// is recorded as a span in the trace carried by ctx.
+func GenericQueryContext(ctx context.Context, db *sql.DB, query string, handlers GenericQueryHandlers) (err error) {
+	ctx, span := tracing.Start(ctx, "query")
+	span.SetAttribute("db.statement", query)
+	rowCount := 0
+	defer func() {
+		span.SetAttribute("db.rows", rowCount)
+		span.RecordError(err)
+		span.End()
+	}()
+
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return err
 	}
@@ -48,6 +68,7 @@ func GenericQuery(db *sql.DB, query string, handlers GenericQueryHandlers) error
 			row[i] = string(*(v.(*sql.RawBytes)))
 		}
 		handlers.RowHandler(row)
+		rowCount++
 	}
-	return nil
+	return rows.Err()
 }
@@ -0,0 +1,272 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReasonRateLimited is reported in the ErrorResponse when a client has used up its requests
+const ReasonRateLimited = "rate_limited"
+
+// RateLimit is a token bucket holding Burst requests that refills at Requests per Period
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+	// Burst is how many requests may be made at once. Defaults to Requests.
+	Burst int
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Requests)
+}
+
+// perSecond is the refill rate of the bucket
+func (l RateLimit) perSecond() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// RateLimitResult is the state of a bucket after taking a request from it
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is how long until the next request is allowed, when this one was not
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// RateLimitStore keeps a token bucket per key. Take must be atomic for a key across every server sharing the store.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// takeToken refills a bucket holding tokens as of updated and takes a token from it if one is available
+func takeToken(tokens float64, updated time.Time, limit RateLimit, now time.Time) (float64, RateLimitResult) {
+	burst, rate := limit.burst(), limit.perSecond()
+	if elapsed := now.Sub(updated).Seconds(); elapsed > 0 {
+		tokens = math.Min(burst, tokens+elapsed*rate)
+	}
+	result := RateLimitResult{Limit: int(burst)}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	result.Remaining = int(tokens)
+	result.Reset = time.Duration((burst - tokens) / rate * float64(time.Second))
+	return tokens, result
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will have refilled, by the limit it was last taken from
+	full time.Time
+}
+
+// MemoryRateLimitStore keeps buckets in memory, so limits apply per process
+type MemoryRateLimitStore struct {
+	mu       sync.Mutex
+	buckets  map[string]bucket
+	lastTrim time.Time
+}
+
+// NewMemoryRateLimitStore returns an empty in-memory store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]bucket)}
+}
+
+// Take takes a request from the bucket for key
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = bucket{tokens: limit.burst(), updated: now}
+	}
+	tokens, result := takeToken(b.tokens, b.updated, limit, now)
+	s.buckets[key] = bucket{tokens: tokens, updated: now, full: now.Add(result.Reset)}
+	s.trim(limit, now)
+	return result, nil
+}
+
+// trim forgets buckets that have refilled completely, at most once per period. Each bucket is judged by its own
+// limit, as limiters with different limits may share the store.
+func (s *MemoryRateLimitStore) trim(limit RateLimit, now time.Time) {
+	if now.Sub(s.lastTrim) < limit.Period {
+		return
+	}
+	s.lastTrim = now
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// KeyFunc picks the bucket for a request. Requests it returns "" for are not limited.
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP keys requests on the client IP. X-Forwarded-For is only believed when the request comes from one of
+// trustedProxies, given as IPs or CIDRs, and then the right-most address that is not a trusted proxy is used.
+func KeyByIP(trustedProxies []string) KeyFunc {
+	trusted := parseCIDRs(trustedProxies)
+	return func(r *http.Request) string {
+		return "ip:" + clientIP(r, trusted)
+	}
+}
+
+// KeyByHeader keys requests on a header such as an API key. The value is hashed so secrets do not end up in the store.
+func KeyByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		value := r.Header.Get(name)
+		if value == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(value))
+		return "header:" + hex.EncodeToString(sum[:16])
+	}
+}
+
+// FirstKey uses the first key that is not empty, e.g. FirstKey(KeyByHeader("X-API-Key"), KeyByIP(nil))
+func FirstKey(keys ...KeyFunc) KeyFunc {
+	return func(r *http.Request) string {
+		for _, key := range keys {
+			if k := key(r); k != "" {
+				return k
+			}
+		}
+		return ""
+	}
+}
+
+// RateLimitSpec captures the specification for RateLimiter
+type RateLimitSpec struct {
+	Limit RateLimit
+	// Key defaults to KeyByIP(nil)
+	Key KeyFunc
+	// Store defaults to a new MemoryRateLimitStore
+	Store RateLimitStore
+	// Prefix separates the buckets of different limiters sharing a store
+	Prefix string
+	// FailOpen serves requests when the store fails instead of answering 503
+	FailOpen bool
+}
+
+// RateLimiter refuses requests beyond the spec's limit with a 429 and Retry-After. Every limited response carries
+// the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers. It panics if the limit's Requests or
+// Period is not positive.
+func RateLimiter(spec RateLimitSpec) Middleware {
+	if spec.Limit.Requests <= 0 || spec.Limit.Period <= 0 {
+		panic("service: RateLimit needs a positive Requests and Period")
+	}
+	if spec.Key == nil {
+		spec.Key = KeyByIP(nil)
+	}
+	if spec.Store == nil {
+		spec.Store = NewMemoryRateLimitStore()
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := spec.Key(r)
+			if key == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			result, err := spec.Store.Take(r.Context(), spec.Prefix+key, spec.Limit, time.Now())
+			if err != nil {
+				Logger(r.Context()).Error("Rate limit store failed", "error", err)
+				if spec.FailOpen {
+					h.ServeHTTP(w, r)
+					return
+				}
+				writeJSONError(w, http.StatusServiceUnavailable, ReasonRateLimited, "the rate limiter is unavailable")
+				return
+			}
+			header := w.Header()
+			header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+			if !result.Allowed {
+				header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				writeJSONError(w, http.StatusTooManyRequests, ReasonRateLimited, "too many requests, retry later")
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// parseCIDRs accepts plain IPs as well as CIDRs. Entries that are neither are ignored.
+func parseCIDRs(values []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			}
+			continue
+		}
+		if _, n, err := net.ParseCIDR(v); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+func ipTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP walks X-Forwarded-For from the right while the hops are trusted proxies
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip := remoteIP(r)
+	if !ipTrusted(ip, trusted) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			return ip
+		}
+		ip = hop
+		if !ipTrusted(hop, trusted) {
+			return hop
+		}
+	}
+	return ip
+}
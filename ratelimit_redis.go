@@ -0,0 +1,292 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ErrRedisConflict is returned when a bucket kept changing under concurrent requests until retries ran out
+var ErrRedisConflict = errors.New("redis: bucket changed concurrently too often")
+
+// redisMaxAttempts bounds the optimistic WATCH/MULTI/EXEC retries of a single Take
+const redisMaxAttempts = 10
+
+// RedisRateLimitSpec captures the specification for a RedisRateLimitStore
+type RedisRateLimitSpec struct {
+	// Network and Address of the server. Default to "tcp" and "localhost:6379".
+	Network  string
+	Address  string
+	Password string
+	DB       int
+	// KeyPrefix is put before every bucket key. Defaults to "ratelimit:".
+	KeyPrefix string
+	// Timeout bounds each Take. Defaults to one second.
+	Timeout time.Duration
+	// MaxIdle connections kept open. Defaults to 4.
+	MaxIdle int
+}
+
+// RedisRateLimitStore keeps buckets in Redis, or anything speaking its protocol, so limits are shared between
+// servers. Buckets are updated with WATCH/MULTI/EXEC and expire once they would be full again.
+type RedisRateLimitStore struct {
+	spec RedisRateLimitSpec
+	idle chan *redisConn
+}
+
+// NewRedisRateLimitStore returns a store for the spec. Connections are made when first needed.
+func NewRedisRateLimitStore(spec RedisRateLimitSpec) *RedisRateLimitStore {
+	if spec.Network == "" {
+		spec.Network = "tcp"
+	}
+	if spec.Address == "" {
+		spec.Address = "localhost:6379"
+	}
+	if spec.KeyPrefix == "" {
+		spec.KeyPrefix = "ratelimit:"
+	}
+	if spec.Timeout == 0 {
+		spec.Timeout = time.Second
+	}
+	if spec.MaxIdle == 0 {
+		spec.MaxIdle = 4
+	}
+	return &RedisRateLimitStore{spec: spec, idle: make(chan *redisConn, spec.MaxIdle)}
+}
+
+// Take takes a request from the bucket for key
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.spec.Timeout)
+	defer cancel()
+	conn, reused, err := s.get(ctx)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	result, err := s.take(conn, s.spec.KeyPrefix+key, limit, now)
+	s.put(conn, err)
+	if reused && stale(err) {
+		// The server may have closed the idle connection in the meantime, so try once more on a new one
+		if conn, err = s.dial(ctx); err != nil {
+			return RateLimitResult{}, err
+		}
+		result, err = s.take(conn, s.spec.KeyPrefix+key, limit, now)
+		s.put(conn, err)
+	}
+	return result, err
+}
+
+// stale says whether err is the connection failing, rather than the server answering with an error or the
+// Take running out of time
+func stale(err error) bool {
+	var netErr net.Error
+	switch {
+	case err == nil, err == ErrRedisConflict:
+		return false
+	case errors.As(err, new(redisError)):
+		return false
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return false
+	}
+	return true
+}
+
+func (s *RedisRateLimitStore) take(conn *redisConn, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	for attempt := 0; attempt < redisMaxAttempts; attempt++ {
+		if _, err := conn.do("WATCH", key); err != nil {
+			return RateLimitResult{}, err
+		}
+		reply, err := conn.do("HMGET", key, "tokens", "updated")
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		tokens, updated := limit.burst(), now
+		if fields, ok := reply.([]interface{}); ok && len(fields) == 2 && fields[0] != nil && fields[1] != nil {
+			tokensField, tok := fields[0].(string)
+			updatedField, uok := fields[1].(string)
+			t, terr := strconv.ParseFloat(tokensField, 64)
+			ms, uerr := strconv.ParseInt(updatedField, 10, 64)
+			if tok && uok && terr == nil && uerr == nil {
+				tokens, updated = t, time.Unix(0, ms*int64(time.Millisecond))
+			}
+		}
+		tokens, result := takeToken(tokens, updated, limit, now)
+		ttl := result.Reset + time.Second
+
+		if _, err := conn.do("MULTI"); err != nil {
+			return RateLimitResult{}, err
+		}
+		if _, err := conn.do("HSET", key, "tokens", strconv.FormatFloat(tokens, 'f', -1, 64),
+			"updated", strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)); err != nil {
+			conn.do("DISCARD")
+			return RateLimitResult{}, err
+		}
+		if _, err := conn.do("PEXPIRE", key, strconv.FormatInt(int64(ttl/time.Millisecond), 10)); err != nil {
+			conn.do("DISCARD")
+			return RateLimitResult{}, err
+		}
+		reply, err = conn.do("EXEC")
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		// EXEC answers nil when the watched bucket changed, so read it again
+		if reply == nil {
+			continue
+		}
+		replies, ok := reply.([]interface{})
+		if !ok {
+			return RateLimitResult{}, fmt.Errorf("redis: unexpected EXEC reply %v", reply)
+		}
+		for _, r := range replies {
+			if err, ok := r.(redisError); ok {
+				return RateLimitResult{}, err
+			}
+		}
+		return result, nil
+	}
+	return RateLimitResult{}, ErrRedisConflict
+}
+
+// get takes an idle connection, or dials a new one. reused says the connection came from the idle ones.
+func (s *RedisRateLimitStore) get(ctx context.Context) (conn *redisConn, reused bool, err error) {
+	select {
+	case conn = <-s.idle:
+		deadline, _ := ctx.Deadline()
+		conn.conn.SetDeadline(deadline)
+		return conn, true, nil
+	default:
+		conn, err = s.dial(ctx)
+		return conn, false, err
+	}
+}
+
+func (s *RedisRateLimitStore) dial(ctx context.Context) (*redisConn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, s.spec.Network, s.spec.Address)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: c, r: bufio.NewReader(c)}
+	if err := conn.setup(ctx, s.spec); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// put keeps healthy connections for reuse. A connection that failed may be mid-reply or left inside a WATCH or
+// MULTI, so it is closed. Running out of attempts leaves it clean, as EXEC ends the transaction.
+func (s *RedisRateLimitStore) put(conn *redisConn, err error) {
+	if err != nil && err != ErrRedisConflict {
+		conn.conn.Close()
+		return
+	}
+	select {
+	case s.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// Close closes the idle connections
+func (s *RedisRateLimitStore) Close() error {
+	for {
+		select {
+		case conn := <-s.idle:
+			conn.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisConn speaks RESP, the Redis serialization protocol
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *redisConn) setup(ctx context.Context, spec RedisRateLimitSpec) error {
+	deadline, _ := ctx.Deadline()
+	c.conn.SetDeadline(deadline)
+	if spec.Password != "" {
+		if _, err := c.do("AUTH", spec.Password); err != nil {
+			return err
+		}
+	}
+	if spec.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(spec.DB)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// do sends a command and reads its reply: a string, an int64, nil or a []interface{} of those, in which the
+// error replies of the commands in an EXEC are kept as redisErrors
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			// Errors inside an EXEC reply belong to a single queued command
+			item, err := c.read()
+			if replyErr, ok := err.(redisError); ok {
+				item = replyErr
+			} else if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply %q", line)
+}
@@ -0,0 +1,365 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRedis understands the few hash and transaction commands the rate limit store uses. Every write bumps the
+// key's version so WATCH can detect conflicting transactions, as real Redis does.
+type fakeRedis struct {
+	l        net.Listener
+	password string
+
+	mu       sync.Mutex
+	hashes   map[string]map[string]string
+	versions map[string]int
+	ttls     map[string]string
+	execs    int
+	aborts   int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{l: l, password: password, hashes: map[string]map[string]string{}, versions: map[string]int{}, ttls: map[string]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func bulk(s string) string { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	watched := map[string]int{}
+	var queued [][]string
+	inMulti := false
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		if inMulti && cmd != "EXEC" && cmd != "DISCARD" {
+			queued = append(queued, args)
+			io.WriteString(conn, "+QUEUED\r\n")
+			continue
+		}
+		f.mu.Lock()
+		switch cmd {
+		case "AUTH":
+			if args[1] != f.password {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+				break
+			}
+			authed = true
+			io.WriteString(conn, "+OK\r\n")
+		case "WATCH":
+			watched[args[1]] = f.versions[args[1]]
+			io.WriteString(conn, "+OK\r\n")
+		case "HMGET":
+			reply := "*" + strconv.Itoa(len(args)-2) + "\r\n"
+			for _, field := range args[2:] {
+				if v, ok := f.hashes[args[1]][field]; ok {
+					reply += bulk(v)
+				} else {
+					reply += "$-1\r\n"
+				}
+			}
+			io.WriteString(conn, reply)
+		case "MULTI":
+			inMulti = true
+			io.WriteString(conn, "+OK\r\n")
+		case "DISCARD":
+			inMulti, queued, watched = false, nil, map[string]int{}
+			io.WriteString(conn, "+OK\r\n")
+		case "EXEC":
+			conflict := false
+			for key, version := range watched {
+				if f.versions[key] != version {
+					conflict = true
+				}
+			}
+			if conflict {
+				f.aborts++
+				io.WriteString(conn, "*-1\r\n")
+			} else {
+				f.execs++
+				reply := "*" + strconv.Itoa(len(queued)) + "\r\n"
+				for _, q := range queued {
+					reply += f.apply(q)
+				}
+				io.WriteString(conn, reply)
+			}
+			inMulti, queued, watched = false, nil, map[string]int{}
+		default:
+			io.WriteString(conn, "-ERR unknown command '"+args[0]+"'\r\n")
+		}
+		f.mu.Unlock()
+	}
+}
+
+// apply runs a queued write, called with f.mu held
+func (f *fakeRedis) apply(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "HSET":
+		if f.hashes[args[1]] == nil {
+			f.hashes[args[1]] = map[string]string{}
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			f.hashes[args[1]][args[i]] = args[i+1]
+		}
+		f.versions[args[1]]++
+		return ":" + strconv.Itoa((len(args)-2)/2) + "\r\n"
+	case "PEXPIRE":
+		f.ttls[args[1]] = args[2]
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+	fake := newFakeRedis(t, "secret")
+	defer fake.l.Close()
+	store := NewRedisRateLimitStore(RedisRateLimitSpec{Address: fake.l.Addr().String(), Password: "secret"})
+	defer store.Close()
+	limit := RateLimit{Requests: 1, Period: time.Second, Burst: 3}
+	now := time.Unix(1600000000, 0)
+
+	for i := 0; i < 3; i++ {
+		result, err := store.Take(context.Background(), "k", limit, now)
+		if err != nil || !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("Request %d should be allowed: %+v %v", i, result, err)
+		}
+	}
+	result, err := store.Take(context.Background(), "k", limit, now)
+	if err != nil || result.Allowed || result.RetryAfter != time.Second {
+		t.Errorf("Expected the bucket to be empty: %+v %v", result, err)
+	}
+	result, err = store.Take(context.Background(), "k", limit, now.Add(time.Second))
+	if err != nil || !result.Allowed {
+		t.Errorf("Expected a token to have refilled: %+v %v", result, err)
+	}
+	fake.mu.Lock()
+	tokens, ttl := fake.hashes["ratelimit:k"]["tokens"], fake.ttls["ratelimit:k"]
+	fake.mu.Unlock()
+	if tokens != "0" || ttl != "4000" {
+		t.Error("Unexpected bucket in redis: ", tokens, ttl)
+	}
+}
+
+func TestRedisRateLimitStoreConcurrent(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	defer fake.l.Close()
+	store := NewRedisRateLimitStore(RedisRateLimitSpec{Address: fake.l.Addr().String(), Timeout: 5 * time.Second})
+	defer store.Close()
+	limit := RateLimit{Requests: 1, Period: time.Hour, Burst: 20}
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := store.Take(context.Background(), "shared", limit, now)
+			if err != nil && err != ErrRedisConflict {
+				t.Error(err)
+			}
+			if result.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed > 20 {
+		t.Error("Concurrent requests overdrew the bucket: ", allowed)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.execs == 0 {
+		t.Error("Expected transactions to commit.")
+	}
+}
+
+func TestRedisRateLimitStoreErrors(t *testing.T) {
+	fake := newFakeRedis(t, "secret")
+	defer fake.l.Close()
+	store := NewRedisRateLimitStore(RedisRateLimitSpec{Address: fake.l.Addr().String(), Password: "wrong"})
+	if _, err := store.Take(context.Background(), "k", RateLimit{Requests: 1, Period: time.Second}, time.Now()); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Error("Expected the authentication error. Got: ", err)
+	}
+	fake.l.Close()
+	store = NewRedisRateLimitStore(RedisRateLimitSpec{Address: fake.l.Addr().String()})
+	if _, err := store.Take(context.Background(), "k", RateLimit{Requests: 1, Period: time.Second}, time.Now()); err == nil {
+		t.Error("Expected an error when redis is unreachable.")
+	}
+}
+
+// scriptedRedis answers each command with the reply its handler gives, recording the commands it saw
+func scriptedRedis(t *testing.T, reply func(args []string) string) (net.Listener, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					io.WriteString(conn, reply(args))
+				}
+			}()
+		}
+	}()
+	return l, &conns
+}
+
+func TestRedisRateLimitStoreBadReplies(t *testing.T) {
+	limit := RateLimit{Requests: 1, Period: time.Second}
+	l, _ := scriptedRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "HMGET":
+			return "*2\r\n:1\r\n:2\r\n"
+		case "HSET", "PEXPIRE":
+			return "+QUEUED\r\n"
+		case "EXEC":
+			return "*2\r\n:2\r\n:1\r\n"
+		}
+		return "+OK\r\n"
+	})
+	defer l.Close()
+	store := NewRedisRateLimitStore(RedisRateLimitSpec{Address: l.Addr().String()})
+	defer store.Close()
+	if result, err := store.Take(context.Background(), "k", limit, time.Now()); err != nil || !result.Allowed {
+		t.Error("Expected a bucket of the wrong types to be treated as full. Got: ", result, err)
+	}
+
+	l, conns := scriptedRedis(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "HMGET" {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		}
+		return "+OK\r\n"
+	})
+	defer l.Close()
+	store = NewRedisRateLimitStore(RedisRateLimitSpec{Address: l.Addr().String()})
+	defer store.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := store.Take(context.Background(), "k", limit, time.Now()); err == nil || !strings.Contains(err.Error(), "WRONGTYPE") {
+			t.Error("Expected the error reply. Got: ", err)
+		}
+	}
+	if n := atomic.LoadInt32(conns); n != 2 {
+		t.Error("Expected a connection left inside a WATCH not to be reused. Connections: ", n)
+	}
+}
+
+func TestRedisRateLimitStoreExecErrors(t *testing.T) {
+	l, conns := scriptedRedis(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "HMGET":
+			return "*2\r\n$-1\r\n$-1\r\n"
+		case "HSET", "PEXPIRE":
+			return "+QUEUED\r\n"
+		case "EXEC":
+			return "*2\r\n-OOM command not allowed when used memory > 'maxmemory'\r\n:1\r\n"
+		}
+		return "+OK\r\n"
+	})
+	defer l.Close()
+	store := NewRedisRateLimitStore(RedisRateLimitSpec{Address: l.Addr().String()})
+	defer store.Close()
+	limit := RateLimit{Requests: 1, Period: time.Second}
+	for i := 0; i < 2; i++ {
+		if result, err := store.Take(context.Background(), "k", limit, time.Now()); err == nil || result.Allowed || !strings.Contains(err.Error(), "OOM") {
+			t.Error("Expected a failed write in the transaction to fail the Take. Got: ", result, err)
+		}
+	}
+	if n := atomic.LoadInt32(conns); n != 2 {
+		t.Error("Expected the connection not to be reused after the error. Connections: ", n)
+	}
+}
+
+func TestRedisRateLimitStoreStaleConnection(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	defer fake.l.Close()
+	store := NewRedisRateLimitStore(RedisRateLimitSpec{Address: fake.l.Addr().String()})
+	defer store.Close()
+	limit := RateLimit{Requests: 1, Period: time.Second, Burst: 2}
+	now := time.Now()
+	if _, err := store.Take(context.Background(), "k", limit, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server has since closed the idle connection
+	conn := <-store.idle
+	conn.conn.Close()
+	client, server := net.Pipe()
+	server.Close()
+	conn.conn, conn.r = client, bufio.NewReader(client)
+	store.idle <- conn
+
+	if result, err := store.Take(context.Background(), "k", limit, now); err != nil || !result.Allowed || result.Remaining != 0 {
+		t.Error("Expected the Take to be retried on a new connection. Got: ", result, err)
+	}
+}
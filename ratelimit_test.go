@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTakeToken(t *testing.T) {
+	limit := RateLimit{Requests: 2, Period: time.Second, Burst: 4}
+	store := NewMemoryRateLimitStore()
+	now := time.Unix(1600000000, 0)
+
+	for i := 0; i < 4; i++ {
+		result, _ := store.Take(context.Background(), "k", limit, now)
+		if !result.Allowed || result.Remaining != 3-i || result.Limit != 4 {
+			t.Fatalf("Request %d should be allowed from the burst: %+v", i, result)
+		}
+	}
+	result, _ := store.Take(context.Background(), "k", limit, now)
+	if result.Allowed || result.RetryAfter != 500*time.Millisecond || result.Reset != 2*time.Second {
+		t.Errorf("Expected the fifth request to wait half a second: %+v", result)
+	}
+	if result, _ := store.Take(context.Background(), "other", limit, now); !result.Allowed {
+		t.Error("Buckets should be separate per key.")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if result, _ := store.Take(context.Background(), "k", limit, now); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected one token to have refilled: %+v", result)
+	}
+	now = now.Add(time.Hour)
+	if result, _ := store.Take(context.Background(), "k", limit, now); !result.Allowed || result.Remaining != 3 {
+		t.Errorf("Expected the bucket to refill no further than the burst: %+v", result)
+	}
+	if len(store.buckets) != 1 {
+		t.Error("Expected full buckets to be forgotten. Got: ", len(store.buckets))
+	}
+}
+
+func TestMemoryRateLimitStoreSharedLimits(t *testing.T) {
+	strict := RateLimit{Requests: 1, Period: time.Hour}
+	lenient := RateLimit{Requests: 100, Period: time.Second}
+	store := NewMemoryRateLimitStore()
+	now := time.Unix(1600000000, 0)
+
+	store.Take(context.Background(), "strict", strict, now)
+	now = now.Add(2 * time.Second)
+	store.Take(context.Background(), "lenient", lenient, now)
+	if result, _ := store.Take(context.Background(), "strict", strict, now); result.Allowed {
+		t.Error("Expected the strict bucket to survive a trim by the lenient limit: ", result)
+	}
+}
+
+func TestRateLimiterInvalidLimit(t *testing.T) {
+	for _, limit := range []RateLimit{{}, {Requests: 1}, {Period: time.Second}, {Requests: -1, Period: time.Second}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected %+v to be refused.", limit)
+				}
+			}()
+			RateLimiter(RateLimitSpec{Limit: limit})
+		}()
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	h := RateLimiter(RateLimitSpec{Limit: RateLimit{Requests: 2, Period: time.Minute}})(getGenericHandler())
+	get := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := get("192.0.2.1"); w.Code != http.StatusOK {
+			t.Fatal("Expected request to be allowed. Got: ", w.Code)
+		}
+	}
+	w := get("192.0.2.1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatal("Expected 429. Got: ", w.Code)
+	}
+	if e := decodeErrorResponse(t, w); e.Reason != ReasonRateLimited {
+		t.Error("Unexpected reason: ", e.Reason)
+	}
+	headers := map[string]string{"Retry-After": "30", "RateLimit-Limit": "2", "RateLimit-Remaining": "0", "RateLimit-Reset": "60"}
+	for k, v := range headers {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("%s: expected %s, got %s", k, v, got)
+		}
+	}
+	if w := get("192.0.2.2"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "1" {
+		t.Error("Expected another IP to have its own bucket: ", w.Code, w.Header())
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	h := RateLimiter(RateLimitSpec{
+		Limit: RateLimit{Requests: 1, Period: time.Minute},
+		Key:   FirstKey(KeyByHeader("X-API-Key"), KeyByIP(nil)),
+	})(getGenericHandler())
+	get := func(apiKey string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	if get("key-1") != http.StatusOK || get("key-1") != http.StatusTooManyRequests {
+		t.Error("Expected the API key to be limited.")
+	}
+	if get("key-2") != http.StatusOK {
+		t.Error("Expected another API key to have its own bucket.")
+	}
+	if get("") != http.StatusOK || get("") != http.StatusTooManyRequests {
+		t.Error("Expected requests without a key to be limited by IP.")
+	}
+
+	unlimited := RateLimiter(RateLimitSpec{
+		Limit: RateLimit{Requests: 1, Period: time.Minute},
+		Key:   KeyByHeader("X-API-Key"),
+	})(getGenericHandler())
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		unlimited.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+			t.Error("Requests without a key should not be limited.")
+		}
+	}
+}
+
+func TestKeyByIPTrustedProxies(t *testing.T) {
+	key := KeyByIP([]string{"10.0.0.0/8", "192.0.2.7"})
+	cases := []struct {
+		remote, forwarded, expected string
+	}{
+		{"203.0.113.9:1", "198.51.100.1", "ip:203.0.113.9"},
+		{"10.1.2.3:1", "198.51.100.1", "ip:198.51.100.1"},
+		{"10.1.2.3:1", "6.6.6.6, 198.51.100.1, 192.0.2.7", "ip:198.51.100.1"},
+		{"192.0.2.7:1", "10.9.9.9", "ip:10.9.9.9"},
+		{"10.1.2.3:1", "not-an-ip", "ip:10.1.2.3"},
+		{"10.1.2.3:1", "", "ip:10.1.2.3"},
+		{"[2001:db8::1]:1", "198.51.100.1", "ip:2001:db8::1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := key(req); got != c.expected {
+			t.Errorf("%s via %q: expected %s, got %s", c.remote, c.forwarded, c.expected, got)
+		}
+	}
+}
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	return RateLimitResult{}, context.DeadlineExceeded
+}
+
+func TestRateLimiterStoreFailure(t *testing.T) {
+	spec := RateLimitSpec{Limit: RateLimit{Requests: 1, Period: time.Minute}, Store: failingRateLimitStore{}}
+	w := httptest.NewRecorder()
+	RateLimiter(spec)(getGenericHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("Expected to fail closed. Got: ", w.Code)
+	}
+	spec.FailOpen = true
+	w = httptest.NewRecorder()
+	RateLimiter(spec)(getGenericHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Error("Expected to fail open. Got: ", w.Code)
+	}
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// ReasonInternalError is reported in the ErrorResponse when a handler panics
+const ReasonInternalError = "internal_error"
+
+// PanicReport describes a panic recovered from a handler
+type PanicReport struct {
+	// Value is what the handler panicked with
+	Value     interface{}
+	Stack     []byte
+	RequestID string
+	Request   *http.Request
+}
+
+// Reporter forwards recovered panics to an error tracking service
+type Reporter interface {
+	ReportPanic(ctx context.Context, report PanicReport)
+}
+
+// ReporterFunc lets an ordinary function be used as a Reporter
+type ReporterFunc func(ctx context.Context, report PanicReport)
+
+// ReportPanic calls f
+func (f ReporterFunc) ReportPanic(ctx context.Context, report PanicReport) {
+	f(ctx, report)
+}
+
+// RecoverySpec captures the specification for Recovery
+type RecoverySpec struct {
+	// Reporter, when set, is called with every recovered panic
+	Reporter Reporter
+}
+
+// Recovery turns a panic in the handler into a 500 JSON error carrying the request ID, logs it with the stack
+// trace and reports it. Place it inside RequestLogger so the request ID is known. When the response had already
+// started, the connection is aborted instead so the client cannot mistake a partial body for a complete one.
+// http.ErrAbortHandler is passed on untouched.
+func Recovery(spec RecoverySpec) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := newStatusRecorder(w)
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				report := PanicReport{Value: v, Stack: debug.Stack(), RequestID: RequestID(r.Context()), Request: r}
+				Logger(r.Context()).Error("Recovered from panic", "panic", fmt.Sprint(v), "stack", string(report.Stack))
+				if spec.Reporter != nil {
+					reportPanic(r.Context(), spec.Reporter, report)
+				}
+				if rec.status != 0 {
+					panic(http.ErrAbortHandler)
+				}
+				writeJSONError(w, http.StatusInternalServerError, ReasonInternalError, "the server was unable to complete the request")
+			}()
+			h.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// reportPanic keeps a failing Reporter from taking the recovery down with it
+func reportPanic(ctx context.Context, reporter Reporter, report PanicReport) {
+	defer func() {
+		if v := recover(); v != nil {
+			Logger(ctx).Error("Panic reporter failed", "panic", fmt.Sprint(v))
+		}
+	}()
+	reporter.ReportPanic(ctx, report)
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func panickingRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/boom/{id}", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom " + mux.Vars(r)["id"])
+	})
+	router.HandleFunc("/partial", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("half a response"))
+		panic("after writing")
+	})
+	router.HandleFunc("/abort", func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	router.HandleFunc("/ok", getGenericHandler())
+	return router
+}
+
+// serveRecovered serves the request and returns whatever the handler chain panicked with
+func serveRecovered(h http.Handler, w http.ResponseWriter, r *http.Request) (v interface{}) {
+	defer func() { v = recover() }()
+	h.ServeHTTP(w, r)
+	return nil
+}
+
+func TestRecovery(t *testing.T) {
+	var logs bytes.Buffer
+	var reports []PanicReport
+	reporter := ReporterFunc(func(ctx context.Context, report PanicReport) {
+		reports = append(reports, report)
+	})
+	h := Chain(panickingRouter(),
+		RequestLogger(LoggingSpec{Logger: NewJSONLogger(&logs)}),
+		Recovery(RecoverySpec{Reporter: reporter}),
+	)
+
+	w := httptest.NewRecorder()
+	if v := serveRecovered(h, w, httptest.NewRequest("GET", "/boom/7", nil)); v != nil {
+		t.Fatal("Panic escaped the recovery: ", v)
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Error("Expected 500. Got: ", w.Code)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	id := w.Header().Get(HeaderRequestID)
+	if resp.Reason != ReasonInternalError || resp.RequestID == "" || resp.RequestID != id {
+		t.Error("Unexpected error response: ", resp)
+	}
+	if strings.Contains(w.Body.String(), "boom") {
+		t.Error("The panic value must not leak to the client: ", w.Body.String())
+	}
+
+	if len(reports) != 1 {
+		t.Fatal("Expected one report. Got: ", len(reports))
+	}
+	if reports[0].Value != "boom 7" || reports[0].RequestID != id || reports[0].Request.URL.Path != "/boom/7" {
+		t.Error("Unexpected report: ", reports[0].Value, reports[0].RequestID)
+	}
+	if !strings.Contains(string(reports[0].Stack), "panickingRouter") {
+		t.Error("Expected the stack to point at the handler: ", string(reports[0].Stack))
+	}
+	if !strings.Contains(logs.String(), `"msg":"Recovered from panic"`) || !strings.Contains(logs.String(), `"panic":"boom 7"`) {
+		t.Error("Expected the panic to be logged: ", logs.String())
+	}
+
+	w = httptest.NewRecorder()
+	serveRecovered(h, w, httptest.NewRequest("GET", "/ok", nil))
+	if w.Code != http.StatusOK || len(reports) != 1 {
+		t.Error("Requests without panics should pass through untouched.")
+	}
+}
+
+func TestRecoveryAfterResponseStarted(t *testing.T) {
+	reported := 0
+	h := Recovery(RecoverySpec{Reporter: ReporterFunc(func(ctx context.Context, report PanicReport) {
+		reported++
+	})})(panickingRouter())
+
+	w := httptest.NewRecorder()
+	if v := serveRecovered(h, w, httptest.NewRequest("GET", "/partial", nil)); v != http.ErrAbortHandler {
+		t.Error("Expected the connection to be aborted. Got: ", v)
+	}
+	if reported != 1 {
+		t.Error("Expected the panic to be reported before aborting.")
+	}
+	if v := serveRecovered(h, httptest.NewRecorder(), httptest.NewRequest("GET", "/abort", nil)); v != http.ErrAbortHandler {
+		t.Error("Expected http.ErrAbortHandler to pass through. Got: ", v)
+	}
+	if reported != 1 {
+		t.Error("http.ErrAbortHandler should not be reported.")
+	}
+}
+
+func TestRecoveryOverHTTP(t *testing.T) {
+	h := Recovery(RecoverySpec{Reporter: ReporterFunc(func(ctx context.Context, report PanicReport) {
+		panic("reporter is broken too")
+	})})(panickingRouter())
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/boom/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("Content-Type") != ContentTypeProblem {
+		t.Error("Unexpected response: ", resp.StatusCode, string(body))
+	}
+
+	if resp, err := http.Get(ts.URL + "/partial"); err == nil {
+		if _, err := ioutil.ReadAll(resp.Body); err == nil {
+			t.Error("Expected the partial body to end in an error.")
+		}
+		resp.Body.Close()
+	}
+	resp, err = http.Get(ts.URL + "/ok")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Server should keep serving after an aborted response: ", err)
+	}
+	resp.Body.Close()
+}
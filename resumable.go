@@ -0,0 +1,346 @@
+package service
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Reasons reported in the ErrorResponse by the ResumableUploadHandler
+const (
+	ReasonOffsetMismatch    = "offset_mismatch"
+	ReasonUploadIncomplete  = "upload_incomplete"
+	ReasonUploadBusy        = "upload_busy"
+	ReasonInvalidUploadSpec = "invalid_upload_request"
+)
+
+// Headers used by the resumable upload protocol. They follow the tus.io conventions.
+const (
+	HeaderUploadLength   = "Upload-Length"
+	HeaderUploadOffset   = "Upload-Offset"
+	HeaderUploadMetadata = "Upload-Metadata"
+	HeaderUploadExpires  = "Upload-Expires"
+	offsetOctetStream    = "application/offset+octet-stream"
+)
+
+// ResumableUploadSpec specifies the ResumableUploadHandler. The embedded UploadHandlerSpec decides where
+// and how completed uploads are stored.
+type ResumableUploadSpec struct {
+	UploadHandlerSpec
+	// BasePath is the path the handler is mounted on, e.g. "/resumable/". Defaults to "/".
+	BasePath string
+	// StagingLocation is the local directory incomplete uploads are written to. Defaults to os.TempDir().
+	StagingLocation string
+	// TTL is how long an incomplete upload is kept after its last chunk. Defaults to 24 hours.
+	TTL time.Duration
+}
+
+type resumableUpload struct {
+	mu       sync.Mutex
+	id       string
+	filename string
+	length   int64
+	offset   int64
+	expires  time.Time
+	path     string
+	// removed is set, with mu held, once the upload is finalised, deleted or expired
+	removed bool
+}
+
+// ResumableUploadHandler accepts uploads in chunks so an interrupted transfer can carry on where it stopped:
+//
+//	POST   {BasePath}       create an upload. Requires Upload-Length; Upload-Metadata may carry the filename.
+//	HEAD   {BasePath}{id}   report the current Upload-Offset
+//	PATCH  {BasePath}{id}   append the body at Upload-Offset
+//	POST   {BasePath}{id}   finalise a complete upload; replies with an UploadManifest
+//	DELETE {BasePath}{id}   abandon the upload
+type ResumableUploadHandler struct {
+	spec    ResumableUploadSpec
+	now     func() time.Time
+	mu      sync.Mutex
+	uploads map[string]*resumableUpload
+}
+
+// NewResumableUploadHandler returns a handler for the spec
+func NewResumableUploadHandler(spec ResumableUploadSpec) *ResumableUploadHandler {
+	spec.UploadHandlerSpec = spec.UploadHandlerSpec.withDefaults()
+	if spec.BasePath == "" {
+		spec.BasePath = "/"
+	}
+	if !strings.HasSuffix(spec.BasePath, "/") {
+		spec.BasePath += "/"
+	}
+	if spec.StagingLocation == "" {
+		spec.StagingLocation = os.TempDir()
+	}
+	if spec.TTL <= 0 {
+		spec.TTL = 24 * time.Hour
+	}
+	return &ResumableUploadHandler{spec: spec, now: time.Now, uploads: make(map[string]*resumableUpload)}
+}
+
+func (h *ResumableUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.PurgeExpired()
+	if !strings.HasPrefix(r.URL.Path, h.spec.BasePath) {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, h.spec.BasePath)
+	if id == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		h.create(w, r)
+		return
+	}
+	upload := h.lookup(id)
+	if upload == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		h.head(w, upload)
+	case http.MethodPatch:
+		h.patch(w, r, upload)
+	case http.MethodPost:
+		h.finalise(w, r, upload)
+	case http.MethodDelete:
+		if !upload.mu.TryLock() {
+			writeJSONError(w, http.StatusConflict, ReasonUploadBusy, "a chunk is being written to this upload")
+			return
+		}
+		defer upload.mu.Unlock()
+		if !upload.removed {
+			h.remove(upload)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "HEAD, PATCH, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// PurgeExpired removes incomplete uploads whose TTL has passed, leaving any a request is busy with. It is called
+// on every request; call it on a timer as well if the handler may sit idle for long.
+func (h *ResumableUploadHandler) PurgeExpired() {
+	now := h.now()
+	h.mu.Lock()
+	var expired []*resumableUpload
+	for id, u := range h.uploads {
+		// TryLock keeps to the order of patch, which takes h.mu with u.mu held
+		if now.After(u.expires) && u.mu.TryLock() {
+			u.removed = true
+			u.mu.Unlock()
+			expired = append(expired, u)
+			delete(h.uploads, id)
+		}
+	}
+	h.mu.Unlock()
+	for _, u := range expired {
+		os.Remove(u.path)
+	}
+}
+
+func (h *ResumableUploadHandler) lookup(id string) *resumableUpload {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.uploads[id]
+}
+
+// advance records n more bytes written to an upload and pushes back its expiry. The offset is only
+// changed with both the upload and handler locks held so HEAD can read it without waiting on a PATCH.
+func (h *ResumableUploadHandler) advance(u *resumableUpload, n int64) (int64, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u.offset += n
+	u.expires = h.now().Add(h.spec.TTL)
+	return u.offset, u.expires
+}
+
+// remove forgets an upload and deletes its staging file. It is called with u.mu held.
+func (h *ResumableUploadHandler) remove(u *resumableUpload) {
+	u.removed = true
+	h.mu.Lock()
+	delete(h.uploads, u.id)
+	h.mu.Unlock()
+	os.Remove(u.path)
+}
+
+func (h *ResumableUploadHandler) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get(HeaderUploadLength), 10, 64)
+	if err != nil || length < 0 {
+		writeJSONError(w, http.StatusBadRequest, ReasonInvalidUploadSpec, "a valid Upload-Length header is required")
+		return
+	}
+	if h.spec.MaxBytes > 0 && length > h.spec.MaxBytes {
+		WriteError(w, r, tooLargeUploadError(h.spec.MaxBytes))
+		return
+	}
+	u, err := uuid.NewV4()
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	filename := uploadMetadata(r.Header.Get(HeaderUploadMetadata))["filename"]
+	if filename == "" {
+		filename = "upload"
+	}
+	expires := h.now().Add(h.spec.TTL)
+	upload := &resumableUpload{
+		id:       u.String(),
+		filename: filename,
+		length:   length,
+		expires:  expires,
+		path:     filepath.Join(h.spec.StagingLocation, "resumable-"+u.String()),
+	}
+	f, err := os.OpenFile(upload.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		Logger(r.Context()).Error("Unable to create resumable upload", "error", err)
+		WriteError(w, r, err)
+		return
+	}
+	f.Close()
+	h.mu.Lock()
+	h.uploads[upload.id] = upload
+	h.mu.Unlock()
+
+	w.Header().Set("Location", h.spec.BasePath+upload.id)
+	w.Header().Set(HeaderUploadOffset, "0")
+	w.Header().Set(HeaderUploadExpires, expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *ResumableUploadHandler) head(w http.ResponseWriter, u *resumableUpload) {
+	h.mu.Lock()
+	offset, expires := u.offset, u.expires
+	h.mu.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(HeaderUploadOffset, strconv.FormatInt(offset, 10))
+	w.Header().Set(HeaderUploadLength, strconv.FormatInt(u.length, 10))
+	w.Header().Set(HeaderUploadExpires, expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *ResumableUploadHandler) patch(w http.ResponseWriter, r *http.Request, u *resumableUpload) {
+	if r.Header.Get("Content-Type") != offsetOctetStream {
+		writeJSONError(w, http.StatusUnsupportedMediaType, ReasonInvalidUploadSpec, "chunks must be sent as "+offsetOctetStream)
+		return
+	}
+	if !u.mu.TryLock() {
+		writeJSONError(w, http.StatusConflict, ReasonUploadBusy, "another chunk is being written to this upload")
+		return
+	}
+	defer u.mu.Unlock()
+	if u.removed {
+		http.NotFound(w, r)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(HeaderUploadOffset), 10, 64)
+	if err != nil || offset != u.offset {
+		w.Header().Set(HeaderUploadOffset, strconv.FormatInt(u.offset, 10))
+		writeJSONError(w, http.StatusConflict, ReasonOffsetMismatch,
+			fmt.Sprintf("chunk offset %q does not match the upload offset %d", r.Header.Get(HeaderUploadOffset), u.offset))
+		return
+	}
+	remaining := u.length - u.offset
+	if r.ContentLength > remaining {
+		w.Header().Set(HeaderUploadOffset, strconv.FormatInt(u.offset, 10))
+		writeJSONError(w, http.StatusRequestEntityTooLarge, ReasonTooLarge, "chunk extends past Upload-Length")
+		return
+	}
+	f, err := os.OpenFile(u.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	n, err := io.Copy(f, io.LimitReader(r.Body, remaining))
+	if err == nil && n == remaining {
+		// A chunk without a Content-Length that turns out to run past Upload-Length is taken back out, so the
+		// client and the server agree nothing of it was kept
+		var extra [1]byte
+		if m, _ := r.Body.Read(extra[:]); m > 0 {
+			if err = f.Truncate(u.offset); err == nil {
+				f.Close()
+				w.Header().Set(HeaderUploadOffset, strconv.FormatInt(u.offset, 10))
+				writeJSONError(w, http.StatusRequestEntityTooLarge, ReasonTooLarge, "chunk extends past Upload-Length")
+				return
+			}
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	newOffset, expires := h.advance(u, n)
+	w.Header().Set(HeaderUploadOffset, strconv.FormatInt(newOffset, 10))
+	w.Header().Set(HeaderUploadExpires, expires.UTC().Format(http.TimeFormat))
+	if err != nil {
+		Logger(r.Context()).Warn("Resumable upload chunk interrupted", "id", u.id, "offset", newOffset, "error", err)
+		WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ResumableUploadHandler) finalise(w http.ResponseWriter, r *http.Request, u *resumableUpload) {
+	if !u.mu.TryLock() {
+		writeJSONError(w, http.StatusConflict, ReasonUploadBusy, "a chunk is still being written to this upload")
+		return
+	}
+	defer u.mu.Unlock()
+	if u.removed {
+		http.NotFound(w, r)
+		return
+	}
+	if u.offset != u.length {
+		w.Header().Set(HeaderUploadOffset, strconv.FormatInt(u.offset, 10))
+		writeJSONError(w, http.StatusConflict, ReasonUploadIncomplete,
+			fmt.Sprintf("upload has %d of %d bytes", u.offset, u.length))
+		return
+	}
+	f, err := os.Open(u.path)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	file, uploadErr := h.spec.store(r.Context(), "", u.filename, f)
+	f.Close()
+	if uploadErr != nil {
+		WriteError(w, r, uploadErr)
+		return
+	}
+	h.remove(u)
+	WriteJSON(w, http.StatusOK, UploadManifest{Files: []UploadedFile{file}})
+}
+
+// uploadMetadata decodes an Upload-Metadata header: comma separated "key base64(value)" pairs
+func uploadMetadata(header string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		result[fields[0]] = value
+	}
+	return result
+}
@@ -0,0 +1,231 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arunsworld/go-service/httpclient"
+)
+
+func newTestResumableHandler(t *testing.T, store UploadStore) (*ResumableUploadHandler, func()) {
+	dir, err := ioutil.TempDir("", "resumable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewResumableUploadHandler(ResumableUploadSpec{
+		UploadHandlerSpec: UploadHandlerSpec{Store: store, DownloadURL: "http://abc.com/uploads/"},
+		BasePath:          "/resumable/",
+		StagingLocation:   dir,
+		TTL:               time.Hour,
+	})
+	return h, func() { os.RemoveAll(dir) }
+}
+
+func resumableRequest(h http.Handler, method, target string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestResumableUploadHandler(t *testing.T) {
+	store := NewMemoryUploadStore()
+	h, cleanup := newTestResumableHandler(t, store)
+	defer cleanup()
+	data := []byte("0123456789abcdefghij")
+
+	w := resumableRequest(h, "POST", "/resumable/", nil, map[string]string{
+		HeaderUploadLength:   "20",
+		HeaderUploadMetadata: "filename ZGF0YS5jc3Y=",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatal("Expected 201 on create. Got:", w.Code)
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/resumable/") {
+		t.Fatal("Unexpected Location:", location)
+	}
+
+	chunk := func(offset string, body []byte) *httptest.ResponseRecorder {
+		return resumableRequest(h, "PATCH", location, body, map[string]string{
+			"Content-Type":     offsetOctetStream,
+			HeaderUploadOffset: offset,
+		})
+	}
+	if w := chunk("0", data[:8]); w.Code != http.StatusNoContent || w.Header().Get(HeaderUploadOffset) != "8" {
+		t.Fatal("Unexpected response to first chunk:", w.Code, w.Header().Get(HeaderUploadOffset))
+	}
+	if w := chunk("3", data[3:8]); w.Code != http.StatusConflict || w.Header().Get(HeaderUploadOffset) != "8" {
+		t.Error("Expected 409 with the current offset for a chunk at the wrong offset. Got:", w.Code)
+	}
+	if w := resumableRequest(h, "HEAD", location, nil, nil); w.Header().Get(HeaderUploadOffset) != "8" || w.Header().Get(HeaderUploadLength) != "20" {
+		t.Error("HEAD reported the wrong progress:", w.Header())
+	}
+	if w := resumableRequest(h, "POST", location, nil, nil); w.Code != http.StatusConflict {
+		t.Error("Expected 409 when finalising an incomplete upload. Got:", w.Code)
+	}
+	if w := chunk("8", append(data[8:], 'X')); w.Code != http.StatusRequestEntityTooLarge || w.Header().Get(HeaderUploadOffset) != "8" {
+		t.Error("Expected 413 for a chunk running past Upload-Length. Got:", w.Code, w.Header().Get(HeaderUploadOffset))
+	}
+	// Without a Content-Length the chunk is only found to be too long once written, and is taken back out
+	req := httptest.NewRequest("PATCH", location, io.MultiReader(bytes.NewReader(append(data[8:], 'X'))))
+	req.Header.Set("Content-Type", offsetOctetStream)
+	req.Header.Set(HeaderUploadOffset, "8")
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge || w.Header().Get(HeaderUploadOffset) != "8" {
+		t.Error("Expected 413 for a chunked body running past Upload-Length. Got:", w.Code, w.Header().Get(HeaderUploadOffset))
+	}
+	if w := chunk("8", data[8:]); w.Code != http.StatusNoContent || w.Header().Get(HeaderUploadOffset) != "20" {
+		t.Fatal("Expected the rest of the upload to be accepted. Got:", w.Code, w.Header().Get(HeaderUploadOffset))
+	}
+
+	w = resumableRequest(h, "POST", location, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected 200 on finalise. Got:", w.Code, w.Body.String())
+	}
+	manifest := decodeManifest(t, w)
+	if manifest.Files[0].OriginalName != "data.csv" || manifest.Files[0].Size != 20 {
+		t.Error("Unexpected manifest:", manifest.Files[0])
+	}
+	rc, _, err := store.Get(context.Background(), manifest.Files[0].StoredName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if stored, _ := ioutil.ReadAll(rc); !bytes.Equal(stored, data) {
+		t.Errorf("Stored content did not match: %q", stored)
+	}
+	if w := resumableRequest(h, "HEAD", location, nil, nil); w.Code != http.StatusNotFound {
+		t.Error("Expected a finalised upload to be gone. Got:", w.Code)
+	}
+}
+
+func TestResumableUploadExpiry(t *testing.T) {
+	h, cleanup := newTestResumableHandler(t, NewMemoryUploadStore())
+	defer cleanup()
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	w := resumableRequest(h, "POST", "/resumable/", nil, map[string]string{HeaderUploadLength: "10"})
+	location := w.Header().Get("Location")
+	path := h.lookup(strings.TrimPrefix(location, "/resumable/")).path
+
+	now = now.Add(2 * time.Hour)
+	if w := resumableRequest(h, "HEAD", location, nil, nil); w.Code != http.StatusNotFound {
+		t.Error("Expected an expired upload to be gone. Got:", w.Code)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected the staging file of an expired upload to be removed.")
+	}
+}
+
+func TestResumableUploadRemovalWaitsForRequests(t *testing.T) {
+	h, cleanup := newTestResumableHandler(t, NewMemoryUploadStore())
+	defer cleanup()
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	location := resumableRequest(h, "POST", "/resumable/", nil, map[string]string{HeaderUploadLength: "4"}).Header().Get("Location")
+	upload := h.lookup(strings.TrimPrefix(location, "/resumable/"))
+	resumableRequest(h, "PATCH", location, []byte("data"), map[string]string{"Content-Type": offsetOctetStream, HeaderUploadOffset: "0"})
+
+	// A request busy with the upload holds its lock
+	upload.mu.Lock()
+	if w := resumableRequest(h, "DELETE", location, nil, nil); w.Code != http.StatusConflict {
+		t.Error("Expected 409 when deleting a busy upload. Got:", w.Code)
+	}
+	now = now.Add(2 * time.Hour)
+	h.PurgeExpired()
+	if _, err := os.Stat(upload.path); err != nil || h.lookup(upload.id) == nil {
+		t.Error("Expected a busy upload not to be purged.")
+	}
+	upload.mu.Unlock()
+
+	h.PurgeExpired()
+	if _, err := os.Stat(upload.path); !os.IsNotExist(err) || h.lookup(upload.id) != nil {
+		t.Error("Expected the idle expired upload to be purged.")
+	}
+	// A request that found the upload before it was purged
+	w := httptest.NewRecorder()
+	h.finalise(w, httptest.NewRequest("POST", location, nil), upload)
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected 404 when finalising a removed upload. Got:", w.Code)
+	}
+}
+
+// failingBody returns an error after a few bytes, as if the connection dropped mid-chunk
+type failingBody struct {
+	r io.Reader
+}
+
+func (f failingBody) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func (f failingBody) Close() error { return nil }
+
+func TestResumableUploadClientAgainstHandler(t *testing.T) {
+	store := NewMemoryUploadStore()
+	h, cleanup := newTestResumableHandler(t, store)
+	defer cleanup()
+
+	var mu sync.Mutex
+	patches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			mu.Lock()
+			patches++
+			drop := patches == 2
+			mu.Unlock()
+			if drop {
+				r.Body = failingBody{io.LimitReader(r.Body, 7)}
+			}
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	resp, err := httpclient.ResumableUploadClient(httpclient.ResumableUploadClientSpec{
+		URL:        ts.URL + "/resumable/",
+		Content:    bytes.NewReader(data),
+		Filename:   "numbers.txt",
+		ChunkSize:  30,
+		RetryDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Resumable upload failed:", err)
+	}
+	var manifest UploadManifest
+	if err := json.Unmarshal(resp, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	rc, _, err := store.Get(context.Background(), manifest.Files[0].StoredName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if stored, _ := ioutil.ReadAll(rc); !bytes.Equal(stored, data) {
+		t.Errorf("Stored content did not match: %q", stored)
+	}
+}
@@ -0,0 +1,524 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3MetaPrefix      = "X-Amz-Meta-"
+	// s3MinPartSize is the smallest part S3 accepts in a multipart upload, other than the last
+	s3MinPartSize = 5 << 20
+)
+
+// S3UploadStoreSpec specifies how to reach an S3-compatible bucket
+type S3UploadStoreSpec struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Client          *http.Client
+	// PartSize is the size of the parts content of unknown length is uploaded in, and so the most memory a Put
+	// holds. Defaults to 8 MiB; S3 needs at least 5 MiB.
+	PartSize int64
+}
+
+// S3UploadStore stores uploads in an S3-compatible bucket using path-style addressing and
+// Signature Version 4. Metadata is kept as x-amz-meta-* headers on the object.
+type S3UploadStore struct {
+	spec S3UploadStoreSpec
+	now  func() time.Time
+}
+
+// NewS3UploadStore returns a store for the bucket described by spec
+func NewS3UploadStore(spec S3UploadStoreSpec) *S3UploadStore {
+	if spec.Region == "" {
+		spec.Region = "us-east-1"
+	}
+	if spec.Client == nil {
+		spec.Client = http.DefaultClient
+	}
+	if spec.PartSize < s3MinPartSize {
+		spec.PartSize = 8 << 20
+	}
+	spec.Endpoint = strings.TrimSuffix(spec.Endpoint, "/")
+	return &S3UploadStore{spec: spec, now: time.Now}
+}
+
+// Put uploads the content of r to name. S3 needs to know the object size up front, so content whose length
+// cannot be determined is sent as a multipart upload, a part at a time, unless it all fits in the first part.
+func (s *S3UploadStore) Put(ctx context.Context, name string, r io.Reader, metadata map[string]string) (StoredFile, error) {
+	if err := validateStoredName(name); err != nil {
+		return StoredFile{}, err
+	}
+	body, size, err := sizedReader(r)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	if size < 0 {
+		part, err := ioutil.ReadAll(io.LimitReader(r, s.spec.PartSize))
+		if err != nil {
+			return StoredFile{}, err
+		}
+		if int64(len(part)) == s.spec.PartSize {
+			return s.putMultipart(ctx, name, part, r, metadata)
+		}
+		body, size = bytes.NewReader(part), int64(len(part))
+	}
+	req, err := s.newRequest(ctx, http.MethodPut, name, nil, ioutil.NopCloser(body))
+	if err != nil {
+		return StoredFile{}, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	setS3Metadata(req, metadata)
+	resp, err := s.do(req, s3UnsignedPayload)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	resp.Body.Close()
+	return StoredFile{Name: name, Size: size, ModTime: s.now(), Metadata: copyMetadata(metadata)}, nil
+}
+
+func setS3Metadata(req *http.Request, metadata map[string]string) {
+	for k, v := range metadata {
+		req.Header.Set(s3MetaPrefix+k, url.QueryEscape(v))
+	}
+	if ct := metadata[MetaContentType]; ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+}
+
+// s3CompleteMultipartUpload is the body of the request that assembles the uploaded parts
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart uploads part, which is full, followed by the rest of r, reusing part's memory for each part.
+// A failed upload is aborted so S3 does not keep the parts.
+func (s *S3UploadStore) putMultipart(ctx context.Context, name string, part []byte, r io.Reader, metadata map[string]string) (StoredFile, error) {
+	req, err := s.newRequest(ctx, http.MethodPost, name, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	setS3Metadata(req, metadata)
+	resp, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return StoredFile{}, fmt.Errorf("s3: unable to start multipart upload of %s: %v", name, err)
+	}
+	uploadID := initiated.UploadID
+
+	sent, err := s.putParts(ctx, name, uploadID, part, r)
+	if err == nil {
+		err = s.completeMultipart(ctx, name, uploadID, sent.parts)
+	}
+	if err != nil {
+		s.abortMultipart(context.WithoutCancel(ctx), name, uploadID)
+		return StoredFile{}, err
+	}
+	return StoredFile{Name: name, Size: sent.bytes, ModTime: s.now(), Metadata: copyMetadata(metadata)}, nil
+}
+
+// s3Parts tracks what a multipart upload has sent
+type s3Parts struct {
+	parts []s3CompletedPart
+	bytes int64
+}
+
+func (s *S3UploadStore) putParts(ctx context.Context, name, uploadID string, part []byte, r io.Reader) (s3Parts, error) {
+	var sent s3Parts
+	buf := part
+	for number := 1; len(part) > 0; number++ {
+		query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {uploadID}}
+		req, err := s.newRequest(ctx, http.MethodPut, name, query, bytes.NewReader(part))
+		if err != nil {
+			return sent, err
+		}
+		resp, err := s.do(req, s3UnsignedPayload)
+		if err != nil {
+			return sent, err
+		}
+		resp.Body.Close()
+		sent.parts = append(sent.parts, s3CompletedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		sent.bytes += int64(len(part))
+
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return sent, err
+		}
+		part = buf[:n]
+	}
+	return sent, nil
+}
+
+func (s *S3UploadStore) completeMultipart(ctx context.Context, name, uploadID string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest(ctx, http.MethodPost, name, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, sha256Hex(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 may answer 200 and report a failure in the body
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("s3: unable to complete multipart upload of %s: %v", name, err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("s3: unable to complete multipart upload of %s: %s: %s", name, result.Code, result.Message)
+	}
+	return nil
+}
+
+func (s *S3UploadStore) abortMultipart(ctx context.Context, name, uploadID string) {
+	req, err := s.newRequest(ctx, http.MethodDelete, name, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return
+	}
+	if resp, err := s.do(req, s3EmptyPayload); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Get downloads name. The returned reader can also Seek when S3 gave the object's size: seeking away from the
+// current position makes the next Read fetch the rest of the object with a Range request.
+func (s *S3UploadStore) Get(ctx context.Context, name string) (io.ReadCloser, StoredFile, error) {
+	if err := validateStoredName(name); err != nil {
+		return nil, StoredFile{}, err
+	}
+	resp, err := s.get(ctx, name, 0)
+	if err != nil {
+		return nil, StoredFile{}, err
+	}
+	info := s.storedFile(name, resp)
+	if info.Size < 0 {
+		return resp.Body, info, nil
+	}
+	return &s3Object{store: s, ctx: ctx, name: name, size: info.Size, body: resp.Body}, info, nil
+}
+
+func (s *S3UploadStore) get(ctx context.Context, name string, offset int64) (*http.Response, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return s.do(req, s3EmptyPayload)
+}
+
+// Stat issues a HEAD request for name
+func (s *S3UploadStore) Stat(ctx context.Context, name string) (StoredFile, error) {
+	if err := validateStoredName(name); err != nil {
+		return StoredFile{}, err
+	}
+	req, err := s.newRequest(ctx, http.MethodHead, name, nil, nil)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	resp, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	resp.Body.Close()
+	return s.storedFile(name, resp), nil
+}
+
+// Delete removes name from the bucket
+func (s *S3UploadStore) Delete(ctx context.Context, name string) error {
+	if err := validateStoredName(name); err != nil {
+		return err
+	}
+	req, err := s.newRequest(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, s3EmptyPayload)
+	if err == ErrUploadNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3UploadStore) newRequest(ctx context.Context, method, name string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := s.spec.Endpoint + "/" + s3Escape(s.spec.Bucket+"/"+s.spec.Prefix+name, false)
+	if len(query) > 0 {
+		u += "?" + s3CanonicalQuery(query)
+	}
+	return http.NewRequestWithContext(ctx, method, u, body)
+}
+
+func (s *S3UploadStore) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	signS3Request(req, s.spec, payloadHash, s.now())
+	resp, err := s.spec.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrUploadNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (s *S3UploadStore) storedFile(name string, resp *http.Response) StoredFile {
+	info := StoredFile{Name: name, Size: resp.ContentLength, Metadata: map[string]string{}}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	for k, v := range resp.Header {
+		if !strings.HasPrefix(k, s3MetaPrefix) || len(v) == 0 {
+			continue
+		}
+		value, err := url.QueryUnescape(v[0])
+		if err != nil {
+			value = v[0]
+		}
+		info.Metadata[strings.ToLower(strings.TrimPrefix(k, s3MetaPrefix))] = value
+	}
+	return info
+}
+
+// s3Object reads an object from S3, re-requesting from the new position after a Seek
+type s3Object struct {
+	store   *S3UploadStore
+	ctx     context.Context
+	name    string
+	size    int64
+	pos     int64
+	body    io.ReadCloser
+	bodyPos int64
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil || o.bodyPos != o.pos {
+		if o.body != nil {
+			o.body.Close()
+		}
+		resp, err := o.store.get(o.ctx, o.name, o.pos)
+		if err != nil {
+			o.body = nil
+			return 0, err
+		}
+		o.body, o.bodyPos = resp.Body, o.pos
+	}
+	n, err := o.body.Read(p)
+	o.pos += int64(n)
+	o.bodyPos += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, fmt.Errorf("s3: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("s3: negative position %d", offset)
+	}
+	o.pos = offset
+	return o.pos, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
+
+// sizedReader works out the length of r, returning -1 when there is no way to without reading it
+func sizedReader(r io.Reader) (io.Reader, int64, error) {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return r, int64(v.Len()), nil
+	case *os.File:
+		fi, err := v.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+		pos, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, err
+		}
+		return r, fi.Size() - pos, nil
+	case io.Seeker:
+		pos, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, err
+		}
+		end, err := v.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := v.Seek(pos, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		return r, end - pos, nil
+	}
+	return r, -1, nil
+}
+
+// signS3Request adds AWS Signature Version 4 headers to req
+func signS3Request(req *http.Request, spec S3UploadStoreSpec, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if spec.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", spec.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" || lk == "range" || lk == "content-md5" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + spec.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+spec.SecretAccessKey), date)
+	key = hmacSHA256(key, spec.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, spec.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func s3CanonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), values[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape URI-encodes s the way SigV4 expects; slashes are kept unless encodeSlash is set
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arunsworld/go-service/tracing"
+)
+
+// Reasons reported in the ErrorResponse when scanning refuses an upload
+const (
+	ReasonInfected   = "infected"
+	ReasonScanFailed = "scan_failed"
+)
+
+// MetaScanSignature records what the Scanner found on files moved to quarantine
+const MetaScanSignature = "scan-signature"
+
+// ScanResult is the verdict of a Scanner on a single file
+type ScanResult struct {
+	Infected bool
+	// Signature names what was found, e.g. "Eicar-Test-Signature"
+	Signature string
+}
+
+// Scanner inspects a stored upload before its download URL is handed out
+type Scanner interface {
+	Scan(ctx context.Context, name string, r io.Reader) (ScanResult, error)
+}
+
+// ScannerFunc lets an ordinary function be used as a Scanner
+type ScannerFunc func(ctx context.Context, name string, r io.Reader) (ScanResult, error)
+
+// Scan calls f
+func (f ScannerFunc) Scan(ctx context.Context, name string, r io.Reader) (ScanResult, error) {
+	return f(ctx, name, r)
+}
+
+// scan runs the spec's Scanner over a stored file. Flagged files are moved to the quarantine store and
+// a scanner that cannot give a verdict refuses the file, so nothing unscanned is ever handed out. A flagged file
+// that cannot be quarantined is left in the store and refused with a 503.
+func (spec UploadHandlerSpec) scan(ctx context.Context, name string) (uploadErr *HTTPError) {
+	ctx, span := tracing.Start(ctx, "upload.scan")
+	span.SetAttribute("upload.name", name)
+	defer func() {
+		if uploadErr != nil {
+			span.SetStatus(tracing.StatusError, uploadErr.Message)
+		}
+		span.End()
+	}()
+	rc, info, err := spec.Store.Get(ctx, name)
+	if err != nil {
+		return internalUploadError(err)
+	}
+	result, err := spec.Scanner.Scan(ctx, name, rc)
+	rc.Close()
+	if err != nil {
+		Logger(ctx).Error("Unable to scan upload", "name", name, "error", err)
+		spec.Store.Delete(ctx, name)
+		return NewHTTPError(http.StatusServiceUnavailable, ReasonScanFailed, "the file could not be scanned, try again later")
+	}
+	if !result.Infected {
+		return nil
+	}
+	if spec.Quarantine != nil {
+		if err := spec.quarantine(ctx, name, info, result); err != nil {
+			// Keep the file where it is rather than lose the evidence; it never gets a download URL
+			Logger(ctx).Error("Unable to quarantine infected upload, leaving it in the store", "name", name,
+				"signature", result.Signature, "error", err)
+			return NewHTTPError(http.StatusServiceUnavailable, ReasonScanFailed, "the file could not be quarantined, try again later")
+		}
+	}
+	spec.Store.Delete(ctx, name)
+	return NewHTTPError(http.StatusUnprocessableEntity, ReasonInfected, fmt.Sprintf("the file %q was rejected by the content scanner", info.Metadata[MetaOriginalName]))
+}
+
+func (spec UploadHandlerSpec) quarantine(ctx context.Context, name string, info StoredFile, result ScanResult) error {
+	rc, _, err := spec.Store.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	metadata := copyMetadata(info.Metadata)
+	metadata[MetaScanSignature] = result.Signature
+	_, err = spec.Quarantine.Put(ctx, name, rc, metadata)
+	return err
+}
+
+// clamdChunkSize is the size of each INSTREAM chunk sent to clamd
+const clamdChunkSize = 64 * 1024
+
+// ClamdScanner scans files with a ClamAV daemon over its INSTREAM protocol
+type ClamdScanner struct {
+	// Network and Address of clamd. Default to "tcp" and "localhost:3310"; use "unix" for a socket.
+	Network string
+	Address string
+	// Timeout bounds a whole scan. Defaults to one minute.
+	Timeout time.Duration
+}
+
+// Scan streams r to clamd and reports its verdict
+func (s ClamdScanner) Scan(ctx context.Context, name string, r io.Reader) (ScanResult, error) {
+	network, address, timeout := s.Network, s.Address, s.Timeout
+	if network == "" {
+		network = "tcp"
+	}
+	if address == "" {
+		address = "localhost:3310"
+	}
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return ScanResult{}, werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ScanResult{}, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanResult{}, err
+	}
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply understands replies such as "stream: OK" and "stream: Eicar-Test-Signature FOUND"
+func parseClamdReply(reply string) (ScanResult, error) {
+	verdict := reply
+	if i := strings.Index(reply, ": "); i >= 0 {
+		verdict = reply[i+2:]
+	}
+	switch {
+	case verdict == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	}
+	return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+}
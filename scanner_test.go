@@ -0,0 +1,181 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd speaks enough of the clamd INSTREAM protocol to flag the EICAR test string
+func fakeClamd(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn)
+		}
+	}()
+	return l
+}
+
+func serveClamd(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil || cmd != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	var data bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+			return
+		}
+	}
+	if bytes.Contains(data.Bytes(), []byte(eicar)) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestClamdScanner(t *testing.T) {
+	l := fakeClamd(t)
+	defer l.Close()
+	scanner := ClamdScanner{Address: l.Addr().String(), Timeout: 5 * time.Second}
+
+	result, err := scanner.Scan(context.Background(), "clean.txt", strings.NewReader(strings.Repeat("clean ", 50000)))
+	if err != nil || result.Infected {
+		t.Error("Expected a clean verdict. Got:", result, err)
+	}
+	result, err = scanner.Scan(context.Background(), "eicar.txt", strings.NewReader(eicar))
+	if err != nil || !result.Infected || result.Signature != "Eicar-Test-Signature" {
+		t.Error("Expected the EICAR signature. Got:", result, err)
+	}
+
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("Expected clamd errors to be reported.")
+	}
+	l.Close()
+	if _, err := scanner.Scan(context.Background(), "clean.txt", strings.NewReader("clean")); err == nil {
+		t.Error("Expected an error when clamd is unreachable.")
+	}
+}
+
+func TestUploadHandlerScanning(t *testing.T) {
+	l := fakeClamd(t)
+	defer l.Close()
+	store := NewMemoryUploadStore()
+	quarantine := NewMemoryUploadStore()
+	handler := GetUploadHandler(UploadHandlerSpec{
+		Store:      store,
+		Scanner:    ClamdScanner{Address: l.Addr().String()},
+		Quarantine: quarantine,
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, multipartUpload(t, "clean.txt", "text/plain", []byte("clean content")))
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected a clean file to be accepted. Got:", w.Code, w.Body.String())
+	}
+	clean := decodeManifest(t, w).Files[0]
+	if _, err := store.Stat(context.Background(), clean.StoredName); err != nil {
+		t.Error("Expected the clean file in the store:", err)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, multipartUpload(t, "eicar.txt", "text/plain", []byte(eicar)))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatal("Expected an infected file to be refused. Got:", w.Code, w.Body.String())
+	}
+	if e := decodeErrorResponse(t, w); e.Reason != ReasonInfected {
+		t.Error("Unexpected reason:", e.Reason)
+	}
+	if len(store.objects) != 1 {
+		t.Error("Expected the infected file to be removed from the store.")
+	}
+	if len(quarantine.objects) != 1 {
+		t.Fatal("Expected the infected file in quarantine.")
+	}
+	for _, obj := range quarantine.objects {
+		if string(obj.data) != eicar || obj.info.Metadata[MetaScanSignature] != "Eicar-Test-Signature" {
+			t.Error("Unexpected quarantined file:", string(obj.data), obj.info.Metadata)
+		}
+	}
+}
+
+func TestUploadHandlerScannerFailsClosed(t *testing.T) {
+	store := NewMemoryUploadStore()
+	handler := GetUploadHandler(UploadHandlerSpec{
+		Store: store,
+		Scanner: ScannerFunc(func(ctx context.Context, name string, r io.Reader) (ScanResult, error) {
+			return ScanResult{}, errors.New("scanner offline")
+		}),
+	})
+	w := httptest.NewRecorder()
+	handler(w, multipartUpload(t, "clean.txt", "text/plain", []byte("clean content")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("Expected 503 when the scanner fails. Got:", w.Code)
+	}
+	if e := decodeErrorResponse(t, w); e.Reason != ReasonScanFailed {
+		t.Error("Unexpected reason:", e.Reason)
+	}
+	if len(store.objects) != 0 {
+		t.Error("Expected the unscanned file to be removed.")
+	}
+}
+
+// failingStore is an UploadStore whose Put always fails
+type failingStore struct {
+	UploadStore
+}
+
+func (failingStore) Put(ctx context.Context, name string, r io.Reader, metadata map[string]string) (StoredFile, error) {
+	return StoredFile{}, errors.New("quarantine offline")
+}
+
+func TestUploadHandlerQuarantineFails(t *testing.T) {
+	store := NewMemoryUploadStore()
+	handler := GetUploadHandler(UploadHandlerSpec{
+		Store: store,
+		Scanner: ScannerFunc(func(ctx context.Context, name string, r io.Reader) (ScanResult, error) {
+			return ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+		}),
+		Quarantine: failingStore{NewMemoryUploadStore()},
+	})
+	w := httptest.NewRecorder()
+	handler(w, multipartUpload(t, "eicar.txt", "text/plain", []byte(eicar)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Error("Expected 503 when the file cannot be quarantined. Got:", w.Code)
+	}
+	if e := decodeErrorResponse(t, w); e.Reason != ReasonScanFailed {
+		t.Error("Unexpected reason:", e.Reason)
+	}
+	if len(store.objects) != 1 {
+		t.Error("Expected the infected file to be kept in the store.")
+	}
+}
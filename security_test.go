@@ -0,0 +1,99 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecureGivenHandlerWithProductionOptions(t *testing.T) {
+	var nonce string
+	h := SecureGivenHandlerWithOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = CSPNonce(r)
+		w.Write([]byte("OK"))
+	}), ProductionSecurityOptions())
+
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	headers := w.Header()
+	if nonce == "" {
+		t.Fatal("Expected a CSP nonce in the request context.")
+	}
+	csp := headers.Get("Content-Security-Policy")
+	if !strings.Contains(csp, "script-src 'self' 'nonce-"+nonce+"'") || strings.Contains(csp, "$NONCE") {
+		t.Error("Content-Security-Policy does not carry the nonce: ", csp)
+	}
+	expected := map[string]string{
+		"Strict-Transport-Security":    "max-age=63072000; includeSubdomains; preload",
+		"Referrer-Policy":              "strict-origin-when-cross-origin",
+		"Permissions-Policy":           "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+		"Cross-Origin-Opener-Policy":   "same-origin",
+		"Cross-Origin-Embedder-Policy": "require-corp",
+		"X-Content-Type-Options":       "nosniff",
+		"X-Frame-Options":              "DENY",
+	}
+	for header, value := range expected {
+		if got := headers.Get(header); got != value {
+			t.Errorf("%s not set or set to wrong value: %s", header, got)
+		}
+	}
+
+	first := nonce
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/", nil))
+	if nonce == first || strings.Contains(w.Header().Get("Content-Security-Policy"), first) {
+		t.Error("Expected a fresh nonce for every request.")
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if sts := w.Header().Get("Strict-Transport-Security"); sts != "" {
+		t.Error("Strict-Transport-Security should only be sent over HTTPS: ", sts)
+	}
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	h.ServeHTTP(w, req)
+	if sts := w.Header().Get("Strict-Transport-Security"); sts == "" {
+		t.Error("Strict-Transport-Security should be sent behind a TLS proxy.")
+	}
+}
+
+func TestSecureGivenHandlerWithOptionsAllowedHosts(t *testing.T) {
+	opts := ProductionSecurityOptions()
+	opts.AllowedHosts = []string{"example.com"}
+	h := SecureGivenHandlerWithOptions(getGenericHandler(), opts)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "https://evil.com/", nil))
+	if w.Code == http.StatusOK {
+		t.Error("Expected a request for another host to be refused.")
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Error("Expected a request for an allowed host to be served. Got: ", w.Code)
+	}
+}
+
+func TestSecureGivenHandlerWithDevelopmentOptions(t *testing.T) {
+	h := SecureGivenHandlerWithOptions(getGenericHandler(), DevelopmentSecurityOptions())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "https://localhost/", nil))
+
+	headers := w.Header()
+	if headers.Get("Content-Security-Policy") != "" || !strings.Contains(headers.Get("Content-Security-Policy-Report-Only"), "'nonce-") {
+		t.Error("Expected the CSP to be report only with a nonce: ", headers)
+	}
+	for _, header := range []string{"Strict-Transport-Security", "Cross-Origin-Embedder-Policy"} {
+		if v := headers.Get(header); v != "" {
+			t.Errorf("%s should not be set in development: %s", header, v)
+		}
+	}
+	if headers.Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("X-Content-Type-Options not set in development.")
+	}
+}
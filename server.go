@@ -0,0 +1,202 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Middleware wraps a handler with extra behaviour, like SecureGivenHandler
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h in the middleware. The first middleware is the outermost, so it sees requests first.
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// ShutdownHook releases a resource when the Server stops, e.g. closing a database
+type ShutdownHook func(ctx context.Context) error
+
+// ServerSpec captures the specification for a Server
+type ServerSpec struct {
+	// Addr to listen on. Defaults to ":8080".
+	Addr    string
+	Handler http.Handler
+	// Middleware is applied around Handler, the first being the outermost
+	Middleware []Middleware
+	// Timeouts default to 10 seconds for headers, 3 minutes to read or write a request and 2 minutes idle
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownGracePeriod is how long in-flight requests and shutdown hooks get once a shutdown starts.
+	// Defaults to one minute.
+	ShutdownGracePeriod time.Duration
+	// ShutdownDelay keeps serving for a while after a shutdown starts, so load balancers polling a readiness
+	// endpoint stop sending traffic before the listener closes. It counts towards the grace period.
+	ShutdownDelay time.Duration
+	// TLS serves HTTPS, reloading the certificate when its files change. Verified client certificates are
+	// available to handlers through ClientIdentityFrom.
+	TLS *TLSSpec
+}
+
+// Server is an http.Server that shuts down gracefully on SIGINT or SIGTERM
+type Server struct {
+	spec ServerSpec
+	srv  *http.Server
+
+	mu    sync.Mutex
+	hooks []ShutdownHook
+
+	once         sync.Once
+	shuttingDown chan struct{}
+	done         chan struct{}
+	shutdownErr  error
+}
+
+// NewServer returns a Server for the spec
+func NewServer(spec ServerSpec) *Server {
+	if spec.Addr == "" {
+		spec.Addr = ":8080"
+	}
+	if spec.Handler == nil {
+		spec.Handler = http.DefaultServeMux
+	}
+	if spec.ReadHeaderTimeout == 0 {
+		spec.ReadHeaderTimeout = 10 * time.Second
+	}
+	if spec.ReadTimeout == 0 {
+		spec.ReadTimeout = 3 * time.Minute
+	}
+	if spec.WriteTimeout == 0 {
+		spec.WriteTimeout = 3 * time.Minute
+	}
+	if spec.IdleTimeout == 0 {
+		spec.IdleTimeout = 2 * time.Minute
+	}
+	if spec.ShutdownGracePeriod == 0 {
+		spec.ShutdownGracePeriod = time.Minute
+	}
+	handler := Chain(spec.Handler, spec.Middleware...)
+	if spec.TLS != nil {
+		handler = ClientCertIdentity(handler)
+	}
+	return &Server{
+		spec: spec,
+		srv: &http.Server{
+			Addr:              spec.Addr,
+			Handler:           handler,
+			ReadHeaderTimeout: spec.ReadHeaderTimeout,
+			ReadTimeout:       spec.ReadTimeout,
+			WriteTimeout:      spec.WriteTimeout,
+			IdleTimeout:       spec.IdleTimeout,
+		},
+		shuttingDown: make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// OnShutdown registers a hook to run once in-flight requests have drained. Hooks run in the order registered.
+func (s *Server) OnShutdown(hook ShutdownHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// ShuttingDown is closed as soon as a shutdown starts
+func (s *Server) ShuttingDown() <-chan struct{} {
+	return s.shuttingDown
+}
+
+// ListenAndServe listens on the spec's Addr and serves until the server is shut down
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.spec.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves on l until SIGINT or SIGTERM is received or Shutdown is called. It returns once requests have
+// drained and the shutdown hooks have run, with the first error they reported.
+func (s *Server) Serve(l net.Listener) error {
+	var certs *CertReloader
+	if s.spec.TLS != nil {
+		var err error
+		if certs, err = NewCertReloader(*s.spec.TLS); err != nil {
+			return err
+		}
+		s.srv.TLSConfig = certs.ServerConfig()
+		go certs.Watch(s.shuttingDown)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() {
+		if certs != nil {
+			served <- s.srv.ServeTLS(l, "", "")
+			return
+		}
+		served <- s.srv.Serve(l)
+	}()
+
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			return err
+		}
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String())
+		ctx, cancel := context.WithTimeout(context.Background(), s.spec.ShutdownGracePeriod)
+		defer cancel()
+		s.Shutdown(ctx)
+		<-served
+	}
+	<-s.done
+	return s.shutdownErr
+}
+
+// Shutdown stops accepting connections after the ShutdownDelay, waits for in-flight requests to finish and then
+// runs the shutdown hooks. Calling it again waits for the first shutdown to complete.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.once.Do(func() {
+		close(s.shuttingDown)
+		if s.spec.ShutdownDelay > 0 {
+			select {
+			case <-time.After(s.spec.ShutdownDelay):
+			case <-ctx.Done():
+			}
+		}
+		err := s.srv.Shutdown(ctx)
+		if err != nil {
+			slog.Error("Shutdown error", "error", err)
+		}
+		s.mu.Lock()
+		hooks := append([]ShutdownHook(nil), s.hooks...)
+		s.mu.Unlock()
+		for _, hook := range hooks {
+			if hookErr := hook(ctx); hookErr != nil {
+				slog.Error("Shutdown hook error", "error", hookErr)
+				if err == nil {
+					err = hookErr
+				}
+			}
+		}
+		s.shutdownErr = err
+		close(s.done)
+	})
+	<-s.done
+	return s.shutdownErr
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				h.ServeHTTP(w, r)
+			})
+		}
+	}
+	h := Chain(getGenericHandler(), mark("outer"), mark("inner"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if len(order) != 2 || order[0] != "outer" || order[1] != "inner" {
+		t.Error("Middleware ran in the wrong order: ", order)
+	}
+}
+
+func TestServerDrainsAndRunsHooks(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := NewServer(ServerSpec{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("finished"))
+		}),
+		ShutdownGracePeriod: 5 * time.Second,
+	})
+	var mu sync.Mutex
+	var hooks []string
+	hook := func(name string, err error) ShutdownHook {
+		return func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			hooks = append(hooks, name)
+			return err
+		}
+	}
+	srv.OnShutdown(hook("first", nil))
+	srv.OnShutdown(hook("second", errors.New("close failed")))
+	srv.OnShutdown(hook("third", nil))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	<-srv.ShuttingDown()
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the in-flight request finished.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	if b := <-body; b != "finished" {
+		t.Error("In-flight request was not drained: ", b)
+	}
+	if err := <-shutdown; err == nil || err.Error() != "close failed" {
+		t.Error("Expected the hook error from Shutdown. Got: ", err)
+	}
+	if err := <-served; err == nil || err.Error() != "close failed" {
+		t.Error("Expected the hook error from Serve. Got: ", err)
+	}
+	if len(hooks) != 3 || hooks[0] != "first" || hooks[1] != "second" || hooks[2] != "third" {
+		t.Error("Hooks ran in the wrong order: ", hooks)
+	}
+	if _, err := http.Get("http://" + l.Addr().String() + "/"); err == nil {
+		t.Error("Expected the server to stop accepting connections.")
+	}
+}
+
+func TestServerStopsOnSIGTERM(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals cannot be sent to the own process on windows")
+	}
+	srv := NewServer(ServerSpec{Handler: getGenericHandler()})
+	hookRan := make(chan struct{})
+	srv.OnShutdown(func(ctx context.Context) error {
+		close(hookRan)
+		return nil
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	// Once a request is served the signal handler is in place
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error("Expected a clean shutdown. Got: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not shut down on SIGTERM.")
+	}
+	select {
+	case <-hookRan:
+	default:
+		t.Error("Shutdown hook did not run.")
+	}
+}
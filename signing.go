@@ -0,0 +1,185 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Query parameters carried by a signed download URL
+const (
+	ParamExpires   = "expires"
+	ParamKeyID     = "kid"
+	ParamSingleUse = "once"
+	ParamSignature = "signature"
+)
+
+// Reason reported in the ErrorResponse when a download URL fails verification
+const ReasonInvalidSignature = "invalid_signature"
+
+// Errors returned by URLSigner.Verify
+var (
+	ErrSignatureInvalid = errors.New("download URL signature is invalid")
+	ErrSignatureExpired = errors.New("download URL has expired")
+	ErrSignatureUsed    = errors.New("download URL has already been used")
+)
+
+// SigningKey is a named secret used to sign download URLs
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// URLSigner issues and verifies HMAC-SHA256 signed download URLs. New URLs are signed with the active key while
+// every key the signer holds is accepted on verification, so URLs keep working through a key rollover.
+// Single-use URLs are remembered in memory until they expire, which means they are single use per process.
+type URLSigner struct {
+	mu   sync.Mutex
+	keys []SigningKey
+	used map[string]time.Time
+	now  func() time.Time
+}
+
+// NewURLSigner returns a signer. The first key is the active one.
+func NewURLSigner(keys ...SigningKey) *URLSigner {
+	return &URLSigner{keys: append([]SigningKey(nil), keys...), used: make(map[string]time.Time), now: time.Now}
+}
+
+// Rotate makes key the active signing key. Previous keys are still accepted until retired.
+func (s *URLSigner) Rotate(key SigningKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append([]SigningKey{key}, s.keys...)
+}
+
+// Retire stops accepting URLs signed with the key id
+func (s *URLSigner) Retire(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.keys[:0]
+	for _, k := range s.keys {
+		if k.ID != id {
+			keys = append(keys, k)
+		}
+	}
+	s.keys = keys
+}
+
+// Sign returns the query parameters that authorise downloading the stored file name until expiry has passed
+func (s *URLSigner) Sign(name string, expiry time.Duration, singleUse bool) (url.Values, error) {
+	s.mu.Lock()
+	if len(s.keys) == 0 {
+		s.mu.Unlock()
+		return nil, errors.New("URLSigner has no signing keys")
+	}
+	key := s.keys[0]
+	expires := s.now().Add(expiry).Unix()
+	s.mu.Unlock()
+
+	q := url.Values{}
+	q.Set(ParamExpires, strconv.FormatInt(expires, 10))
+	q.Set(ParamKeyID, key.ID)
+	if singleUse {
+		q.Set(ParamSingleUse, "1")
+	}
+	q.Set(ParamSignature, signature(key, name, q))
+	return q, nil
+}
+
+// SignURL appends a signature for name to downloadURL
+func (s *URLSigner) SignURL(downloadURL, name string, expiry time.Duration, singleUse bool) (string, error) {
+	q, err := s.Sign(name, expiry, singleUse)
+	if err != nil {
+		return "", err
+	}
+	return downloadURL + "?" + q.Encode(), nil
+}
+
+// Verify checks the signature in query authorises downloading the stored file name. A single-use URL is
+// consumed by its first successful verification.
+func (s *URLSigner) Verify(name string, query url.Values) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(name, query); err != nil {
+		return err
+	}
+	return s.markUsed(query)
+}
+
+// Check is Verify without consuming a single-use URL, which is left to MarkUsed once the download goes ahead.
+// A single-use URL that has already been used fails with ErrSignatureUsed.
+func (s *URLSigner) Check(name string, query url.Values) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(name, query); err != nil {
+		return err
+	}
+	if _, ok := s.used[query.Get(ParamSignature)]; ok && query.Get(ParamSingleUse) != "" {
+		return ErrSignatureUsed
+	}
+	return nil
+}
+
+// MarkUsed consumes a single-use URL that passed Check, failing with ErrSignatureUsed if another request got
+// there first. It does nothing for other URLs.
+func (s *URLSigner) MarkUsed(query url.Values) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.markUsed(query)
+}
+
+func (s *URLSigner) check(name string, query url.Values) error {
+	now := s.now()
+	for sig, expires := range s.used {
+		if now.After(expires) {
+			delete(s.used, sig)
+		}
+	}
+
+	var key *SigningKey
+	for i := range s.keys {
+		if s.keys[i].ID == query.Get(ParamKeyID) {
+			key = &s.keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return ErrSignatureInvalid
+	}
+	if !hmac.Equal([]byte(query.Get(ParamSignature)), []byte(signature(*key, name, query))) {
+		return ErrSignatureInvalid
+	}
+	expires, err := strconv.ParseInt(query.Get(ParamExpires), 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	if now.After(time.Unix(expires, 0)) {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func (s *URLSigner) markUsed(query url.Values) error {
+	if query.Get(ParamSingleUse) == "" {
+		return nil
+	}
+	sig := query.Get(ParamSignature)
+	if _, ok := s.used[sig]; ok {
+		return ErrSignatureUsed
+	}
+	expires, _ := strconv.ParseInt(query.Get(ParamExpires), 10, 64)
+	s.used[sig] = time.Unix(expires, 0)
+	return nil
+}
+
+// signature covers the stored name and every signed parameter
+func signature(key SigningKey, name string, q url.Values) string {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(name + "\n" + q.Get(ParamExpires) + "\n" + q.Get(ParamKeyID) + "\n" + q.Get(ParamSingleUse)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	signer := NewURLSigner(SigningKey{ID: "k1", Secret: []byte("first secret")})
+	now := time.Unix(1600000000, 0)
+	signer.now = func() time.Time { return now }
+
+	q, err := signer.Sign("abc.csv", time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Verify("abc.csv", q); err != nil {
+		t.Error("Expected a valid signature. Got:", err)
+	}
+	if err := signer.Verify("abd.csv", q); err != ErrSignatureInvalid {
+		t.Error("Expected the signature to be bound to the name. Got:", err)
+	}
+
+	tampered := url.Values{}
+	for k, v := range q {
+		tampered[k] = v
+	}
+	tampered.Set(ParamExpires, "9999999999")
+	if err := signer.Verify("abc.csv", tampered); err != ErrSignatureInvalid {
+		t.Error("Expected a tampered expiry to be rejected. Got:", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if err := signer.Verify("abc.csv", q); err != ErrSignatureExpired {
+		t.Error("Expected the URL to have expired. Got:", err)
+	}
+}
+
+func TestURLSignerSingleUse(t *testing.T) {
+	signer := NewURLSigner(SigningKey{ID: "k1", Secret: []byte("secret")})
+	q, err := signer.Sign("abc.csv", time.Minute, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Verify("abc.csv", q); err != nil {
+		t.Fatal("Expected the first use to succeed. Got:", err)
+	}
+	if err := signer.Verify("abc.csv", q); err != ErrSignatureUsed {
+		t.Error("Expected the second use to fail. Got:", err)
+	}
+	q.Del(ParamSingleUse)
+	if err := signer.Verify("abc.csv", q); err != ErrSignatureInvalid {
+		t.Error("Expected dropping the single-use flag to break the signature. Got:", err)
+	}
+}
+
+func TestURLSignerCheckAndMarkUsed(t *testing.T) {
+	signer := NewURLSigner(SigningKey{ID: "k1", Secret: []byte("secret")})
+	q, _ := signer.Sign("abc.csv", time.Minute, true)
+	if err := signer.Check("abc.csv", q); err != nil {
+		t.Fatal("Expected the URL to check out. Got:", err)
+	}
+	if err := signer.Check("abc.csv", q); err != nil {
+		t.Error("Expected Check not to consume the URL. Got:", err)
+	}
+	if err := signer.MarkUsed(q); err != nil {
+		t.Error("Expected the first MarkUsed to succeed. Got:", err)
+	}
+	if err := signer.MarkUsed(q); err != ErrSignatureUsed {
+		t.Error("Expected a second MarkUsed to fail. Got:", err)
+	}
+	if err := signer.Check("abc.csv", q); err != ErrSignatureUsed {
+		t.Error("Expected Check to report the used URL. Got:", err)
+	}
+}
+
+func TestURLSignerRotation(t *testing.T) {
+	signer := NewURLSigner(SigningKey{ID: "old", Secret: []byte("old secret")})
+	before, err := signer.Sign("abc.csv", time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.Rotate(SigningKey{ID: "new", Secret: []byte("new secret")})
+	after, err := signer.Sign("abc.csv", time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Get(ParamKeyID) != "new" {
+		t.Error("Expected new URLs to be signed with the rotated key. Got:", after.Get(ParamKeyID))
+	}
+	if err := signer.Verify("abc.csv", before); err != nil {
+		t.Error("Expected URLs signed with the old key to keep working. Got:", err)
+	}
+	signer.Retire("old")
+	if err := signer.Verify("abc.csv", before); err != ErrSignatureInvalid {
+		t.Error("Expected URLs signed with a retired key to fail. Got:", err)
+	}
+	if err := signer.Verify("abc.csv", after); err != nil {
+		t.Error("Expected URLs signed with the new key to work. Got:", err)
+	}
+	if _, err := NewURLSigner().Sign("abc.csv", time.Minute, false); err == nil {
+		t.Error("Expected an error signing without keys.")
+	}
+}
+
+func TestSignedUploadAndDownload(t *testing.T) {
+	store := NewMemoryUploadStore()
+	signer := NewURLSigner(SigningKey{ID: "k1", Secret: []byte("secret")})
+	upload := GetUploadHandler(UploadHandlerSpec{
+		Store:         store,
+		DownloadURL:   "http://example.com/uploads/",
+		Signer:        signer,
+		SingleUseURLs: true,
+	})
+	download := http.StripPrefix("/uploads/", GetDownloadHandler(DownloadHandlerSpec{Store: store, Signer: signer}))
+
+	w := httptest.NewRecorder()
+	upload(w, multipartUpload(t, "report.csv", "text/csv", []byte("a,b,c\n")))
+	if w.Code != http.StatusOK {
+		t.Fatal("Upload failed:", w.Code, w.Body.String())
+	}
+	manifest := decodeManifest(t, w)
+	downloadURL, err := url.Parse(manifest.Files[0].DownloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if downloadURL.Query().Get(ParamSignature) == "" || downloadURL.Query().Get(ParamSingleUse) == "" {
+		t.Fatal("Expected a signed single-use download URL. Got:", downloadURL)
+	}
+
+	w = httptest.NewRecorder()
+	download.ServeHTTP(w, httptest.NewRequest("GET", "/uploads/"+manifest.Files[0].StoredName, nil))
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected 403 without a signature. Got:", w.Code)
+	}
+	if e := decodeErrorResponse(t, w); e.Reason != ReasonInvalidSignature {
+		t.Error("Unexpected reason:", e.Reason)
+	}
+
+	w = httptest.NewRecorder()
+	download.ServeHTTP(w, httptest.NewRequest("GET", downloadURL.RequestURI(), nil))
+	if w.Code != http.StatusOK || w.Body.String() != "a,b,c\n" {
+		t.Error("Expected the signed URL to download the file. Got:", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	download.ServeHTTP(w, httptest.NewRequest("GET", downloadURL.RequestURI(), nil))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), ErrSignatureUsed.Error()) {
+		t.Error("Expected the single-use URL to be refused the second time. Got:", w.Code, w.Body.String())
+	}
+
+	if _, err := store.Stat(context.Background(), manifest.Files[0].StoredName); err != nil {
+		t.Error("Expected the upload to remain in the store:", err)
+	}
+}
+
+func TestSignedDownloadSingleUse(t *testing.T) {
+	store := NewMemoryUploadStore()
+	store.Put(context.Background(), "abc-report.csv", strings.NewReader("0123456789"), nil)
+	signer := NewURLSigner(SigningKey{ID: "k1", Secret: []byte("secret")})
+	download := http.StripPrefix("/uploads/", GetDownloadHandler(DownloadHandlerSpec{Store: store, Signer: signer}))
+	serve := func(method, name string, q url.Values, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/uploads/"+name+"?"+q.Encode(), nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		download.ServeHTTP(w, req)
+		return w
+	}
+
+	missing, _ := signer.Sign("missing.csv", time.Minute, true)
+	if w := serve("GET", "missing.csv", missing, nil); w.Code != http.StatusNotFound {
+		t.Error("Expected 404. Got:", w.Code)
+	}
+	store.Put(context.Background(), "missing.csv", strings.NewReader("late"), nil)
+	if w := serve("GET", "missing.csv", missing, nil); w.Code != http.StatusOK {
+		t.Error("Expected a 404 not to use up the URL. Got:", w.Code)
+	}
+
+	q, _ := signer.Sign("abc-report.csv", time.Minute, true)
+	w := serve("HEAD", "abc-report.csv", q, nil)
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected HEAD to succeed. Got:", w.Code)
+	}
+	etag := w.Header().Get("ETag")
+	w = serve("GET", "abc-report.csv", q, map[string]string{"Range": "bytes=0-4"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "01234" {
+		t.Fatal("Expected HEAD not to use up the URL. Got:", w.Code, w.Body.String())
+	}
+	for _, headers := range []map[string]string{nil, {"Range": "bytes=5-"}, {"Range": "bytes=0-", "If-Range": etag}} {
+		if w := serve("GET", "abc-report.csv", q, headers); w.Code != http.StatusForbidden {
+			t.Errorf("Expected the used URL to be refused with %v. Got: %d", headers, w.Code)
+		}
+	}
+	if w := serve("HEAD", "abc-report.csv", q, nil); w.Code != http.StatusForbidden {
+		t.Error("Expected HEAD on the used URL to be refused. Got:", w.Code)
+	}
+}
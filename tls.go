@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSSpec captures the specification for serving, or calling, over TLS
+type TLSSpec struct {
+	CertFile string
+	KeyFile  string
+	// CAFile is a PEM bundle that peer certificates are verified against. On a server setting it turns on mTLS.
+	CAFile string
+	// ClientAuth defaults to tls.RequireAndVerifyClientCert when CAFile is set
+	ClientAuth tls.ClientAuthType
+	// MinVersion defaults to TLS 1.2
+	MinVersion uint16
+	// CipherSuites limits the TLS 1.2 cipher suites. TLS 1.3 suites are not configurable.
+	CipherSuites []uint16
+	// ReloadInterval is how often the files are checked for changes. Defaults to 30 seconds.
+	ReloadInterval time.Duration
+}
+
+// CertReloader holds a certificate and CA bundle loaded from files and reloads them when the files change, so
+// certificates can be renewed without restarting. A reload that fails keeps the previous certificate.
+type CertReloader struct {
+	spec TLSSpec
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	cas      *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// NewCertReloader loads the spec's files
+func NewCertReloader(spec TLSSpec) (*CertReloader, error) {
+	if spec.CertFile == "" || spec.KeyFile == "" {
+		return nil, errors.New("TLSSpec needs a CertFile and a KeyFile")
+	}
+	if spec.MinVersion == 0 {
+		spec.MinVersion = tls.VersionTLS12
+	}
+	if spec.ReloadInterval == 0 {
+		spec.ReloadInterval = 30 * time.Second
+	}
+	if spec.CAFile != "" && spec.ClientAuth == tls.NoClientCert {
+		spec.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	c := &CertReloader{spec: spec}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the files again if any of them changed since they were last loaded and reports whether it did
+func (c *CertReloader) Reload() (bool, error) {
+	files := []string{c.spec.CertFile, c.spec.KeyFile}
+	if c.spec.CAFile != "" {
+		files = append(files, c.spec.CAFile)
+	}
+	modTimes := make(map[string]time.Time)
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+		modTimes[f] = info.ModTime()
+	}
+	c.mu.RLock()
+	changed := false
+	for f, t := range modTimes {
+		if !t.Equal(c.modTimes[f]) {
+			changed = true
+		}
+	}
+	c.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.spec.CertFile, c.spec.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	var cas *x509.CertPool
+	if c.spec.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.spec.CAFile)
+		if err != nil {
+			return false, err
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificates found in %s", c.spec.CAFile)
+		}
+	}
+	c.mu.Lock()
+	c.cert, c.cas, c.modTimes = &cert, cas, modTimes
+	c.mu.Unlock()
+	return true, nil
+}
+
+// Watch checks the files every ReloadInterval until stop is closed
+func (c *CertReloader) Watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.spec.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := c.Reload()
+			if err != nil {
+				slog.Error("Could not reload TLS certificate, keeping the previous one", "error", err)
+			} else if reloaded {
+				slog.Info("Reloaded TLS certificate", "cert", c.spec.CertFile)
+			}
+		}
+	}
+}
+
+func (c *CertReloader) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, c.cas
+}
+
+// GetCertificate returns the current certificate, for use in a tls.Config
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := c.current()
+	return cert, nil
+}
+
+// ServerConfig returns a config for serving with the current certificate. Client certificates are verified
+// against the current CA bundle.
+func (c *CertReloader) ServerConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     c.spec.MinVersion,
+		CipherSuites:   c.spec.CipherSuites,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: c.GetCertificate,
+	}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		_, cas := c.current()
+		handshake := config.Clone()
+		handshake.GetConfigForClient = nil
+		handshake.ClientCAs = cas
+		handshake.ClientAuth = c.spec.ClientAuth
+		return handshake, nil
+	}
+	return config
+}
+
+// ClientConfig returns a config for calling mTLS servers. The current certificate is presented to servers, which
+// are verified against the CA bundle as loaded when ClientConfig is called.
+func (c *CertReloader) ClientConfig() *tls.Config {
+	_, cas := c.current()
+	return &tls.Config{
+		MinVersion:   c.spec.MinVersion,
+		CipherSuites: c.spec.CipherSuites,
+		RootCAs:      cas,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.GetCertificate(nil)
+		},
+	}
+}
+
+// ClientIdentity is the verified certificate a client presented over mTLS
+type ClientIdentity struct {
+	CommonName  string
+	DNSNames    []string
+	URIs        []string
+	Certificate *x509.Certificate
+}
+
+type clientIdentityKey struct{}
+
+// ClientIdentityFrom returns the identity ClientCertIdentity stored in the context
+func ClientIdentityFrom(ctx context.Context) (ClientIdentity, bool) {
+	id, ok := ctx.Value(clientIdentityKey{}).(ClientIdentity)
+	return id, ok
+}
+
+// ClientCertIdentity puts the identity of a verified client certificate in the request context. Server applies
+// it when serving TLS.
+func ClientCertIdentity(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		leaf := r.TLS.VerifiedChains[0][0]
+		id := ClientIdentity{CommonName: leaf.Subject.CommonName, DNSNames: leaf.DNSNames, Certificate: leaf}
+		for _, u := range leaf.URIs {
+			id.URIs = append(id.URIs, u.String())
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIdentityKey{}, id)))
+	})
+}
+
+// ClientCertAuthenticator authenticates requests by their verified client certificate. The principal's subject
+// is the certificate's first URI, such as a SPIFFE ID, or else its common name.
+func ClientCertAuthenticator() Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		id, ok := ClientIdentityFrom(r.Context())
+		if !ok {
+			return Principal{}, ErrNoCredentials
+		}
+		p := Principal{Method: AuthMethodClientCert, Subject: id.CommonName}
+		if len(id.URIs) > 0 {
+			p.Subject = id.URIs[0]
+		}
+		return p, nil
+	})
+}
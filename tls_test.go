@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for cn signed by the CA to dir and returns the cert and key file names
+func (ca *testCA) issue(t *testing.T, dir, cn string, serial int64, usage x509.ExtKeyUsage, uris ...string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	for _, u := range uris {
+		parsed, _ := url.Parse(u)
+		tmpl.URIs = append(tmpl.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func (ca *testCA) write(t *testing.T, dir string) string {
+	file := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(file, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// touch moves the modification time on so a reload notices files rewritten within the same clock tick
+func touch(files ...string) {
+	later := time.Now().Add(time.Minute)
+	for _, f := range files {
+		os.Chtimes(f, later, later)
+	}
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := ca.write(t, dir)
+	serverCert, serverKey := ca.issue(t, dir, "server", 2, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "svc-a", 3, x509.ExtKeyUsageClientAuth, "spiffe://test/svc-a")
+
+	handler := Authenticate(AuthSpec{Authenticators: []Authenticator{ClientCertAuthenticator()}})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, _ := ClientIdentityFrom(r.Context())
+			p, _ := PrincipalFrom(r.Context())
+			w.Write([]byte(id.CommonName + " " + p.Subject))
+		}))
+	srv := NewServer(ServerSpec{
+		Handler: handler,
+		TLS:     &TLSSpec{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile},
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	defer func() {
+		srv.Shutdown(context.Background())
+		<-served
+	}()
+	url := "https://" + l.Addr().String() + "/"
+
+	certs, err := NewCertReloader(TLSSpec{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: certs.ClientConfig()}}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "svc-a spiffe://test/svc-a" || resp.TLS.Version < tls.VersionTLS12 {
+		t.Error("Unexpected identity: ", string(body))
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if resp, err := anonymous.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("Expected clients without a certificate to be refused.")
+	}
+
+	other := newTestCA(t)
+	otherCert, otherKey := other.issue(t, t.TempDir(), "intruder", 4, x509.ExtKeyUsageClientAuth)
+	intruderCert, _ := tls.LoadX509KeyPair(otherCert, otherKey)
+	intruder := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{intruderCert}}}}
+	if resp, err := intruder.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("Expected certificates from another CA to be refused.")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "server", 10, x509.ExtKeyUsageServerAuth)
+	certs, err := NewCertReloader(TLSSpec{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		cert, _ := certs.GetCertificate(nil)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.SerialNumber.Int64()
+	}
+
+	if reloaded, err := certs.Reload(); reloaded || err != nil {
+		t.Error("Nothing changed, so nothing should be reloaded: ", err)
+	}
+	ca.issue(t, dir, "server", 11, x509.ExtKeyUsageServerAuth)
+	touch(certFile, keyFile)
+	if reloaded, err := certs.Reload(); !reloaded || err != nil || serial() != 11 {
+		t.Error("Expected the renewed certificate to be loaded: ", err, serial())
+	}
+
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0600)
+	touch(certFile)
+	if _, err := certs.Reload(); err == nil || serial() != 11 {
+		t.Error("Expected a broken certificate to be refused and the previous one kept: ", err, serial())
+	}
+
+	config := certs.ServerConfig()
+	handshake, _ := config.GetConfigForClient(&tls.ClientHelloInfo{})
+	if handshake.MinVersion != tls.VersionTLS12 || handshake.ClientAuth != tls.NoClientCert {
+		t.Error("Unexpected defaults: ", handshake.MinVersion, handshake.ClientAuth)
+	}
+	if _, err := NewCertReloader(TLSSpec{CertFile: certFile}); err == nil {
+		t.Error("Expected a spec without a key to be refused.")
+	}
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/arunsworld/go-service/tracing"
+)
+
+// TracingSpec captures the specification for Tracing
+type TracingSpec struct {
+	// Tracer starts the request spans. Defaults to tracing.Default().
+	Tracer *tracing.Tracer
+	// Router names each span after the matched route template such as "GET /files/{id}"
+	Router *mux.Router
+	// IgnoreIncomingTrace starts a new trace for every request instead of continuing the caller's traceparent.
+	// Set it on services exposed to untrusted clients.
+	IgnoreIncomingTrace bool
+}
+
+// Tracing starts a server span for every request, continuing the trace of an incoming W3C traceparent header.
+// The span is in the request context, so spans started from it, and calls made with an httpclient traced client,
+// join the trace. When used inside RequestLogger the request logger gains a trace_id.
+func Tracing(spec TracingSpec) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tracer := spec.Tracer
+			if tracer == nil {
+				tracer = tracing.Default()
+			}
+			ctx := r.Context()
+			if !spec.IgnoreIncomingTrace {
+				ctx = tracing.Extract(ctx, r.Header)
+			}
+			ctx, span := tracer.Start(ctx, r.Method, tracing.SpanKindServer)
+			defer span.End()
+			ctx = context.WithValue(ctx, loggerKey, Logger(ctx).With("trace_id", span.SpanContext().TraceID.String()))
+			span.SetAttribute("http.method", r.Method)
+			span.SetAttribute("http.target", r.URL.Path)
+			span.SetAttribute("net.peer.ip", remoteIP(r))
+			if id := RequestID(ctx); id != "" {
+				span.SetAttribute("request_id", id)
+			}
+
+			rec := newStatusRecorder(w)
+			h.ServeHTTP(rec, r.WithContext(ctx))
+
+			if route := routeTemplate(spec.Router, r); route != routeUnmatched {
+				span.SetName(r.Method + " " + route)
+				span.SetAttribute("http.route", route)
+			}
+			span.SetAttribute("http.status_code", rec.Status())
+			if rec.Status() >= http.StatusInternalServerError {
+				span.SetStatus(tracing.StatusError, fmt.Sprintf("status %d", rec.Status()))
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer(TracerSpec{ServiceName: "uploads", Exporter: NewJSONExporter(&buf)})
+	ctx, parent := tracer.Start(context.Background(), "parent", SpanKindServer)
+	_, child := Start(ctx, "child")
+	child.SetAttribute("db.rows", 3)
+	child.End()
+	parent.End()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Expected one line per span. Got: ", buf.String())
+	}
+	var span map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &span); err != nil {
+		t.Fatal(err)
+	}
+	if span["name"] != "child" || span["kind"] != "internal" || span["service"] != "uploads" || span["status"] != StatusUnset {
+		t.Error("Unexpected span: ", lines[0])
+	}
+	if span["parent_span_id"] != parent.SpanContext().SpanID.String() || span["attributes"].(map[string]interface{})["db.rows"] != 3.0 {
+		t.Error("Unexpected span: ", lines[0])
+	}
+}
+
+func TestMemoryExporter(t *testing.T) {
+	exporter := NewMemoryExporter()
+	ExporterFunc(exporter.ExportSpan).ExportSpan(SpanData{Name: "a"})
+	if spans := exporter.Spans(); len(spans) != 1 || spans[0].Name != "a" {
+		t.Error("Unexpected spans: ", spans)
+	}
+	exporter.Reset()
+	if len(exporter.Spans()) != 0 {
+		t.Error("Expected Reset to forget the spans.")
+	}
+}
@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+const exampleTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent(exampleTraceparent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Error("Unexpected span context: ", sc)
+	}
+	if sc.Traceparent() != exampleTraceparent {
+		t.Error("Expected the header to round trip. Got: ", sc.Traceparent())
+	}
+	if sc, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); err != nil || sc.Sampled {
+		t.Error("Expected a later version with extra fields to be accepted. Got: ", err)
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	}
+	for _, header := range invalid {
+		if _, err := ParseTraceparent(header); err != ErrInvalidTraceparent {
+			t.Errorf("%q: expected ErrInvalidTraceparent. Got: %v", header, err)
+		}
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	incoming := http.Header{}
+	incoming.Set(HeaderTraceparent, exampleTraceparent)
+	incoming.Set(HeaderTracestate, "vendor=abc")
+	ctx := Extract(context.Background(), incoming)
+	if sc := SpanContextFromContext(ctx); !sc.Remote || sc.TraceState != "vendor=abc" {
+		t.Fatal("Expected the remote span context. Got: ", sc)
+	}
+
+	ctx, span := NewTracer(TracerSpec{}).Start(ctx, "handler", SpanKindServer)
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	sc, err := ParseTraceparent(outgoing.Get(HeaderTraceparent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID != span.SpanContext().SpanID {
+		t.Error("Expected the local span to be sent downstream. Got: ", outgoing.Get(HeaderTraceparent))
+	}
+	if outgoing.Get(HeaderTracestate) != "vendor=abc" {
+		t.Error("Expected tracestate to be passed on. Got: ", outgoing.Get(HeaderTracestate))
+	}
+
+	none := http.Header{}
+	Inject(context.Background(), none)
+	if len(none) != 0 {
+		t.Error("Expected no headers outside a trace. Got: ", none)
+	}
+	bad := http.Header{}
+	bad.Set(HeaderTraceparent, "garbage")
+	if sc := SpanContextFromContext(Extract(context.Background(), bad)); sc.IsValid() {
+		t.Error("Expected an invalid traceparent to be ignored.")
+	}
+}
@@ -0,0 +1,359 @@
+// Package tracing records spans for requests, downstream calls, queries and file IO and propagates them
+// between services with W3C Trace Context (traceparent) headers. Finished spans go to an Exporter.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a whole trace across services
+type TraceID [16]byte
+
+// IsValid reports whether t is not all zeros
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a single span within a trace
+type SpanID [8]byte
+
+// IsValid reports whether s is not all zeros
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext is the part of a span that crosses process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	// TraceState is the vendor specific tracestate header, passed on untouched
+	TraceState string
+	// Remote is set on span contexts extracted from an incoming request
+	Remote bool
+}
+
+// IsValid reports whether both IDs are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// SpanKind says what part a span plays in a call between services
+type SpanKind int
+
+// Span kinds
+const (
+	SpanKindInternal SpanKind = iota
+	SpanKindServer
+	SpanKindClient
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindServer:
+		return "server"
+	case SpanKindClient:
+		return "client"
+	}
+	return "internal"
+}
+
+// MarshalText writes the kind by name in exported spans
+func (k SpanKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Span status values in SpanData
+const (
+	StatusUnset = "unset"
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// SpanData is a finished span as handed to the Exporter
+type SpanData struct {
+	Service      string                 `json:"service,omitempty"`
+	Name         string                 `json:"name"`
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Kind         SpanKind               `json:"kind"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	DurationMS   float64                `json:"duration_ms"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Status       string                 `json:"status"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// Span is an operation being timed. All methods are safe on a nil *Span, which records nothing.
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+	parent SpanID
+	kind   SpanKind
+	start  time.Time
+
+	mu     sync.Mutex
+	name   string
+	attrs  map[string]interface{}
+	status string
+	err    string
+	ended  bool
+}
+
+// SpanContext returns the IDs to propagate to child spans and downstream services
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetName renames the span, e.g. once the route of a request is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetAttribute records a key and value on the span. Values should be strings, numbers or booleans.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// RecordError marks the span as failed. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.err = StatusError, err.Error()
+}
+
+// SetStatus sets the span status to StatusOK or StatusError with a description
+func (s *Span) SetStatus(status, description string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.err = status, description
+}
+
+// End finishes the span and exports it if it is sampled. Calls after the first are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	end := s.tracer.now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	// The exporter may keep the attributes, and SetAttribute may still be called after End
+	var attrs map[string]interface{}
+	if len(s.attrs) > 0 {
+		attrs = make(map[string]interface{}, len(s.attrs))
+		for k, v := range s.attrs {
+			attrs[k] = v
+		}
+	}
+	data := SpanData{
+		Service:    s.tracer.spec.ServiceName,
+		Name:       s.name,
+		TraceID:    s.sc.TraceID.String(),
+		SpanID:     s.sc.SpanID.String(),
+		Kind:       s.kind,
+		Start:      s.start,
+		End:        end,
+		DurationMS: float64(end.Sub(s.start)) / float64(time.Millisecond),
+		Attributes: attrs,
+		Status:     s.status,
+		Error:      s.err,
+	}
+	s.mu.Unlock()
+	if s.parent.IsValid() {
+		data.ParentSpanID = s.parent.String()
+	}
+	if data.Status == "" {
+		data.Status = StatusUnset
+	}
+	if s.sc.Sampled && s.tracer.spec.Exporter != nil {
+		s.tracer.spec.Exporter.ExportSpan(data)
+	}
+}
+
+// Sampler decides whether a new trace is recorded. Child spans follow the decision of their parent.
+type Sampler func(TraceID) bool
+
+// AlwaysSample records every trace
+func AlwaysSample(TraceID) bool {
+	return true
+}
+
+// RatioSampler records about ratio of traces, 0 to 1, deciding on the trace ID so every service sampling at
+// the same ratio agrees
+func RatioSampler(ratio float64) Sampler {
+	bound := uint64(ratio * (1 << 63))
+	return func(id TraceID) bool {
+		if ratio >= 1 {
+			return true
+		}
+		return binary.BigEndian.Uint64(id[8:])>>1 < bound
+	}
+}
+
+// TracerSpec captures the specification for a Tracer
+type TracerSpec struct {
+	// ServiceName is recorded on every span
+	ServiceName string
+	// Exporter receives finished spans. Without one spans are still propagated but not recorded.
+	Exporter Exporter
+	// Sampler defaults to AlwaysSample
+	Sampler Sampler
+}
+
+// Tracer starts spans
+type Tracer struct {
+	spec TracerSpec
+	now  func() time.Time
+}
+
+// NewTracer returns a Tracer per the spec
+func NewTracer(spec TracerSpec) *Tracer {
+	if spec.Sampler == nil {
+		spec.Sampler = AlwaysSample
+	}
+	return &Tracer{spec: spec, now: time.Now}
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultTracer = NewTracer(TracerSpec{})
+)
+
+// SetDefault sets the Tracer used by Start when the context carries no span
+func SetDefault(t *Tracer) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultTracer = t
+}
+
+// Default returns the Tracer set with SetDefault, which exports nothing until one is set
+func Default() *Tracer {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultTracer
+}
+
+// Start starts an internal span as a child of the span in ctx, using that span's Tracer or else the Default.
+// Library code uses it so its spans join whatever trace the caller is in.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return TracerFromContext(ctx).Start(ctx, name, SpanKindInternal)
+}
+
+// TracerFromContext returns the Tracer of the span in ctx, or the Default outside a trace
+func TracerFromContext(ctx context.Context) *Tracer {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.tracer
+	}
+	return Default()
+}
+
+// Start starts a span as a child of the span or remote span context in ctx, or as the root of a new trace.
+// The returned context carries the span; call End on it when the operation finishes.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	s := &Span{tracer: t, name: name, kind: kind, start: t.now()}
+	parent := SpanContextFromContext(ctx)
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+		s.sc.TraceState = parent.TraceState
+		s.parent = parent.SpanID
+	} else {
+		s.sc.TraceID = newTraceID()
+		s.sc.Sampled = t.spec.Sampler(s.sc.TraceID)
+	}
+	s.sc.SpanID = newSpanID()
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		randomFill(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		randomFill(id[:])
+	}
+	return id
+}
+
+func randomFill(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("tracing: unable to generate an ID: %v", err))
+	}
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// SpanFromContext returns the span started in ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+// ContextWithRemoteSpanContext makes spans started from ctx children of a span in another service
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// SpanContextFromContext returns the span context of the span in ctx, or the remote one if no span has been
+// started locally
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.sc
+	}
+	sc, _ := ctx.Value(remoteKey).(SpanContext)
+	return sc
+}
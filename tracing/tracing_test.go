@@ -0,0 +1,93 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSpanParenting(t *testing.T) {
+	exporter := NewMemoryExporter()
+	tracer := NewTracer(TracerSpec{ServiceName: "uploads", Exporter: exporter})
+
+	ctx, root := tracer.Start(context.Background(), "GET /upload", SpanKindServer)
+	childCtx, child := Start(ctx, "upload.store")
+	child.SetAttribute("file.bytes", 42)
+	child.RecordError(errors.New("disk full"))
+	if SpanFromContext(childCtx) != child || TracerFromContext(childCtx) != tracer {
+		t.Error("Expected the child span and its tracer in the context.")
+	}
+	child.End()
+	child.End()
+	root.SetName("POST /upload")
+	root.End()
+
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatal("Expected each span to be exported once. Got: ", len(spans))
+	}
+	c, r := spans[0], spans[1]
+	if c.TraceID != r.TraceID || c.ParentSpanID != r.SpanID || r.ParentSpanID != "" {
+		t.Errorf("Expected the child in the root's trace: %+v %+v", c, r)
+	}
+	if c.Kind != SpanKindInternal || r.Kind != SpanKindServer || r.Name != "POST /upload" || r.Service != "uploads" {
+		t.Errorf("Unexpected spans: %+v %+v", c, r)
+	}
+	if c.Status != StatusError || c.Error != "disk full" || c.Attributes["file.bytes"] != 42 || r.Status != StatusUnset {
+		t.Errorf("Unexpected span status or attributes: %+v %+v", c, r)
+	}
+	if c.End.Before(c.Start) || c.DurationMS < 0 {
+		t.Error("Unexpected span timing: ", c.Start, c.End)
+	}
+	child.SetAttribute("file.bytes", 7)
+	if exporter.Spans()[0].Attributes["file.bytes"] != 42 {
+		t.Error("Expected the exported attributes not to change after End.")
+	}
+
+	var nilSpan *Span
+	nilSpan.SetAttribute("ignored", true)
+	nilSpan.End()
+}
+
+func TestDefaultTracer(t *testing.T) {
+	exporter := NewMemoryExporter()
+	previous := Default()
+	SetDefault(NewTracer(TracerSpec{Exporter: exporter}))
+	defer SetDefault(previous)
+
+	_, span := Start(context.Background(), "background job")
+	span.End()
+	if spans := exporter.Spans(); len(spans) != 1 || spans[0].Name != "background job" {
+		t.Error("Expected a root span from the default tracer. Got: ", spans)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	exporter := NewMemoryExporter()
+	never := NewTracer(TracerSpec{Exporter: exporter, Sampler: RatioSampler(0)})
+	ctx, root := never.Start(context.Background(), "root", SpanKindServer)
+	_, child := Start(ctx, "child")
+	child.End()
+	root.End()
+	if len(exporter.Spans()) != 0 || root.SpanContext().Sampled {
+		t.Error("Expected an unsampled trace to export nothing.")
+	}
+
+	remote := ContextWithRemoteSpanContext(context.Background(), SpanContext{TraceID: TraceID{1}, SpanID: SpanID{2}, Sampled: true})
+	_, span := never.Start(remote, "continued", SpanKindServer)
+	span.End()
+	if len(exporter.Spans()) != 1 {
+		t.Error("Expected the caller's sampling decision to be followed.")
+	}
+
+	sampler := RatioSampler(0.5)
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if sampler(newTraceID()) {
+			sampled++
+		}
+	}
+	if sampled < 400 || sampled > 600 {
+		t.Error("Expected about half the traces to be sampled. Got: ", sampled)
+	}
+}
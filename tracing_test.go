@@ -0,0 +1,103 @@
+package service
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/arunsworld/go-service/tracing"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracing.NewMemoryExporter()
+	tracer := tracing.NewTracer(tracing.TracerSpec{Exporter: exporter})
+	var logs bytes.Buffer
+	router := mux.NewRouter()
+	router.HandleFunc("/reports/{id}", func(w http.ResponseWriter, r *http.Request) {
+		Logger(r.Context()).Info("building report")
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	h := Chain(router,
+		RequestLogger(LoggingSpec{Logger: NewJSONLogger(&logs), Router: router}),
+		Tracing(TracingSpec{Tracer: tracer, Router: router}),
+	)
+
+	req := httptest.NewRequest("GET", "/reports/7", nil)
+	req.Header.Set(tracing.HeaderTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatal("Expected a server span. Got: ", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "GET /reports/{id}" || span.Kind != tracing.SpanKindServer || span.Status != tracing.StatusError {
+		t.Errorf("Unexpected span: %+v", span)
+	}
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Expected the incoming trace to be continued: %+v", span)
+	}
+	if span.Attributes["http.status_code"] != http.StatusInternalServerError || span.Attributes["request_id"] == nil {
+		t.Errorf("Unexpected span attributes: %+v", span.Attributes)
+	}
+	if !strings.Contains(logs.String(), `"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"`) {
+		t.Error("Expected the handler's log line to carry the trace ID: ", logs.String())
+	}
+
+	exporter.Reset()
+	Tracing(TracingSpec{Tracer: tracer, IgnoreIncomingTrace: true})(router).ServeHTTP(httptest.NewRecorder(), req)
+	if spans := exporter.Spans(); len(spans) != 1 || spans[0].TraceID == "4bf92f3577b34da6a3ce929d0e0e4736" || spans[0].ParentSpanID != "" {
+		t.Errorf("Expected a new trace: %+v", spans)
+	}
+}
+
+func TestTracingAcrossServices(t *testing.T) {
+	exporter := tracing.NewMemoryExporter()
+	tracer := tracing.NewTracer(tracing.TracerSpec{Exporter: exporter})
+	uploads := httptest.NewServer(Tracing(TracingSpec{Tracer: tracer})(GetUploadHandler(UploadHandlerSpec{Store: NewMemoryUploadStore()})))
+	defer uploads.Close()
+	front := Tracing(TracingSpec{Tracer: tracer})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := FileUploaderClientContext(r.Context(), UploadClientSpec{
+			URL:      uploads.URL,
+			Content:  strings.NewReader("report"),
+			Filename: "report.txt",
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	front.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/reports", nil))
+
+	spans := exporter.Spans()
+	if len(spans) != 4 {
+		t.Fatal("Expected four spans. Got: ", spans)
+	}
+	var store, uploadServer, client, frontServer tracing.SpanData
+	for _, span := range spans {
+		switch {
+		case span.Kind == tracing.SpanKindClient:
+			client = span
+		case span.Name == "upload.store":
+			store = span
+		case span.ParentSpanID == "":
+			frontServer = span
+		default:
+			uploadServer = span
+		}
+	}
+	for _, span := range spans {
+		if span.TraceID != frontServer.TraceID {
+			t.Errorf("Expected a single trace: %+v", span)
+		}
+	}
+	if client.ParentSpanID != frontServer.SpanID || uploadServer.ParentSpanID != client.SpanID || store.ParentSpanID != uploadServer.SpanID {
+		t.Errorf("Expected each span to be a child of the one before: %+v", spans)
+	}
+	if store.Attributes["file.bytes"] != int64(len("report")) {
+		t.Errorf("Unexpected upload span: %+v", store)
+	}
+}
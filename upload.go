@@ -0,0 +1,353 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+
+	"github.com/arunsworld/go-service/tracing"
+)
+
+// Reasons reported in the ErrorResponse when an upload is rejected
+const (
+	ReasonTooLarge              = "too_large"
+	ReasonContentTypeNotAllowed = "content_type_not_allowed"
+	ReasonExtensionNotAllowed   = "extension_not_allowed"
+)
+
+// sniffLen is the number of bytes http.DetectContentType considers
+const sniffLen = 512
+
+// UploadHandlerSpec captures the specification for the upload
+type UploadHandlerSpec struct {
+	// Param is the form field files are accepted from; file parts in other fields are ignored. Defaults to "file".
+	Param string
+	// AnyField accepts file parts from every form field instead, ignoring Param
+	AnyField       bool
+	UploadLocation string
+	DownloadURL    string
+	// Store is where uploaded files go. Defaults to a LocalUploadStore over UploadLocation.
+	Store UploadStore
+	// MaxBytes limits the size of the whole request body. Zero means no limit.
+	MaxBytes int64
+	// AllowedContentTypes restricts uploads by the content type sniffed from the first bytes of the file,
+	// e.g. "image/png" or "image/*". The Content-Type sent by the client is not trusted.
+	AllowedContentTypes []string
+	// AllowedExtensions restricts uploads by file extension, e.g. ".csv". Matching ignores case.
+	AllowedExtensions []string
+	// FilenamePolicy controls how the client-supplied filename is cleaned before it is used
+	FilenamePolicy FilenamePolicy
+	// Signer, when set, makes every DownloadURL a signed link that expires after URLExpiry (default one hour).
+	// Give the same signer to the DownloadHandlerSpec.
+	Signer    *URLSigner
+	URLExpiry time.Duration
+	// SingleUseURLs makes signed download URLs valid for one download only
+	SingleUseURLs bool
+	// Scanner, when set, inspects every stored file before its download URL is returned. Files it flags are
+	// moved to Quarantine, or deleted when Quarantine is nil, and the client gets a 422. If moving a file to
+	// Quarantine fails it is kept in Store and the client gets a 503.
+	Scanner    Scanner
+	Quarantine UploadStore
+	// Metrics, when set, records the files and bytes stored and the uploads refused
+	Metrics *Metrics
+}
+
+// UploadedFile describes one stored file in the UploadManifest
+type UploadedFile struct {
+	Field        string `json:"field"`
+	OriginalName string `json:"original_name"`
+	StoredName   string `json:"stored_name"`
+	Size         int64  `json:"size"`
+	ContentType  string `json:"content_type"`
+	SHA256       string `json:"sha256"`
+	DownloadURL  string `json:"download_url"`
+}
+
+// UploadManifest is the JSON body GetUploadHandler replies with
+type UploadManifest struct {
+	Files []UploadedFile `json:"files"`
+}
+
+// internalUploadError reports a failure the client cannot act upon. Only rejections the client can fix carry
+// a reason, which also labels them in the Metrics.
+func internalUploadError(err error) *HTTPError {
+	return &HTTPError{Status: http.StatusInternalServerError, Err: err}
+}
+
+func tooLargeUploadError(limit int64) *HTTPError {
+	return NewHTTPError(http.StatusRequestEntityTooLarge, ReasonTooLarge, fmt.Sprintf("uploads are limited to %d bytes", limit))
+}
+
+func badUploadRequest(message string, err error) *HTTPError {
+	return &HTTPError{Status: http.StatusBadRequest, Reason: ReasonBadRequest, Message: message, Err: err}
+}
+
+// GetUploadHandler gets an upload handler based on the spec. Every file part of the multipart request is
+// streamed to the store and the handler replies with an UploadManifest. If any file is refused, the files
+// already stored for the request are removed again.
+func GetUploadHandler(spec UploadHandlerSpec) http.HandlerFunc {
+	spec = spec.withDefaults()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if spec.MaxBytes > 0 {
+			if r.ContentLength > spec.MaxBytes {
+				spec.Metrics.uploadFailed(ReasonTooLarge)
+				WriteError(w, r, tooLargeUploadError(spec.MaxBytes))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, spec.MaxBytes)
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			spec.Metrics.uploadFailed(ReasonBadRequest)
+			Logger(r.Context()).Warn("Bad request being sent to UploadHandler", "error", err)
+			WriteError(w, r, badUploadRequest("the request must be a multipart form upload", err))
+			return
+		}
+		manifest := UploadManifest{Files: []UploadedFile{}}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				spec.discard(r.Context(), manifest.Files)
+				if isTooLarge(err) {
+					spec.Metrics.uploadFailed(ReasonTooLarge)
+					WriteError(w, r, tooLargeUploadError(spec.MaxBytes))
+					return
+				}
+				spec.Metrics.uploadFailed(ReasonBadRequest)
+				Logger(r.Context()).Warn("Bad request being sent to UploadHandler", "error", err)
+				WriteError(w, r, badUploadRequest("the multipart body is malformed", err))
+				return
+			}
+			if part.FileName() == "" || (!spec.AnyField && part.FormName() != spec.Param) {
+				part.Close()
+				continue
+			}
+			file, uploadErr := spec.store(r.Context(), part.FormName(), rawPartFilename(part), &partReader{Reader: part})
+			part.Close()
+			if uploadErr != nil {
+				spec.discard(r.Context(), manifest.Files)
+				WriteError(w, r, uploadErr)
+				return
+			}
+			manifest.Files = append(manifest.Files, file)
+		}
+		if len(manifest.Files) == 0 {
+			spec.Metrics.uploadFailed(ReasonBadRequest)
+			Logger(r.Context()).Warn("Bad request being sent to UploadHandler", "error", "no files in request")
+			WriteError(w, r, badUploadRequest("no files found in request", nil))
+			return
+		}
+		WriteJSON(w, http.StatusOK, manifest)
+	}
+}
+
+func (spec UploadHandlerSpec) withDefaults() UploadHandlerSpec {
+	if spec.Param == "" {
+		spec.Param = "file"
+	}
+	if spec.UploadLocation == "" {
+		spec.UploadLocation = "/tmp/"
+	}
+	if spec.DownloadURL == "" {
+		spec.DownloadURL = "http://localhost/uploads/"
+	}
+	if spec.Store == nil {
+		spec.Store = NewLocalUploadStore(spec.UploadLocation)
+	}
+	if spec.URLExpiry == 0 {
+		spec.URLExpiry = time.Hour
+	}
+	return spec
+}
+
+// store checks a single file against the spec and streams it to the store, recording the outcome in the Metrics
+func (spec UploadHandlerSpec) store(ctx context.Context, field, rawName string, r io.Reader) (UploadedFile, *HTTPError) {
+	file, uploadErr := spec.storeFile(ctx, field, rawName, r)
+	if uploadErr != nil {
+		spec.Metrics.uploadFailed(uploadErr.Reason)
+		return file, uploadErr
+	}
+	spec.Metrics.uploadStored(file.Size)
+	return file, nil
+}
+
+func (spec UploadHandlerSpec) storeFile(ctx context.Context, field, rawName string, r io.Reader) (UploadedFile, *HTTPError) {
+	filename, err := spec.FilenamePolicy.Clean(rawName)
+	if err != nil {
+		return UploadedFile{}, NewHTTPError(http.StatusBadRequest, ReasonInvalidFilename, fmt.Sprintf("the filename %q cannot be accepted", rawName))
+	}
+	if !extensionAllowed(filename, spec.AllowedExtensions) {
+		return UploadedFile{}, NewHTTPError(http.StatusUnsupportedMediaType, ReasonExtensionNotAllowed, fmt.Sprintf("files with extension %q are not accepted", filepath.Ext(filename)))
+	}
+	content, contentType, err := sniffContentType(r)
+	if err != nil {
+		if isTooLarge(err) {
+			return UploadedFile{}, tooLargeUploadError(spec.MaxBytes)
+		}
+		if badRequest := partReadError(r); badRequest != nil {
+			return UploadedFile{}, badRequest
+		}
+		return UploadedFile{}, internalUploadError(err)
+	}
+	if !contentTypeAllowed(contentType, spec.AllowedContentTypes) {
+		return UploadedFile{}, NewHTTPError(http.StatusUnsupportedMediaType, ReasonContentTypeNotAllowed, fmt.Sprintf("files of type %q are not accepted", contentType))
+	}
+	u, err := uuid.NewV4()
+	if err != nil {
+		return UploadedFile{}, internalUploadError(err)
+	}
+	newFilename := u.String()
+	if !spec.FilenamePolicy.UUIDOnly {
+		newFilename += filename
+	}
+	metadata := map[string]string{
+		MetaOriginalName: filename,
+		MetaContentType:  contentType,
+	}
+	hash := sha256.New()
+	putCtx, span := tracing.Start(ctx, "upload.store")
+	span.SetAttribute("upload.name", newFilename)
+	info, err := spec.Store.Put(putCtx, newFilename, io.TeeReader(content, hash), metadata)
+	span.SetAttribute("file.bytes", info.Size)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		spec.Store.Delete(ctx, newFilename)
+		if isTooLarge(err) {
+			return UploadedFile{}, tooLargeUploadError(spec.MaxBytes)
+		}
+		if badRequest := partReadError(r); badRequest != nil {
+			return UploadedFile{}, badRequest
+		}
+		Logger(ctx).Error("Unable to store upload", "name", newFilename, "error", err)
+		return UploadedFile{}, internalUploadError(err)
+	}
+	if spec.Scanner != nil {
+		if scanErr := spec.scan(ctx, newFilename); scanErr != nil {
+			return UploadedFile{}, scanErr
+		}
+	}
+	escapedName := url.PathEscape(newFilename)
+	downloadURL := spec.DownloadURL + escapedName
+	if spec.Signer != nil {
+		downloadURL, err = spec.Signer.SignURL(downloadURL, escapedName, spec.URLExpiry, spec.SingleUseURLs)
+		if err != nil {
+			spec.Store.Delete(ctx, newFilename)
+			return UploadedFile{}, internalUploadError(err)
+		}
+	}
+	return UploadedFile{
+		Field:        field,
+		OriginalName: filename,
+		StoredName:   newFilename,
+		Size:         info.Size,
+		ContentType:  contentType,
+		SHA256:       hex.EncodeToString(hash.Sum(nil)),
+		DownloadURL:  downloadURL,
+	}, nil
+}
+
+// discard removes files stored earlier in a request that was refused
+func (spec UploadHandlerSpec) discard(ctx context.Context, files []UploadedFile) {
+	for _, f := range files {
+		if err := spec.Store.Delete(ctx, f.StoredName); err != nil {
+			Logger(ctx).Error("Unable to remove upload", "name", f.StoredName, "error", err)
+		}
+	}
+}
+
+// sniffContentType detects the content type from the first bytes of r and returns a reader that
+// still yields the full content
+func sniffContentType(r io.Reader) (io.Reader, string, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, "", err
+	}
+	head = head[:n]
+	contentType := "application/octet-stream"
+	if n > 0 {
+		contentType = http.DetectContentType(head)
+	}
+	return io.MultiReader(bytes.NewReader(head), r), contentType, nil
+}
+
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		switch {
+		case a == "*/*", a == mediaType:
+			return true
+		case strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(a, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+func extensionAllowed(filename string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if !strings.HasPrefix(a, ".") {
+			a = "." + a
+		}
+		if a == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// partReader remembers why reading a multipart file part failed, so a body the client cut short or
+// malformed is not mistaken for a failing store
+type partReader struct {
+	io.Reader
+	err error
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	return n, err
+}
+
+// partReadError returns a bad request error if r is a request part that could not be read
+func partReadError(r io.Reader) *HTTPError {
+	if p, ok := r.(*partReader); ok && p.err != nil {
+		return badUploadRequest("the multipart body is malformed", p.err)
+	}
+	return nil
+}
+
+func isTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
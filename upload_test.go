@@ -0,0 +1,330 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"testing"
+)
+
+var pngHeader = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+
+// multipartUpload builds a request carrying a single file in the "file" field
+func multipartUpload(t *testing.T, filename, contentType string, content []byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="file"; filename="`+filename+`"`)
+	h.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func decodeErrorResponse(t *testing.T, w *httptest.ResponseRecorder) ErrorResponse {
+	var resp ErrorResponse
+	if ct := w.Header().Get("Content-Type"); ct != ContentTypeProblem {
+		t.Error("Expected a problem+json error body. Got Content-Type:", ct)
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal("Could not decode error response:", err)
+	}
+	return resp
+}
+
+func decodeManifest(t *testing.T, w *httptest.ResponseRecorder) UploadManifest {
+	var manifest UploadManifest
+	if err := json.NewDecoder(w.Body).Decode(&manifest); err != nil {
+		t.Fatal("Could not decode manifest:", err)
+	}
+	if len(manifest.Files) == 0 {
+		t.Fatal("Manifest has no files.")
+	}
+	return manifest
+}
+
+func TestUploadHandlerLimits(t *testing.T) {
+	t.Run("Declared length over MaxBytes", func(t *testing.T) {
+		store := NewMemoryUploadStore()
+		handler := GetUploadHandler(UploadHandlerSpec{Store: store, MaxBytes: 100})
+		w := httptest.NewRecorder()
+		handler(w, multipartUpload(t, "big.txt", "text/plain", bytes.Repeat([]byte("a"), 200)))
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatal("Expected 413. Got:", w.Code)
+		}
+		if resp := decodeErrorResponse(t, w); resp.Reason != ReasonTooLarge || resp.Status != 413 {
+			t.Error("Unexpected error body:", resp)
+		}
+	})
+
+	t.Run("Streamed body over MaxBytes", func(t *testing.T) {
+		store := NewMemoryUploadStore()
+		handler := GetUploadHandler(UploadHandlerSpec{Store: store, MaxBytes: 1000})
+		req := multipartUpload(t, "big.txt", "text/plain", bytes.Repeat([]byte("a"), 5000))
+		req.ContentLength = -1
+		req.Body = ioutil.NopCloser(io.MultiReader(req.Body))
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatal("Expected 413. Got:", w.Code)
+		}
+		if len(store.objects) != 0 {
+			t.Error("Partial upload was left in the store.")
+		}
+	})
+
+	t.Run("Within MaxBytes", func(t *testing.T) {
+		handler := GetUploadHandler(UploadHandlerSpec{Store: NewMemoryUploadStore(), MaxBytes: 1000})
+		w := httptest.NewRecorder()
+		handler(w, multipartUpload(t, "small.txt", "text/plain", []byte("small")))
+		if w.Code != http.StatusOK {
+			t.Error("Expected 200. Got:", w.Code)
+		}
+	})
+}
+
+func TestUploadHandlerAllowLists(t *testing.T) {
+	spec := UploadHandlerSpec{
+		AllowedContentTypes: []string{"image/*"},
+		AllowedExtensions:   []string{"png", ".JPG"},
+	}
+
+	t.Run("Extension not allowed", func(t *testing.T) {
+		spec.Store = NewMemoryUploadStore()
+		w := httptest.NewRecorder()
+		GetUploadHandler(spec)(w, multipartUpload(t, "script.sh", "image/png", pngHeader))
+
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Fatal("Expected 415. Got:", w.Code)
+		}
+		if resp := decodeErrorResponse(t, w); resp.Reason != ReasonExtensionNotAllowed {
+			t.Error("Unexpected reason:", resp.Reason)
+		}
+	})
+
+	t.Run("Declared content type is not trusted", func(t *testing.T) {
+		spec.Store = NewMemoryUploadStore()
+		w := httptest.NewRecorder()
+		GetUploadHandler(spec)(w, multipartUpload(t, "fake.png", "image/png", []byte("#!/bin/sh\nrm -rf /\n")))
+
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Fatal("Expected 415. Got:", w.Code)
+		}
+		if resp := decodeErrorResponse(t, w); resp.Reason != ReasonContentTypeNotAllowed {
+			t.Error("Unexpected reason:", resp.Reason)
+		}
+	})
+
+	t.Run("Sniffed content type and extension allowed", func(t *testing.T) {
+		store := NewMemoryUploadStore()
+		spec.Store = store
+		w := httptest.NewRecorder()
+		GetUploadHandler(spec)(w, multipartUpload(t, "photo.Png", "application/octet-stream", pngHeader))
+
+		if w.Code != http.StatusOK {
+			t.Fatal("Expected 200. Got:", w.Code, w.Body.String())
+		}
+		name := decodeManifest(t, w).Files[0].StoredName
+		info, err := store.Stat(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Metadata[MetaContentType] != "image/png" {
+			t.Error("Expected sniffed content type to be recorded. Got:", info.Metadata[MetaContentType])
+		}
+	})
+}
+
+func TestUploadHandlerMultipleFiles(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	files := []struct{ field, name, content string }{
+		{"documents", "a.txt", "first document"},
+		{"documents", "b.txt", "second document"},
+		{"attachment", "c.png", string(pngHeader)},
+	}
+	for _, f := range files {
+		part, err := writer.CreateFormFile(f.field, f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(f.content))
+	}
+	writer.WriteField("comment", "not a file")
+	writer.Close()
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	store := NewMemoryUploadStore()
+	w := httptest.NewRecorder()
+	GetUploadHandler(UploadHandlerSpec{Store: store, DownloadURL: "http://abc.com/uploads/", AnyField: true})(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected 200. Got:", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Error("Expected a JSON manifest. Got Content-Type:", ct)
+	}
+	manifest := decodeManifest(t, w)
+	if len(manifest.Files) != len(files) {
+		t.Fatalf("Expected %d files in the manifest. Got %d.", len(files), len(manifest.Files))
+	}
+	for i, f := range files {
+		got := manifest.Files[i]
+		sum := sha256.Sum256([]byte(f.content))
+		if got.Field != f.field || got.OriginalName != f.name || got.Size != int64(len(f.content)) {
+			t.Errorf("Unexpected manifest entry %d: %+v", i, got)
+		}
+		if got.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("Wrong SHA-256 for %s: %s", f.name, got.SHA256)
+		}
+		if got.DownloadURL != "http://abc.com/uploads/"+got.StoredName {
+			t.Errorf("Wrong download URL for %s: %s", f.name, got.DownloadURL)
+		}
+		rc, _, err := store.Get(context.Background(), got.StoredName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if string(content) != f.content {
+			t.Errorf("Stored content for %s did not match.", f.name)
+		}
+	}
+	if manifest.Files[2].ContentType != "image/png" {
+		t.Error("Expected the sniffed content type in the manifest. Got:", manifest.Files[2].ContentType)
+	}
+
+	t.Run("Param restricts the accepted field", func(t *testing.T) {
+		store := NewMemoryUploadStore()
+		w := httptest.NewRecorder()
+		GetUploadHandler(UploadHandlerSpec{Store: store, Param: "file"})(w, multipartUpload(t, "a.txt", "text/plain", []byte("a")))
+		if len(decodeManifest(t, w).Files) != 1 {
+			t.Error("Expected the file in the \"file\" field to be accepted.")
+		}
+	})
+
+	t.Run("Only the file field is accepted by default", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("documents", "a.txt")
+		part.Write([]byte("ignored"))
+		part, _ = writer.CreateFormFile("file", "b.txt")
+		part.Write([]byte("accepted"))
+		writer.Close()
+		req := httptest.NewRequest("POST", "/", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+
+		store := NewMemoryUploadStore()
+		w := httptest.NewRecorder()
+		GetUploadHandler(UploadHandlerSpec{Store: store})(w, req)
+		if files := decodeManifest(t, w).Files; len(files) != 1 || files[0].OriginalName != "b.txt" || len(store.objects) != 1 {
+			t.Error("Expected only the file in the \"file\" field to be accepted. Got:", files)
+		}
+	})
+
+	t.Run("A rejected file discards the whole request", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("documents", "ok.png")
+		part.Write(pngHeader)
+		part, _ = writer.CreateFormFile("documents", "bad.txt")
+		part.Write([]byte("plain text"))
+		writer.Close()
+		req := httptest.NewRequest("POST", "/", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+
+		store := NewMemoryUploadStore()
+		w := httptest.NewRecorder()
+		GetUploadHandler(UploadHandlerSpec{Store: store, AllowedContentTypes: []string{"image/png"}, AnyField: true})(w, req)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Fatal("Expected 415. Got:", w.Code)
+		}
+		if len(store.objects) != 0 {
+			t.Error("Files from the refused request were left in the store.")
+		}
+	})
+}
+
+func TestUploadHandlerBadRequests(t *testing.T) {
+	metrics := NewMetrics(MetricsSpec{})
+	h := GetUploadHandler(UploadHandlerSpec{Store: NewMemoryUploadStore(), Metrics: metrics})
+
+	noFiles := &bytes.Buffer{}
+	writer := multipart.NewWriter(noFiles)
+	writer.WriteField("comment", "not a file")
+	writer.Close()
+	truncated := multipartUpload(t, "a.txt", "text/plain", []byte("a"))
+	raw, _ := ioutil.ReadAll(truncated.Body)
+
+	cases := []struct {
+		name, contentType string
+		body              []byte
+	}{
+		{"not multipart", "application/json", []byte(`{"file":"a.txt"}`)},
+		{"no files", writer.FormDataContentType(), noFiles.Bytes()},
+		{"truncated body", truncated.Header.Get("Content-Type"), raw[:len(raw)-10]},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400. Got: %d", c.name, w.Code)
+			continue
+		}
+		if e := decodeErrorResponse(t, w); e.Reason != ReasonBadRequest || e.Instance != "/upload" || e.Detail == "" {
+			t.Errorf("%s: unexpected error response: %+v", c.name, e)
+		}
+	}
+	if n := metrics.uploadFailures[ReasonBadRequest]; n != uint64(len(cases)) {
+		t.Errorf("Expected %d bad requests in the metrics. Got: %d", len(cases), n)
+	}
+}
+
+func TestUploadHandlerEscapesDownloadURL(t *testing.T) {
+	store := NewMemoryUploadStore()
+	signer := NewURLSigner(SigningKey{ID: "k1", Secret: []byte("secret")})
+	for _, s := range []*URLSigner{nil, signer} {
+		h := GetUploadHandler(UploadHandlerSpec{Store: store, DownloadURL: "http://example.com/uploads/", Signer: s})
+		w := httptest.NewRecorder()
+		h(w, multipartUpload(t, "50% off #1.txt", "text/plain", []byte("sale")))
+		if w.Code != http.StatusOK {
+			t.Fatal("Upload failed:", w.Code, w.Body.String())
+		}
+		file := decodeManifest(t, w).Files[0]
+		u, err := url.Parse(file.DownloadURL)
+		if err != nil {
+			t.Fatal("Expected a valid download URL. Got:", file.DownloadURL, err)
+		}
+		if u.Fragment != "" || u.Path != "/uploads/"+file.StoredName {
+			t.Errorf("Expected the URL path to carry the stored name %q. Got: %s", file.StoredName, file.DownloadURL)
+		}
+
+		download := http.StripPrefix("/uploads/", GetDownloadHandler(DownloadHandlerSpec{Store: store, Signer: s}))
+		w = httptest.NewRecorder()
+		download.ServeHTTP(w, httptest.NewRequest("GET", u.RequestURI(), nil))
+		if w.Code != http.StatusOK || w.Body.String() != "sale" {
+			t.Error("Expected the download URL to serve the file. Got:", w.Code, w.Body.String())
+		}
+	}
+}
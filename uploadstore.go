@@ -0,0 +1,244 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata keys recorded against every stored upload
+const (
+	MetaOriginalName = "original-name"
+	MetaContentType  = "content-type"
+)
+
+// ErrUploadNotFound is returned by an UploadStore when the named file does not exist
+var ErrUploadNotFound = errors.New("upload not found")
+
+// ErrInvalidStoredName is returned by an UploadStore when the name is not a plain file name
+var ErrInvalidStoredName = errors.New("invalid stored file name")
+
+// StoredFile describes a file held by an UploadStore
+type StoredFile struct {
+	Name     string
+	Size     int64
+	ModTime  time.Time
+	Metadata map[string]string
+}
+
+// UploadStore is where GetUploadHandler puts the files it receives. Readers returned by Get that also implement
+// io.Seeker let GetDownloadHandler serve Range requests.
+type UploadStore interface {
+	Put(ctx context.Context, name string, r io.Reader, metadata map[string]string) (StoredFile, error)
+	Get(ctx context.Context, name string) (io.ReadCloser, StoredFile, error)
+	Stat(ctx context.Context, name string) (StoredFile, error)
+	Delete(ctx context.Context, name string) error
+}
+
+func validateStoredName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return ErrInvalidStoredName
+	}
+	return nil
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	result := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		result[k] = v
+	}
+	return result
+}
+
+const localMetaDir = ".uploadmeta"
+
+// LocalUploadStore stores uploads in a directory on the local disk. Metadata is kept in a hidden
+// sub-directory and only files that have metadata are visible through the store.
+type LocalUploadStore struct {
+	dir string
+}
+
+// NewLocalUploadStore returns a store that keeps files in dir
+func NewLocalUploadStore(dir string) *LocalUploadStore {
+	return &LocalUploadStore{dir: dir}
+}
+
+// Put writes the content of r to name
+func (s *LocalUploadStore) Put(ctx context.Context, name string, r io.Reader, metadata map[string]string) (StoredFile, error) {
+	if err := validateStoredName(name); err != nil {
+		return StoredFile{}, err
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, localMetaDir), 0700); err != nil {
+		return StoredFile{}, err
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".upload-*")
+	if err != nil {
+		return StoredFile{}, err
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return StoredFile{}, err
+	}
+	meta, err := json.Marshal(metadata)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	if err := ioutil.WriteFile(s.metaPath(name), meta, 0600); err != nil {
+		return StoredFile{}, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		os.Remove(s.metaPath(name))
+		return StoredFile{}, err
+	}
+	return StoredFile{Name: name, Size: size, ModTime: time.Now(), Metadata: copyMetadata(metadata)}, nil
+}
+
+// Get opens name for reading
+func (s *LocalUploadStore) Get(ctx context.Context, name string) (io.ReadCloser, StoredFile, error) {
+	info, err := s.Stat(ctx, name)
+	if err != nil {
+		return nil, StoredFile{}, err
+	}
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil, StoredFile{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, StoredFile{}, err
+	}
+	return f, info, nil
+}
+
+// Stat describes name without opening it
+func (s *LocalUploadStore) Stat(ctx context.Context, name string) (StoredFile, error) {
+	if err := validateStoredName(name); err != nil {
+		return StoredFile{}, err
+	}
+	meta, err := ioutil.ReadFile(s.metaPath(name))
+	if os.IsNotExist(err) {
+		return StoredFile{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return StoredFile{}, err
+	}
+	fi, err := os.Stat(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return StoredFile{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return StoredFile{}, err
+	}
+	info := StoredFile{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}
+	if err := json.Unmarshal(meta, &info.Metadata); err != nil {
+		return StoredFile{}, err
+	}
+	return info, nil
+}
+
+// Delete removes name. Deleting a file that does not exist is not an error.
+func (s *LocalUploadStore) Delete(ctx context.Context, name string) error {
+	if err := validateStoredName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.metaPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalUploadStore) metaPath(name string) string {
+	return filepath.Join(s.dir, localMetaDir, name+".json")
+}
+
+type memoryObject struct {
+	data []byte
+	info StoredFile
+}
+
+// MemoryUploadStore keeps uploads in memory. Useful for tests and small deployments.
+type MemoryUploadStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+// NewMemoryUploadStore returns an empty in-memory store
+func NewMemoryUploadStore() *MemoryUploadStore {
+	return &MemoryUploadStore{objects: make(map[string]memoryObject)}
+}
+
+// Put reads r fully and keeps it under name
+func (s *MemoryUploadStore) Put(ctx context.Context, name string, r io.Reader, metadata map[string]string) (StoredFile, error) {
+	if err := validateStoredName(name); err != nil {
+		return StoredFile{}, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	info := StoredFile{Name: name, Size: int64(len(data)), ModTime: time.Now(), Metadata: copyMetadata(metadata)}
+	s.mu.Lock()
+	s.objects[name] = memoryObject{data: data, info: info}
+	s.mu.Unlock()
+	return info, nil
+}
+
+// Get returns a reader over the stored content of name
+func (s *MemoryUploadStore) Get(ctx context.Context, name string) (io.ReadCloser, StoredFile, error) {
+	if err := validateStoredName(name); err != nil {
+		return nil, StoredFile{}, err
+	}
+	s.mu.RLock()
+	obj, ok := s.objects[name]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, StoredFile{}, ErrUploadNotFound
+	}
+	return memoryFile{bytes.NewReader(obj.data)}, obj.info, nil
+}
+
+// memoryFile lets stored content be read and seeked like a file
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error { return nil }
+
+// Stat describes name
+func (s *MemoryUploadStore) Stat(ctx context.Context, name string) (StoredFile, error) {
+	if err := validateStoredName(name); err != nil {
+		return StoredFile{}, err
+	}
+	s.mu.RLock()
+	obj, ok := s.objects[name]
+	s.mu.RUnlock()
+	if !ok {
+		return StoredFile{}, ErrUploadNotFound
+	}
+	return obj.info, nil
+}
+
+// Delete forgets name
+func (s *MemoryUploadStore) Delete(ctx context.Context, name string) error {
+	if err := validateStoredName(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.objects, name)
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalUploadStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploadstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testUploadStore(t, NewLocalUploadStore(dir))
+
+	t.Run("Files without metadata are not visible", func(t *testing.T) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "stray.txt"), []byte("stray"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		store := NewLocalUploadStore(dir)
+		if _, err := store.Stat(context.Background(), "stray.txt"); err != ErrUploadNotFound {
+			t.Error("Expected ErrUploadNotFound for a file the store did not write. Got:", err)
+		}
+	})
+}
+
+func TestMemoryUploadStore(t *testing.T) {
+	testUploadStore(t, NewMemoryUploadStore())
+}
+
+func testUploadStore(t *testing.T, store UploadStore) {
+	ctx := context.Background()
+	data := "this is test content of the file that will be uploaded."
+
+	t.Run("Put, Get and Stat", func(t *testing.T) {
+		info, err := store.Put(ctx, "a.txt", strings.NewReader(data), map[string]string{MetaOriginalName: "ä.txt"})
+		if err != nil {
+			t.Fatal("Error during Put:", err)
+		}
+		if info.Size != int64(len(data)) {
+			t.Errorf("Expected size %d. Got %d.", len(data), info.Size)
+		}
+		rc, info, err := store.Get(ctx, "a.txt")
+		if err != nil {
+			t.Fatal("Error during Get:", err)
+		}
+		defer rc.Close()
+		content, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != data {
+			t.Error("Content did not match. Got:", string(content))
+		}
+		if info.Metadata[MetaOriginalName] != "ä.txt" {
+			t.Error("Metadata was not preserved. Got:", info.Metadata)
+		}
+		info, err = store.Stat(ctx, "a.txt")
+		if err != nil {
+			t.Fatal("Error during Stat:", err)
+		}
+		if info.Size != int64(len(data)) {
+			t.Errorf("Expected size %d from Stat. Got %d.", len(data), info.Size)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := store.Delete(ctx, "a.txt"); err != nil {
+			t.Fatal("Error during Delete:", err)
+		}
+		if _, err := store.Stat(ctx, "a.txt"); err != ErrUploadNotFound {
+			t.Error("Expected ErrUploadNotFound after Delete. Got:", err)
+		}
+		if _, _, err := store.Get(ctx, "a.txt"); err != ErrUploadNotFound {
+			t.Error("Expected ErrUploadNotFound from Get after Delete. Got:", err)
+		}
+		if err := store.Delete(ctx, "a.txt"); err != nil {
+			t.Error("Deleting a missing file should not fail. Got:", err)
+		}
+	})
+
+	t.Run("Invalid names", func(t *testing.T) {
+		for _, name := range []string{"", "..", "../a.txt", "a/b.txt", `a\b.txt`} {
+			if _, err := store.Put(ctx, name, strings.NewReader(data), nil); err != ErrInvalidStoredName {
+				t.Errorf("Expected ErrInvalidStoredName for %q. Got: %v", name, err)
+			}
+			if _, _, err := store.Get(ctx, name); err != ErrInvalidStoredName {
+				t.Errorf("Expected ErrInvalidStoredName from Get for %q. Got: %v", name, err)
+			}
+			if _, err := store.Stat(ctx, name); err != ErrInvalidStoredName {
+				t.Errorf("Expected ErrInvalidStoredName from Stat for %q. Got: %v", name, err)
+			}
+			if err := store.Delete(ctx, name); err != ErrInvalidStoredName {
+				t.Errorf("Expected ErrInvalidStoredName from Delete for %q. Got: %v", name, err)
+			}
+		}
+	})
+}
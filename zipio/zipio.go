@@ -2,30 +2,49 @@ package zipio
 
 import (
 	"archive/zip"
+	"context"
 	"io"
 	"os"
+
+	"github.com/arunsworld/go-service/tracing"
 )
 
 type zipWriter struct {
 	file io.WriteCloser
 	zw   *zip.Writer
 	w    io.Writer
+	span *tracing.Span
+	n    int64
 }
 
 func (z *zipWriter) Write(p []byte) (n int, err error) {
-	return z.w.Write(p)
+	n, err = z.w.Write(p)
+	z.n += int64(n)
+	return n, err
 }
 
 func (z *zipWriter) Close() error {
 	z.zw.Close()
 	z.file.Close()
+	z.span.SetAttribute("file.bytes", z.n)
+	z.span.End()
 	return nil
 }
 
 // Create creates a new single file zip writer
 func Create(filename string) (io.WriteCloser, error) {
+	return CreateContext(context.Background(), filename)
+}
+
+// CreateContext creates a new single file zip writer, recording a span in the trace carried by ctx that ends
+// when the writer is closed
+func CreateContext(ctx context.Context, filename string) (io.WriteCloser, error) {
+	_, span := tracing.Start(ctx, "zipio.Create")
+	span.SetAttribute("file.path", filename)
 	f, err := os.Create(filename)
 	if err != nil {
+		span.RecordError(err)
+		span.End()
 		return nil, err
 	}
 	zw := zip.NewWriter(f)
@@ -33,43 +52,65 @@ func Create(filename string) (io.WriteCloser, error) {
 	if err != nil {
 		zw.Close()
 		f.Close()
+		span.RecordError(err)
+		span.End()
 		return nil, err
 	}
 	return &zipWriter{
 		file: f,
 		zw:   zw,
 		w:    w,
+		span: span,
 	}, nil
 }
 
 type zipReader struct {
-	zr *zip.ReadCloser
-	r  io.ReadCloser
+	zr   *zip.ReadCloser
+	r    io.ReadCloser
+	span *tracing.Span
+	n    int64
 }
 
 func (z *zipReader) Read(p []byte) (n int, err error) {
-	return z.r.Read(p)
+	n, err = z.r.Read(p)
+	z.n += int64(n)
+	return n, err
 }
 
 func (z *zipReader) Close() error {
 	z.r.Close()
 	z.zr.Close()
+	z.span.SetAttribute("file.bytes", z.n)
+	z.span.End()
 	return nil
 }
 
 // Open opens a new single file zip for reading
 func Open(filename string) (io.ReadCloser, error) {
+	return OpenContext(context.Background(), filename)
+}
+
+// OpenContext opens a new single file zip for reading, recording a span in the trace carried by ctx that ends
+// when the reader is closed
+func OpenContext(ctx context.Context, filename string) (io.ReadCloser, error) {
+	_, span := tracing.Start(ctx, "zipio.Open")
+	span.SetAttribute("file.path", filename)
 	zr, err := zip.OpenReader(filename)
 	if err != nil {
+		span.RecordError(err)
+		span.End()
 		return nil, err
 	}
 	r, err := zr.File[0].Open()
 	if err != nil {
 		zr.Close()
+		span.RecordError(err)
+		span.End()
 		return nil, err
 	}
 	return &zipReader{
-		zr: zr,
-		r:  r,
+		zr:   zr,
+		r:    r,
+		span: span,
 	}, nil
 }
@@ -1,13 +1,17 @@
 package zipio
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/gob"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/arunsworld/go-service/tracing"
 )
 
 func TestZipWriter(t *testing.T) {
@@ -74,6 +78,44 @@ func TestZipReader(t *testing.T) {
 	}
 }
 
+func TestZipContextSpans(t *testing.T) {
+	exporter := tracing.NewMemoryExporter()
+	ctx, parent := tracing.NewTracer(tracing.TracerSpec{Exporter: exporter}).Start(context.Background(), "job", tracing.SpanKindInternal)
+	filename := filepath.Join(t.TempDir(), "spans.zip")
+
+	w, err := CreateContext(ctx, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+	r, err := OpenContext(ctx, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(r)
+	r.Close()
+	if _, err := OpenContext(ctx, filepath.Join(t.TempDir(), "missing.zip")); err == nil {
+		t.Fatal("Expected an error opening a missing file.")
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 3 {
+		t.Fatal("Expected a span per file. Got: ", len(spans))
+	}
+	for i, name := range []string{"zipio.Create", "zipio.Open", "zipio.Open"} {
+		if spans[i].Name != name || spans[i].ParentSpanID != parent.SpanContext().SpanID.String() {
+			t.Errorf("Unexpected span: %+v", spans[i])
+		}
+	}
+	if spans[0].Attributes["file.bytes"] != int64(5) || spans[1].Attributes["file.bytes"] != int64(5) {
+		t.Error("Expected the bytes written and read on the spans.")
+	}
+	if spans[2].Status != tracing.StatusError {
+		t.Error("Expected the failed open to be marked as an error.")
+	}
+}
+
 func BenchmarkZipWriter(b *testing.B) {
 	content := []string{}
 	for i := 0; i < 1000000; i++ {